@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Event source and detail types used for shifts requested through the admin API
+const (
+	manualEventSource    = "zonal-shift.manual"
+	manualShiftStarted   = "Manual Shift Started"
+	manualShiftCancelled = "Manual Shift Cancelled"
+
+	// adminTokenPrincipal is the principal audited for requests made with the admin token
+	adminTokenPrincipal = "admin-token"
+)
+
+// registerAdminRoutes adds the admin API that reports what the service has done.
+// Every endpoint requires the admin token, since the shifts, NodePools and
+// audit records describe the cluster's topology and incident history.
+func registerAdminRoutes(api *gin.RouterGroup) {
+	api.Use(requireAdminToken)
+	api.GET("/shifts", handleListShifts)
+	api.GET("/nodepools", handleListNodePools)
+	api.GET("/events", handleListEvents)
+	api.GET("/audit", handleListAudit)
+	api.POST("/shifts", handleCreateShift)
+	api.DELETE("/shifts/:id", handleDeleteShift)
+}
+
+// requireAdminToken only lets through requests carrying the configured admin
+// bearer token. The admin API is disabled when no token is configured.
+func requireAdminToken(c *gin.Context) {
+	if principal, ok := clientPrincipal(c.Request, appConfig.TLS.AdminClients); ok {
+		c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), principal))
+		c.Next()
+		return
+	}
+	token := appConfig.AdminAPIToken
+	if token == "" && len(appConfig.TLS.AdminClients) == 0 {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin API is disabled, ADMIN_API_TOKEN is not set"})
+		return
+	}
+	auth := c.GetHeader("Authorization")
+	if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+		slog.Warn("Rejected unauthenticated admin request", "method", c.Request.Method, "path", c.Request.URL.Path, "client_ip", c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), adminTokenPrincipal))
+	c.Next()
+}
+
+// handleListShifts returns the shifts the service is currently acting on
+func handleListShifts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"shifts": store.ActiveShifts()})
+}
+
+// handleListNodePools returns the original and current zones of every NodePool
+func handleListNodePools(c *gin.Context) {
+	processor, err := newProcessor()
+	if err != nil {
+		slog.Error("Failed to create processor", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	statuses, err := processor.NodePoolZones(c.Request.Context())
+	if err != nil {
+		slog.Error("Failed to read node pools", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"nodePools": statuses})
+}
+
+// handleListEvents returns recently processed events and their outcome
+func handleListEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": store.RecentEvents()})
+}
+
+// manualShiftRequest is the body of POST /api/v1/shifts
+type manualShiftRequest struct {
+	ZoneID string `json:"zoneId" binding:"required"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"`
+}
+
+// handleCreateShift starts a manual shift away from a zone, going through the
+// same processing, safety policy and event record as autoshift events
+func handleCreateShift(c *gin.Context) {
+	var req manualShiftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Shifts are kept by zone ID, so a zone given by name is resolved first
+	region := appConfig.Region
+	processor, err := newProcessor()
+	if err != nil {
+		slog.Error("Failed to create processor", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	zone, err := processor.ResolveZone(c.Request.Context(), region, req.ZoneID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	event := Event{
+		Version:    "0",
+		ID:         newShiftID(),
+		DetailType: manualShiftStarted,
+		Source:     manualEventSource,
+		Time:       now.Format(time.RFC3339),
+		Region:     region,
+		Detail:     Detail{Metadata: Metadata{AwayFrom: zone.ID, Notes: req.Reason}},
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ttl %q", req.TTL)})
+			return
+		}
+		event.Detail.Metadata.ExpiryTime = now.Add(ttl).Format(time.RFC3339)
+	}
+
+	slog.Info("Manual shift requested", "event_id", event.ID, "zone_id", zone.ID, "client_ip", c.ClientIP(), "reason", req.Reason)
+	if queueForLeader(c, event) {
+		return
+	}
+	record, err := updateKarpenterNodePool(processingContext(c), event)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "event": record})
+		return
+	}
+	shift, _ := store.ShiftForZone(zone.ID, false)
+	c.JSON(http.StatusCreated, gin.H{"shift": shift, "event": record})
+}
+
+// handleDeleteShift ends an active shift and restores its zone to the node pools
+func handleDeleteShift(c *gin.Context) {
+	shift, ok := store.GetShift(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shift not found"})
+		return
+	}
+
+	// The zone is restored in the region the shift was started in
+	region := shift.Region
+	if region == "" {
+		region = appConfig.Region
+	}
+	event := Event{
+		Version:    "0",
+		ID:         newShiftID(),
+		DetailType: manualShiftCancelled,
+		Source:     manualEventSource,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Region:     region,
+		Detail:     Detail{Metadata: Metadata{AwayFrom: shift.ZoneID, ShiftType: shiftTypeOf(shift)}},
+	}
+
+	slog.Info("Manual restore requested", "event_id", event.ID, "shift_id", shift.ID, "zone_id", shift.ZoneID, "client_ip", c.ClientIP())
+	if queueForLeader(c, event) {
+		return
+	}
+	record, err := updateKarpenterNodePool(processingContext(c), event)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "event": record})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shift": shift, "event": record})
+}
+
+// queueForLeader hands a manual event to the leader when this replica is not
+// leading, responding with 202 and the queued event ID. It reports whether it
+// handled the request.
+func queueForLeader(c *gin.Context, event Event) bool {
+	if leading.Load() {
+		return false
+	}
+	if err := handleEvent(c.Request.Context(), event); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return true
+	}
+	c.JSON(http.StatusAccepted, gin.H{"queued": event.ID})
+	return true
+}
+
+// processingContext is the context a request processes its event in. A client
+// that disconnects does not cancel it, so NodePools are never left half changed.
+func processingContext(c *gin.Context) context.Context {
+	return context.WithoutCancel(c.Request.Context())
+}
+
+// handleListAudit returns audit records, filtered by the since and until
+// (RFC 3339), nodepool, zone and limit query parameters
+func handleListAudit(c *gin.Context) {
+	if auditLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "audit log is not enabled"})
+		return
+	}
+
+	query := AuditQuery{NodePool: c.Query("nodepool"), Zone: c.Query("zone")}
+	for param, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := c.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s %q", param, value)})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q", value)})
+			return
+		}
+		query.Limit = limit
+	}
+
+	records, err := auditLog.Query(c.Request.Context(), query)
+	if err != nil {
+		slog.Error("Failed to query audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
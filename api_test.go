@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestProcessor points the server at a fake cluster and a fresh store, as the leader
+func useTestProcessor(t *testing.T, processor *Processor) {
+	originalProcessor, originalStore, originalLeading := newProcessor, store, leading.Load()
+	newProcessor = func() (*Processor, error) { return processor, nil }
+	store = NewShiftStore()
+	leading.Store(true)
+	t.Cleanup(func() {
+		newProcessor, store = originalProcessor, originalStore
+		leading.Store(originalLeading)
+	})
+}
+
+// testAdminToken is the admin token getJSON authenticates with
+const testAdminToken = "secret"
+
+// useAdminToken sets the admin token, keeping the rest of the configuration in use
+func useAdminToken(t *testing.T) {
+	original := appConfig
+	c := *appConfig
+	c.AdminAPIToken = testAdminToken
+	applyConfig(&c)
+	t.Cleanup(func() { applyConfig(original) })
+}
+
+func getJSON(t *testing.T, path string, out interface{}) {
+	useAdminToken(t)
+	req, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), out))
+}
+
+func TestAdminAPIReportsShift(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+
+	event := testShiftEvent("Autoshift In Progress")
+	event.ID = "event-1"
+	event.Resources = []string{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/web/1"}
+	_, err := updateKarpenterNodePool(context.Background(), event)
+	require.NoError(t, err)
+
+	var shifts struct{ Shifts []Shift }
+	getJSON(t, "/api/v1/shifts", &shifts)
+	require.Len(t, shifts.Shifts, 1)
+	assert.Equal(t, "use1-az1", shifts.Shifts[0].ZoneID)
+	assert.Equal(t, []string{"default"}, shifts.Shifts[0].NodePools)
+	assert.Equal(t, event.Resources, shifts.Shifts[0].Resources)
+
+	var pools struct{ NodePools []NodePoolStatus }
+	getJSON(t, "/api/v1/nodepools", &pools)
+	require.Len(t, pools.NodePools, 1)
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, pools.NodePools[0].OriginalZones)
+	assert.Equal(t, []string{"us-east-1b"}, pools.NodePools[0].CurrentZones)
+
+	_, err = updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift Completed"))
+	require.NoError(t, err)
+	getJSON(t, "/api/v1/shifts", &shifts)
+	assert.Empty(t, shifts.Shifts)
+
+	var events struct{ Events []EventRecord }
+	getJSON(t, "/api/v1/events", &events)
+	require.Len(t, events.Events, 2)
+	assert.Equal(t, "Autoshift Completed", events.Events[0].DetailType)
+	assert.Equal(t, outcomeApplied, events.Events[1].Outcome)
+}
+
+func sendJSON(t *testing.T, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	reqBody, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(method, path, bytes.NewBuffer(reqBody))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestManualShiftRequiresToken(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	body := manualShiftRequest{ZoneID: "use1-az1"}
+
+	useTestConfig(t, func(c *Config) { c.AdminAPIToken = "" })
+	assert.Equal(t, http.StatusForbidden, sendJSON(t, "POST", "/api/v1/shifts", "secret", body).Code)
+
+	useTestConfig(t, func(c *Config) { c.AdminAPIToken = "secret" })
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(t, "POST", "/api/v1/shifts", "", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(t, "POST", "/api/v1/shifts", "wrong", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(t, "DELETE", "/api/v1/shifts/abc", "wrong", nil).Code)
+}
+
+func TestAdminAPIReadsRequireToken(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	for _, path := range []string{"/api/v1/shifts", "/api/v1/nodepools", "/api/v1/events", "/api/v1/audit"} {
+		useTestConfig(t, func(c *Config) { c.AdminAPIToken = "" })
+		assert.Equal(t, http.StatusForbidden, sendJSON(t, "GET", path, "secret", nil).Code, path)
+
+		useTestConfig(t, func(c *Config) { c.AdminAPIToken = "secret" })
+		assert.Equal(t, http.StatusUnauthorized, sendJSON(t, "GET", path, "", nil).Code, path)
+		assert.Equal(t, http.StatusUnauthorized, sendJSON(t, "GET", path, "wrong", nil).Code, path)
+	}
+}
+
+func TestManualShiftAndRestore(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.AdminAPIToken = "secret" })
+
+	assert.Equal(t, http.StatusBadRequest,
+		sendJSON(t, "POST", "/api/v1/shifts", "secret", manualShiftRequest{ZoneID: "use1-az1", TTL: "soon"}).Code)
+
+	rr := sendJSON(t, "POST", "/api/v1/shifts", "secret", manualShiftRequest{ZoneID: "use1-az1", Reason: "packet loss", TTL: "1h"})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created struct {
+		Shift Shift
+		Event EventRecord
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, manualEventSource, created.Shift.Source)
+	assert.Equal(t, "packet loss", created.Shift.Reason)
+	require.NotNil(t, created.Shift.ExpiresAt)
+	assert.Equal(t, []string{"default"}, created.Shift.NodePools)
+	assert.Equal(t, outcomeApplied, created.Event.Outcome)
+	assert.Equal(t, []string{"us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+
+	assert.Equal(t, http.StatusNotFound, sendJSON(t, "DELETE", "/api/v1/shifts/unknown", "secret", nil).Code)
+	rr = sendJSON(t, "DELETE", "/api/v1/shifts/"+created.Shift.ID, "secret", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, store.ActiveShifts())
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+}
+
+func TestManualRestoreUsesShiftRegion(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.AdminAPIToken = "secret"; c.Region = "us-east-1" })
+	resolver := &regionZoneResolver{fakeZoneResolver: testZones}
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, resolver))
+	store.StartShift(Shift{ID: "eu", ZoneID: "use1-az1", Region: "eu-west-1", Source: manualEventSource, StartedAt: time.Now()})
+
+	rr := sendJSON(t, "DELETE", "/api/v1/shifts/eu", "secret", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{"eu-west-1"}, slices.Compact(resolver.regions))
+	assert.Empty(t, store.ActiveShifts())
+}
+
+func TestManualShiftByZoneName(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.AdminAPIToken = "secret" })
+
+	assert.Equal(t, http.StatusBadRequest, sendJSON(t, "POST", "/api/v1/shifts", "secret", manualShiftRequest{ZoneID: "us-east-1z"}).Code)
+
+	rr := sendJSON(t, "POST", "/api/v1/shifts", "secret", manualShiftRequest{ZoneID: "us-east-1a"})
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created struct{ Shift Shift }
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, "use1-az1", created.Shift.ZoneID)
+	assert.Equal(t, "us-east-1a", created.Shift.Zone)
+	assert.Equal(t, []string{"default"}, created.Shift.NodePools)
+}
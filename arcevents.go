@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Detail types of the EventBridge events Route 53 ARC sends for zonal shifts,
+// autoshifts and practice runs
+const (
+	detailAutoshiftInProgress    = "Autoshift In Progress"
+	detailAutoshiftCompleted     = "Autoshift Completed"
+	detailAutoshiftCancelled     = "Autoshift Cancelled"
+	detailZonalShiftInProgress   = "Zonal Shift In Progress"
+	detailZonalShiftCompleted    = "Zonal Shift Completed"
+	detailZonalShiftCancelled    = "Zonal Shift Cancelled"
+	detailPracticeRunStarted     = "Practice Run Started"
+	detailPracticeRunSucceeded   = "Practice Run Succeeded"
+	detailPracticeRunInterrupted = "Practice Run Interrupted"
+	detailPracticeRunFailed      = "Practice Run Failed"
+)
+
+// arcDetailTypes are the detail types an ARC event may have
+var arcDetailTypes = []string{
+	detailAutoshiftInProgress, detailAutoshiftCompleted, detailAutoshiftCancelled,
+	detailZonalShiftInProgress, detailZonalShiftCompleted, detailZonalShiftCancelled,
+	detailPracticeRunStarted, detailPracticeRunSucceeded, detailPracticeRunInterrupted, detailPracticeRunFailed,
+}
+
+// arcSources are the event sources parsed as ARC events
+var arcSources = []string{"aws.arc", "aws.arc-zonal-shift"}
+
+// Values of the status, shiftType and practiceRunOutcome metadata fields, as in the ARC API
+var (
+	arcStatuses            = []string{"ACTIVE", "EXPIRED", "CANCELED", "COMPLETED"}
+	arcShiftTypes          = []string{"ZONAL_SHIFT", "ZONAL_AUTOSHIFT", "PRACTICE_RUN", "FIS_EXPERIMENT"}
+	arcPracticeRunOutcomes = []string{"PENDING", "SUCCEEDED", "INTERRUPTED", "FAILED"}
+)
+
+// arcDetailVersion is the newest detail version whose fields are all modelled.
+// Newer minor and patch versions only add fields, so they are read without
+// the fields the model lacks; another major version is refused.
+var arcDetailVersion = detailVersion{0, 0, 1}
+
+// Detail is the detail of an ARC event
+type Detail struct {
+	Version  string   `json:"version"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Metadata describes the shift an ARC event is about
+type Metadata struct {
+	// AwayFrom is the ID of the zone traffic is shifted away from, such as use1-az1
+	AwayFrom string `json:"awayFrom"`
+	Notes    string `json:"notes"`
+	// StartTime and ExpiryTime are RFC 3339 times
+	StartTime  string `json:"startTime,omitempty"`
+	ExpiryTime string `json:"expiryTime,omitempty"`
+	// Status is ACTIVE, EXPIRED, CANCELED or COMPLETED
+	Status string `json:"status,omitempty"`
+	// ShiftType is ZONAL_SHIFT, ZONAL_AUTOSHIFT, PRACTICE_RUN or FIS_EXPERIMENT
+	ShiftType    string `json:"shiftType,omitempty"`
+	ZonalShiftID string `json:"zonalShiftId,omitempty"`
+	// ResourceIdentifier is the ARN of the shifted resource, such as a load balancer
+	ResourceIdentifier string `json:"resourceIdentifier,omitempty"`
+	// PracticeRunOutcome is PENDING, SUCCEEDED, INTERRUPTED or FAILED
+	PracticeRunOutcome string `json:"practiceRunOutcome,omitempty"`
+}
+
+// detailVersion is a MAJOR.MINOR.PATCH detail version
+type detailVersion [3]int
+
+func parseDetailVersion(value string) (detailVersion, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return detailVersion{}, fmt.Errorf("invalid detail version %q", value)
+	}
+	var v detailVersion
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return detailVersion{}, fmt.Errorf("invalid detail version %q", value)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v detailVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// newerThan reports whether v is a later version than other
+func (v detailVersion) newerThan(other detailVersion) bool {
+	return slices.Compare(v[:], other[:]) > 0
+}
+
+// isARCEvent reports whether the event comes from Route 53 ARC
+func isARCEvent(event Event) bool {
+	return slices.Contains(arcSources, event.Source)
+}
+
+// parseEvent decodes an EventBridge event. ARC events are parsed strictly:
+// unknown fields, unknown detail types and unsupported detail versions are
+// refused. Other events are decoded as they come.
+func parseEvent(data []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return Event{}, err
+	}
+	if !isARCEvent(event) {
+		return event, nil
+	}
+
+	if event.Version != "0" {
+		return Event{}, fmt.Errorf("unsupported event version %q", event.Version)
+	}
+	if !slices.Contains(arcDetailTypes, event.DetailType) {
+		return Event{}, fmt.Errorf("unknown ARC detail type %q", event.DetailType)
+	}
+	version, err := parseDetailVersion(event.Detail.Version)
+	if err != nil {
+		return Event{}, err
+	}
+	if version[0] != arcDetailVersion[0] {
+		return Event{}, fmt.Errorf("unsupported detail version %s, only %d.x is supported", version, arcDetailVersion[0])
+	}
+	if version.newerThan(arcDetailVersion) {
+		slog.Warn("Event detail version is newer than the model, ignoring unknown fields", "event_id", event.ID, "detail_version", version.String())
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&event); err != nil {
+			return Event{}, err
+		}
+	}
+	if err := validateARCMetadata(event.Detail.Metadata); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// validateARCMetadata checks the typed metadata fields that are set
+func validateARCMetadata(m Metadata) error {
+	var errs []error
+	for name, value := range map[string]string{"startTime": m.StartTime, "expiryTime": m.ExpiryTime} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid detail.metadata.%s %q", name, value))
+		}
+	}
+	for _, field := range []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"status", m.Status, arcStatuses},
+		{"shiftType", m.ShiftType, arcShiftTypes},
+		{"practiceRunOutcome", m.PracticeRunOutcome, arcPracticeRunOutcomes},
+	} {
+		if field.value != "" && !slices.Contains(field.allowed, field.value) {
+			errs = append(errs, fmt.Errorf("unknown detail.metadata.%s %q", field.name, field.value))
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestParseEventGolden parses every sample payload in testdata/events and
+// compares the result, or the error, with its .golden file
+func TestParseEventGolden(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "events", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, samples)
+	for _, sample := range samples {
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			data, err := os.ReadFile(sample)
+			require.NoError(t, err)
+
+			var got []byte
+			event, err := parseEvent(data)
+			if err != nil {
+				got = []byte("error: " + err.Error() + "\n")
+			} else {
+				got, err = json.MarshalIndent(event, "", "  ")
+				require.NoError(t, err)
+				got = append(got, '\n')
+			}
+
+			golden := strings.TrimSuffix(sample, ".json") + ".golden"
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, got, 0o644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
+
+func TestParseEventLeavesOtherSourcesAlone(t *testing.T) {
+	event, err := parseEvent([]byte(`{"version": "1.0", "id": "abc123", "detail-type": "EC2 Instance State-change Notification", "source": "aws.ec2", "detail": {"state": "running", "metadata": {"awayFrom": "use1-az1"}}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "use1-az1", event.Detail.Metadata.AwayFrom)
+	assert.False(t, isARCEvent(event))
+}
+
+func TestDetailVersion(t *testing.T) {
+	v, err := parseDetailVersion("0.10.2")
+	require.NoError(t, err)
+	assert.Equal(t, detailVersion{0, 10, 2}, v)
+	assert.True(t, v.newerThan(arcDetailVersion))
+	assert.False(t, arcDetailVersion.newerThan(arcDetailVersion))
+
+	for _, value := range []string{"", "1", "0.0", "0.0.x", "0.-1.0"} {
+		_, err := parseDetailVersion(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultAuditMaxSize is the size at which the audit file is rotated
+	defaultAuditMaxSize = 10 << 20
+
+	// auditRotatedTimeFormat names rotated audit files so they sort by age
+	auditRotatedTimeFormat = "20060102T150405.000000000Z"
+
+	// auditConfigMapName is the ConfigMap holding the audit records
+	auditConfigMapName = "zonal-shift-audit"
+
+	// defaultAuditConfigMapRecords is how many records the ConfigMap holds
+	// before it refuses more, staying well under the 1MiB ConfigMap limit
+	defaultAuditConfigMapRecords = 500
+
+	// auditWriteTimeout bounds writing one audit record
+	auditWriteTimeout = 10 * time.Second
+
+	// reconcilerActor is the actor recorded for changes made by the NodePool reconciler
+	reconcilerActor = "zonal-shift.reconciler"
+
+	// Audit record operations: a NodePool updated or created, or a change a
+	// practice run would have made
+	auditOperationUpdate  = "update"
+	auditOperationCreate  = "create"
+	auditOperationObserve = "observe"
+)
+
+// errAuditLogFull is returned when the audit log would have to drop records to take more
+var errAuditLogFull = errors.New("audit log is full")
+
+// AuditRecord is one NodePool mutation, successful or not
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Actor is what made the change: the source of the event, or the reconciler
+	Actor string `json:"actor"`
+	// Principal is the authenticated caller that asked for a manual change
+	Principal string `json:"principal,omitempty"`
+	// Replica is the pod that made the change
+	Replica   string   `json:"replica,omitempty"`
+	NodePool  string   `json:"nodePool"`
+	Operation string   `json:"operation"`
+	Action    string   `json:"action"`
+	Zone      string   `json:"zone,omitempty"`
+	EventID   string   `json:"eventId,omitempty"`
+	ShiftID   string   `json:"shiftId,omitempty"`
+	OldZones  []string `json:"oldZones"`
+	NewZones  []string `json:"newZones"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// AuditQuery selects audit records; zero fields match everything
+type AuditQuery struct {
+	Since    time.Time
+	Until    time.Time
+	NodePool string
+	Zone     string
+	// Limit keeps only the most recent records
+	Limit int
+}
+
+func (q AuditQuery) matches(r AuditRecord) bool {
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	if q.NodePool != "" && r.NodePool != q.NodePool {
+		return false
+	}
+	return q.Zone == "" || r.Zone == q.Zone
+}
+
+// filter returns the matching records, oldest first, keeping the newest Limit of them
+func (q AuditQuery) filter(records []AuditRecord) []AuditRecord {
+	matched := []AuditRecord{}
+	for _, r := range records {
+		if q.matches(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.Before(matched[j].Time) })
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched
+}
+
+// AuditLog keeps an append-only record of NodePool mutations
+type AuditLog interface {
+	Append(ctx context.Context, record AuditRecord) error
+	Query(ctx context.Context, query AuditQuery) ([]AuditRecord, error)
+}
+
+// fileAuditLog appends JSON lines to a file, rotating it once it grows past
+// maxSize to path.<time>. Rotated files are never removed; archiving them is
+// left to the operator.
+type fileAuditLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newFileAuditLog(path string, maxSize int64) (*fileAuditLog, error) {
+	l := &fileAuditLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *fileAuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %v", err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the file aside, named by the time of rotation, and starts a new one
+func (l *fileAuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	rotated := l.path + "." + time.Now().UTC().Format(auditRotatedTimeFormat)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// rotated returns the rotated files, oldest first
+func (l *fileAuditLog) rotated() ([]string, error) {
+	paths, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (l *fileAuditLog) Append(ctx context.Context, record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return l.file.Sync()
+}
+
+func (l *fileAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths, err := l.rotated()
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	for _, path := range append(paths, l.path) {
+		read, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, read...)
+	}
+	return query.filter(records), nil
+}
+
+// readAuditFile reads the records in one audit file, which may not exist
+func readAuditFile(path string) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			slog.Warn("Skipping unreadable audit record", "file", path, "error", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// configMapAuditLog keeps records in a ConfigMap shared by every replica, one
+// key per record. Records are never changed or dropped: once it holds
+// maxRecords, appends fail until the records are archived and removed.
+type configMapAuditLog struct {
+	state      *configMapState
+	maxRecords int
+}
+
+func newConfigMapAuditLog(clientset kubernetes.Interface, namespace string, maxRecords int) *configMapAuditLog {
+	return &configMapAuditLog{
+		state:      &configMapState{client: clientset.CoreV1().ConfigMaps(namespace), name: auditConfigMapName},
+		maxRecords: maxRecords,
+	}
+}
+
+func (l *configMapAuditLog) Append(ctx context.Context, record AuditRecord) error {
+	// Observed practice runs change nothing, and weekly runs would fill the
+	// capped ConfigMap with them; the file keeps them as evidence
+	if record.Operation == auditOperationObserve {
+		return nil
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// Keys sort by time, with a random suffix so records made in the same instant do not collide
+	key := fmt.Sprintf("%020d-%s", record.Time.UnixNano(), newShiftID())
+	full := false
+	err = l.state.update(ctx, func(data map[string]string) {
+		if full = len(data) >= l.maxRecords; !full {
+			data[key] = string(value)
+		}
+	})
+	if err == nil && full {
+		err = fmt.Errorf("%w: ConfigMap %s holds %d records", errAuditLogFull, auditConfigMapName, l.maxRecords)
+	}
+	return err
+}
+
+func (l *configMapAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	cm, _, err := l.state.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AuditRecord, 0, len(cm.Data))
+	for key, value := range cm.Data {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			slog.Warn("Skipping unreadable audit record", "key", key, "error", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return query.filter(records), nil
+}
+
+// multiAuditLog appends to every log and queries the first
+type multiAuditLog []AuditLog
+
+func (m multiAuditLog) Append(ctx context.Context, record AuditRecord) error {
+	var errs []error
+	for _, l := range m {
+		errs = append(errs, l.Append(ctx, record))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiAuditLog) Query(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	return m[0].Query(ctx, query)
+}
+
+// auditLog records NodePool mutations made by the server; serve sets it when auditing is configured
+var auditLog AuditLog
+
+// newAuditLogFromConfig writes to the configured file, rotated at
+// audit.maxSize bytes, and with audit.configMap also to a ConfigMap, which
+// then answers queries since every replica sees it. It returns nil when
+// neither is configured.
+func newAuditLogFromConfig(clientset kubernetes.Interface) (AuditLog, error) {
+	c := appConfig.Audit
+	var logs multiAuditLog
+	if c.ConfigMap {
+		if clientset == nil {
+			return nil, errors.New("audit.configMap requires running in a cluster")
+		}
+		logs = append(logs, newConfigMapAuditLog(clientset, podNamespace(), c.ConfigMapMaxRecords))
+	}
+	if c.File != "" {
+		file, err := newFileAuditLog(c.File, int64(c.MaxSize))
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, file)
+	}
+	switch len(logs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return logs[0], nil
+	}
+	return logs, nil
+}
+
+// auditChange records a NodePool mutation, or with the observe operation a
+// change a practice run would have made. The change has already been made,
+// so a record that cannot be written is reported rather than failing it. The
+// write gets its own deadline, so a cancelled event does not lose the record.
+func (p *Processor) auditChange(ctx context.Context, change NodePoolChange, operation string, applyErr error) {
+	if p.Audit == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+	record := AuditRecord{
+		Time:      time.Now().UTC(),
+		Actor:     change.Source,
+		Principal: principalFrom(ctx),
+		Replica:   replicaIdentity(),
+		NodePool:  change.Name,
+		Operation: operation,
+		Action:    "shift",
+		Zone:      change.Zone,
+		EventID:   change.EventID,
+		ShiftID:   change.ShiftID,
+		OldZones:  change.OldZones,
+		NewZones:  change.NewZones,
+	}
+	if change.Restore {
+		record.Action = "restore"
+	}
+	if applyErr != nil {
+		record.Error = applyErr.Error()
+	}
+	if err := p.Audit.Append(ctx, record); err != nil {
+		auditWriteFailuresTotal.Inc()
+		slog.Error("Failed to write audit record", "nodepool", change.Name, "event_id", change.EventID, "record", record, "error", err)
+	}
+}
+
+// principalKey is the context key of the authenticated caller behind a change
+type principalKey struct{}
+
+// withPrincipal returns ctx carrying the authenticated caller
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	if principal == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom returns the authenticated caller carried by ctx, if any
+func principalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
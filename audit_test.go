@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testAuditRecord(i int, pool string) AuditRecord {
+	return AuditRecord{
+		Time:     time.Date(2025, 1, 1, 0, i, 0, 0, time.UTC),
+		Actor:    "aws.arc",
+		NodePool: pool,
+		Action:   "shift",
+		Zone:     "us-east-1a",
+		EventID:  fmt.Sprint("event-", i),
+		OldZones: []string{"us-east-1a", "us-east-1b"},
+		NewZones: []string{"us-east-1b"},
+	}
+}
+
+func TestFileAuditLogRotates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := newFileAuditLog(path, 600)
+	require.NoError(t, err)
+
+	for i := 0; i < 12; i++ {
+		require.NoError(t, l.Append(ctx, testAuditRecord(i, []string{"default", "batch"}[i%2])))
+	}
+	rotated, err := l.rotated()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(rotated), 3)
+	for _, name := range append(rotated, path) {
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(600))
+	}
+
+	// Rotated records are kept, and every record comes back in order
+	all, err := l.Query(ctx, AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 12)
+	for i, record := range all {
+		assert.Equal(t, fmt.Sprint("event-", i), record.EventID)
+	}
+
+	batch, err := l.Query(ctx, AuditQuery{NodePool: "batch", Since: time.Date(2025, 1, 1, 0, 9, 0, 0, time.UTC), Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	assert.Equal(t, "event-11", batch[0].EventID)
+
+	none, err := l.Query(ctx, AuditQuery{Zone: "us-east-1c"})
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestConfigMapAuditLogRefusesWhenFull(t *testing.T) {
+	ctx := context.Background()
+	l := newConfigMapAuditLog(fake.NewSimpleClientset(), "default", 3)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.Append(ctx, testAuditRecord(i, "default")))
+	}
+	err := l.Append(ctx, testAuditRecord(3, "default"))
+	assert.ErrorIs(t, err, errAuditLogFull)
+
+	// No record is dropped to make room
+	records, err := l.Query(ctx, AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, "event-0", records[0].EventID)
+	assert.Equal(t, "event-2", records[2].EventID)
+}
+
+func TestConfigMapAuditLogLeavesOutObservedChanges(t *testing.T) {
+	ctx := context.Background()
+	l := newConfigMapAuditLog(fake.NewSimpleClientset(), "default", 3)
+	observed := testAuditRecord(0, "default")
+	observed.Operation = auditOperationObserve
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Append(ctx, observed))
+	}
+	require.NoError(t, l.Append(ctx, testAuditRecord(1, "default")))
+
+	records, err := l.Query(ctx, AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "event-1", records[0].EventID)
+}
+
+func TestAuditAPIReportsMutations(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	l, err := newFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), defaultAuditMaxSize)
+	require.NoError(t, err)
+	processor.Audit = l
+	useTestProcessor(t, processor)
+	original := auditLog
+	auditLog = l
+	t.Cleanup(func() { auditLog = original })
+
+	start := testShiftEvent("Autoshift In Progress")
+	start.ID, start.Source = "event-1", "aws.arc"
+	_, err = updateKarpenterNodePool(context.Background(), start)
+	require.NoError(t, err)
+	end := testShiftEvent("Autoshift Completed")
+	end.ID, end.Source = "event-2", "aws.arc"
+	_, err = updateKarpenterNodePool(context.Background(), end)
+	require.NoError(t, err)
+
+	var body struct{ Records []AuditRecord }
+	getJSON(t, "/api/v1/audit?nodepool=default&zone=us-east-1a", &body)
+	require.Len(t, body.Records, 2)
+	assert.Equal(t, "shift", body.Records[0].Action)
+	assert.Equal(t, "aws.arc", body.Records[0].Actor)
+	assert.Equal(t, "event-1", body.Records[0].ShiftID)
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, body.Records[0].OldZones)
+	assert.Equal(t, []string{"us-east-1b"}, body.Records[0].NewZones)
+	assert.Equal(t, "restore", body.Records[1].Action)
+	assert.Equal(t, "event-2", body.Records[1].EventID)
+
+	getJSON(t, "/api/v1/audit?until=2000-01-01T00:00:00Z", &body)
+	assert.Empty(t, body.Records)
+}
+
+func TestAuditRecordsPrincipalAndOutlivesCancellation(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	l, err := newFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), defaultAuditMaxSize)
+	require.NoError(t, err)
+	processor.Audit = l
+	useTestProcessor(t, processor)
+
+	// A manual shift queued by a follower carries its caller to the leader
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	ctx := withPrincipal(context.Background(), adminTokenPrincipal)
+	event := testShiftEvent(manualShiftStarted)
+	event.ID, event.Source = "manual-1", manualEventSource
+	require.NoError(t, queue.Enqueue(ctx, event))
+	drainQueue(context.Background(), queue, map[string]int{})
+
+	// The record is written even when the event's context is already cancelled
+	change := NodePoolChange{Name: "default", Zone: "us-east-1b", EventID: "cancelled", Source: manualEventSource}
+	cancelled, cancel := context.WithCancel(withPrincipal(context.Background(), adminTokenPrincipal))
+	cancel()
+	processor.auditChange(cancelled, change, auditOperationUpdate, nil)
+
+	records, err := l.Query(context.Background(), AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "manual-1", records[0].EventID)
+	assert.Equal(t, adminTokenPrincipal, records[0].Principal)
+	assert.Equal(t, "cancelled", records[1].EventID)
+	assert.Equal(t, adminTokenPrincipal, records[1].Principal)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/reference"
+)
+
+const usage = `Usage: zonal-shift <command> [flags]
+
+Commands:
+  serve                      Run the HTTP server that receives zonal shift events (default)
+  plan --event event.json    Show the node pool changes an event would make
+  apply --event event.json   Apply the node pool changes for an event
+  restore --zone use1-az1    Give a zone back to the node pools it was removed from
+`
+
+// run dispatches to the requested subcommand
+func run(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(args)
+	case "plan":
+		return runEvent(command, args, false)
+	case "apply":
+		return runEvent(command, args, true)
+	case "restore":
+		return runRestore(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+}
+
+// cliFlags are shared by the subcommands that talk to a cluster from outside it
+type cliFlags struct {
+	kubeconfig  string
+	kubeContext string
+	namespace   string
+	verbose     bool
+}
+
+func (f *cliFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.kubeconfig, "kubeconfig", "", "path to the kubeconfig file (defaults to $KUBECONFIG or ~/.kube/config)")
+	fs.StringVar(&f.kubeContext, "context", "", "kubeconfig context to use")
+	fs.StringVar(&f.namespace, "namespace", "", "namespace the server keeps its state in (defaults to $POD_NAMESPACE or default)")
+	fs.BoolVar(&f.verbose, "v", false, "write processing logs to stderr")
+}
+
+// setup prepares the server's event processing to run against the cluster
+// through the kubeconfig: the active policy, the saved shifts and a Processor
+// that writes its planned changes to out. Unless apply is set nothing in the
+// cluster is changed.
+func (f *cliFlags) setup(ctx context.Context, apply bool, out io.Writer) error {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if f.verbose {
+		if err := setupLogging(logConfig{Level: "debug", Format: "text", Output: "stderr"}); err != nil {
+			return err
+		}
+	}
+
+	c, err := loadConfig(nil)
+	if err != nil {
+		return err
+	}
+	applyConfig(c)
+	if f.namespace != "" {
+		os.Setenv("POD_NAMESPACE", f.namespace)
+	}
+
+	k8sConfig, err := kubeconfigRESTConfig(f.kubeconfig, f.kubeContext)
+	if err != nil {
+		return err
+	}
+	client, err := newDynamicClient(k8sConfig)
+	if err != nil {
+		return err
+	}
+	if err := loadActivePolicy(ctx, client, appConfig.Policy); err != nil {
+		return err
+	}
+	if err := setupStateBackend(k8sConfig); err != nil {
+		return err
+	}
+	if err := store.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load active shifts: %v", err)
+	}
+
+	processor := NewProcessor(client, newEC2ZoneResolver())
+	configureProcessor(processor)
+	processor.Planned = func(changes []NodePoolChange) { writeDiff(out, changes) }
+	if !apply {
+		// Shifts started or ended while planning stay in this process
+		processor.DryRun = true
+		store.SetBackend(nil)
+	} else {
+		clientset, err := kubernetes.NewForConfig(k8sConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create clientset: %v", err)
+		}
+		if auditLog, err = newAuditLogFromConfig(clientset); err != nil {
+			return err
+		}
+		processor.Audit = auditLog
+		processor.Recorder = cliEventRecorder{events: clientset.CoreV1()}
+	}
+	newProcessor = func() (*Processor, error) { return processor, nil }
+	return nil
+}
+
+// runEvent implements the plan and apply subcommands
+func runEvent(command string, args []string, apply bool) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	var flags cliFlags
+	flags.register(fs)
+	eventFile := fs.String("event", "", "path to an EventBridge event or SNS notification JSON file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *eventFile == "" {
+		return errors.New("--event is required")
+	}
+
+	ctx := context.Background()
+	if err := flags.setup(ctx, apply, os.Stdout); err != nil {
+		return err
+	}
+	event, skip, err := loadEventFile(*eventFile)
+	if err != nil {
+		return err
+	}
+	if skip != "" {
+		fmt.Printf("Nothing to do: %s.\n", skip)
+		return nil
+	}
+	return processCLIEvent(ctx, os.Stdout, event, apply)
+}
+
+// runRestore implements the restore subcommand
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var flags cliFlags
+	flags.register(fs)
+	zone := fs.String("zone", "", "zone ID or name to restore, e.g. use1-az1")
+	region := fs.String("region", "", "AWS region of the zone (defaults to $AWS_REGION)")
+	dryRun := fs.Bool("dry-run", false, "only print the changes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *zone == "" {
+		return errors.New("--zone is required")
+	}
+
+	ctx := context.Background()
+	if err := flags.setup(ctx, !*dryRun, os.Stdout); err != nil {
+		return err
+	}
+	event, err := restoreEvent(ctx, *region, *zone)
+	if err != nil {
+		return err
+	}
+	return processCLIEvent(ctx, os.Stdout, event, !*dryRun)
+}
+
+// restoreEvent builds the event a manual restore of a zone is processed as,
+// ending its real shift, or its practice run when that is all there is
+func restoreEvent(ctx context.Context, region, zone string) (Event, error) {
+	if region == "" {
+		region = appConfig.Region
+	}
+	processor, err := newProcessor()
+	if err != nil {
+		return Event{}, err
+	}
+	az, err := processor.ResolveZone(ctx, region, zone)
+	if err != nil {
+		return Event{}, err
+	}
+	metadata := Metadata{AwayFrom: az.ID}
+	if _, ok := store.ShiftForZone(az.ID, false); !ok {
+		if shift, ok := store.ShiftForZone(az.ID, true); ok {
+			metadata.ShiftType = shiftTypeOf(shift)
+		}
+	}
+	return Event{
+		Version:    "0",
+		ID:         newShiftID(),
+		DetailType: manualShiftCancelled,
+		Source:     manualEventSource,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Region:     region,
+		Detail:     Detail{Metadata: metadata},
+	}, nil
+}
+
+// processCLIEvent processes an event the way the server does and reports
+// the outcome to out
+func processCLIEvent(ctx context.Context, out io.Writer, event Event, apply bool) error {
+	if event.ID == "" {
+		event.ID = newShiftID()
+	}
+	record, err := processReceivedEvent(withPrincipal(ctx, cliPrincipal()), event, time.Now())
+	switch record.Outcome {
+	case outcomeIgnored, outcomeNoChanges:
+		if record.Reason != "" {
+			fmt.Fprintf(out, "Nothing to do: %s.\n", record.Reason)
+		}
+	case outcomeObserved:
+		fmt.Fprintln(out, "Practice runs are only observed, no node pool was changed.")
+	case outcomeDryRun:
+		if apply {
+			fmt.Fprintln(out, "Dry run is configured, no node pool was changed.")
+		}
+	default:
+		if !apply {
+			break
+		}
+		fmt.Fprintf(out, "Applied %d node pool change(s).\n", len(record.NodePools))
+		if len(record.Refused) > 0 {
+			fmt.Fprintf(out, "Refused %d node pool change(s) by the safety policy: %s.\n", len(record.Refused), strings.Join(record.Refused, ", "))
+		}
+	}
+	return err
+}
+
+// cliEventRecorder writes Kubernetes Events to the API server as they are
+// recorded. The server's recorder sends them in the background, which a
+// command can exit before.
+type cliEventRecorder struct {
+	events typedcorev1.EventsGetter
+}
+
+func (r cliEventRecorder) Event(obj runtime.Object, eventtype, reason, message string) {
+	ref, err := reference.GetReference(scheme.Scheme, obj)
+	if err != nil {
+		slog.Error("Failed to reference object for Kubernetes Event", "reason", reason, "error", err)
+		return
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()), Namespace: namespace},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventtype,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         corev1.EventSource{Component: eventComponent},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	if _, err := r.events.Events(namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		slog.Error("Failed to record Kubernetes Event", "object", ref.Name, "reason", reason, "error", err)
+	}
+}
+
+func (r cliEventRecorder) Eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(obj, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r cliEventRecorder) AnnotatedEventf(obj runtime.Object, _ map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// cliPrincipal is who the audit log records as making a change from the command line
+func cliPrincipal() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+// loadEventFile reads an event from disk, accepting either a raw EventBridge
+// event or the SNS notification wrapping one. It decodes the event like the
+// server, returning why it is skipped when the server would skip it.
+func loadEventFile(path string) (event Event, skip string, err error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return Event{}, "", fmt.Errorf("failed to read event file: %v", err)
+	}
+
+	var snsMessage SNSMessage
+	if err := json.Unmarshal(body, &snsMessage); err == nil && snsMessage.Type == snsNotification {
+		body = []byte(snsMessage.Message)
+	}
+
+	event, skip, err = decodeEvent(body)
+	if err != nil {
+		return Event{}, "", fmt.Errorf("failed to parse event file: %v", err)
+	}
+	if skip != "" {
+		return event, skip, nil
+	}
+	if isHeartbeat(event) {
+		return event, "the event is a heartbeat", nil
+	}
+	if err := validateEvent(event); err != nil {
+		return Event{}, "", err
+	}
+	return event, "", nil
+}
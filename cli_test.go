@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCLIApplyReportsRefusedChangesSeparately(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("single", zoneRequirementOf("In", "us-east-1a")),
+	)
+	processor := NewProcessor(client, testZones)
+	var out bytes.Buffer
+	processor.Planned = func(changes []NodePoolChange) { writeDiff(&out, changes) }
+	useTestProcessor(t, processor)
+
+	event := testShiftEvent("Autoshift In Progress")
+	event.Source = "aws.arc"
+	require.NoError(t, processCLIEvent(context.Background(), &out, event, true))
+	assert.Contains(t, out.String(), "Applied 1 node pool change(s).\n")
+	assert.Contains(t, out.String(), "Refused 1 node pool change(s) by the safety policy: single.\n")
+	assert.Equal(t, []string{"us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+
+	// The shift is recorded, so the reconciler and end events know about it
+	shift, ok := store.ShiftForZone("use1-az1", false)
+	require.True(t, ok)
+	assert.Equal(t, []string{"default"}, shift.NodePools)
+}
+
+func TestCLIPlanChangesNothing(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	processor.DryRun = true
+	var out bytes.Buffer
+	processor.Planned = func(changes []NodePoolChange) { writeDiff(&out, changes) }
+	useTestProcessor(t, processor)
+
+	require.NoError(t, processCLIEvent(context.Background(), &out, testShiftEvent("Autoshift In Progress"), false))
+	assert.Contains(t, out.String(), "default")
+	assert.NotContains(t, out.String(), "Applied")
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+	assert.Empty(t, store.ActiveShifts())
+}
+
+func TestCLIFollowsPracticeRunMode(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsIgnore })
+
+	var out bytes.Buffer
+	require.NoError(t, processCLIEvent(context.Background(), &out, testPracticeRunEvent(detailPracticeRunStarted, "practice-start"), true))
+	assert.Equal(t, "Nothing to do: practice runs are ignored.\n", out.String())
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+}
+
+func TestLoadEventFile(t *testing.T) {
+	useTestConfig(t, func(*Config) {})
+	dir := t.TempDir()
+	write := func(name string, body []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, body, 0o600))
+		return path
+	}
+	event := `{"version": "0", "id": "event-1", "detail-type": "Autoshift In Progress", "source": "aws.arc", "region": "us-east-1", "detail": {"version": "0.0.1", "metadata": {"awayFrom": "use1-az1"}}}`
+
+	loaded, skip, err := loadEventFile(write("event.json", []byte(event)))
+	require.NoError(t, err)
+	assert.Empty(t, skip)
+	assert.Equal(t, "event-1", loaded.ID)
+
+	// An SNS notification is unwrapped
+	wrapped, err := json.Marshal(SNSMessage{Type: snsNotification, Message: event})
+	require.NoError(t, err)
+	loaded, _, err = loadEventFile(write("sns.json", wrapped))
+	require.NoError(t, err)
+	assert.Equal(t, "use1-az1", loaded.Detail.Metadata.AwayFrom)
+
+	// Events are parsed as strictly as the server parses them
+	_, _, err = loadEventFile(write("invalid.json", []byte(`{"version": "0", "detail": {"metadata": {}}}`)))
+	assert.Error(t, err)
+}
+
+func TestCLIApplyIsAudited(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	l, err := newFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), defaultAuditMaxSize)
+	require.NoError(t, err)
+	processor.Audit = l
+	useTestProcessor(t, processor)
+
+	var out bytes.Buffer
+	require.NoError(t, processCLIEvent(context.Background(), &out, testShiftEvent("Autoshift In Progress"), true))
+	records, err := l.Query(context.Background(), AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "default", records[0].NodePool)
+	assert.Equal(t, cliPrincipal(), records[0].Principal)
+}
+
+func TestCLIApplyRecordsKubernetesEvents(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	clientset := fake.NewSimpleClientset()
+	processor.Recorder = cliEventRecorder{events: clientset.CoreV1()}
+	useTestProcessor(t, processor)
+
+	// The Event is written before the command returns
+	var out bytes.Buffer
+	require.NoError(t, processCLIEvent(context.Background(), &out, testShiftEvent("Autoshift In Progress"), true))
+	events, err := clientset.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	event := events.Items[0]
+	assert.Equal(t, "default", event.InvolvedObject.Name)
+	assert.Equal(t, "NodePool", event.InvolvedObject.Kind)
+	assert.Equal(t, reasonShiftApplied, event.Reason)
+	assert.Equal(t, corev1.EventTypeWarning, event.Type)
+	assert.Equal(t, eventComponent, event.Source.Component)
+}
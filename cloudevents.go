@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// cloudEventsMediaType marks a structured-mode CloudEvent
+	cloudEventsMediaType = "application/cloudevents+json"
+	// cloudEventsBatchMediaType marks a batch of CloudEvents, which is not supported
+	cloudEventsBatchMediaType = "application/cloudevents-batch+json"
+	// cloudEventsHeaderPrefix starts the headers of a binary-mode CloudEvent
+	cloudEventsHeaderPrefix = "ce-"
+)
+
+// errUnsupportedMedia wraps the reasons a request is not a CloudEvent the service reads
+var errUnsupportedMedia = errors.New("unsupported media")
+
+// CloudEventsConfig says which CloudEvents types start and end shifts
+type CloudEventsConfig struct {
+	StartTypes []string `json:"startTypes"`
+	EndTypes   []string `json:"endTypes"`
+}
+
+// validate reports unusable type lists
+func (c CloudEventsConfig) validate() []error {
+	var errs []error
+	if len(c.StartTypes) == 0 || len(c.EndTypes) == 0 {
+		errs = append(errs, errors.New("cloudEvents.startTypes and cloudEvents.endTypes must be set"))
+	}
+	for _, t := range c.StartTypes {
+		if slices.Contains(c.EndTypes, t) {
+			errs = append(errs, fmt.Errorf("CloudEvents type %q cannot both start and end shifts", t))
+		}
+	}
+	return errs
+}
+
+// CloudEvent is a CloudEvents 1.0 event, with the context attributes the
+// service reads
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+}
+
+// cloudEventData is the data of a shift CloudEvent
+type cloudEventData struct {
+	// ZoneID is the zone to shift away from, by ID or name; the subject is used when it is empty
+	ZoneID string `json:"zoneId"`
+	// Region defaults to AWS_REGION
+	Region string `json:"region"`
+	Notes  string `json:"notes"`
+	// ExpiryTime, an RFC 3339 time, ends the shift if no end event arrives first
+	ExpiryTime string `json:"expiryTime"`
+}
+
+// readCloudEvent reads a CloudEvent in structured or binary HTTP mode
+func readCloudEvent(r *http.Request, body []byte) (CloudEvent, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == cloudEventsBatchMediaType:
+		return CloudEvent{}, fmt.Errorf("%w: batched CloudEvents are not supported", errUnsupportedMedia)
+	case mediaType == cloudEventsMediaType:
+		var event CloudEvent
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		if err := decoder.Decode(&event); err != nil {
+			return CloudEvent{}, fmt.Errorf("invalid structured CloudEvent: %v", err)
+		}
+		return event, nil
+	case r.Header.Get("ce-specversion") != "":
+		return CloudEvent{
+			SpecVersion:     r.Header.Get("ce-specversion"),
+			ID:              r.Header.Get("ce-id"),
+			Source:          r.Header.Get("ce-source"),
+			Type:            r.Header.Get("ce-type"),
+			Subject:         r.Header.Get("ce-subject"),
+			Time:            r.Header.Get("ce-time"),
+			DataContentType: r.Header.Get("Content-Type"),
+			Data:            body,
+		}, nil
+	}
+	return CloudEvent{}, fmt.Errorf("%w: expected Content-Type %s or ce-* headers", errUnsupportedMedia, cloudEventsMediaType)
+}
+
+// shiftEvent maps a CloudEvent of a configured type to a shift start or end event
+func (ce CloudEvent) shiftEvent() (Event, error) {
+	if ce.SpecVersion != "1.0" {
+		return Event{}, fmt.Errorf("unsupported CloudEvents specversion %q", ce.SpecVersion)
+	}
+	if ce.ID == "" || ce.Source == "" || ce.Type == "" {
+		return Event{}, errors.New("CloudEvent is missing id, source or type")
+	}
+	var detailType string
+	switch {
+	case slices.Contains(appConfig.CloudEvents.StartTypes, ce.Type):
+		detailType = triggerStarted
+	case slices.Contains(appConfig.CloudEvents.EndTypes, ce.Type):
+		detailType = triggerEnded
+	default:
+		return Event{}, fmt.Errorf("unsupported CloudEvents type %q", ce.Type)
+	}
+	if ce.Time != "" {
+		if _, err := time.Parse(time.RFC3339, ce.Time); err != nil {
+			return Event{}, fmt.Errorf("invalid CloudEvents time %q", ce.Time)
+		}
+	}
+
+	var data cloudEventData
+	if len(ce.Data) > 0 {
+		if contentType, _, _ := mime.ParseMediaType(ce.DataContentType); ce.DataContentType != "" && contentType != "application/json" && !strings.HasSuffix(contentType, "+json") {
+			return Event{}, fmt.Errorf("unsupported CloudEvents datacontenttype %q", ce.DataContentType)
+		}
+		if err := json.Unmarshal(ce.Data, &data); err != nil {
+			return Event{}, fmt.Errorf("invalid CloudEvents data: %v", err)
+		}
+	}
+	if data.ZoneID == "" {
+		data.ZoneID = ce.Subject
+	}
+	if data.Region == "" {
+		data.Region = appConfig.Region
+	}
+	if data.ExpiryTime != "" {
+		if _, err := time.Parse(time.RFC3339, data.ExpiryTime); err != nil {
+			return Event{}, fmt.Errorf("invalid expiryTime %q", data.ExpiryTime)
+		}
+	}
+	return Event{
+		Version:    "0",
+		ID:         cloudEventID(ce.Source, ce.ID),
+		DetailType: detailType,
+		Source:     ce.Source,
+		Time:       ce.Time,
+		Region:     data.Region,
+		Detail:     Detail{Metadata: Metadata{AwayFrom: data.ZoneID, Notes: data.Notes, ExpiryTime: data.ExpiryTime}},
+	}, nil
+}
+
+// cloudEventID is the ID of the event for a CloudEvent. CloudEvents are only
+// unique by source and id together, so both go into it.
+func cloudEventID(source, id string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// handleCloudEvent accepts a CloudEvent, authenticated like a direct
+// EventBridge event, and queues the shift it starts or ends
+func handleCloudEvent(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		slog.Warn("Failed to read request body", "error", err)
+		c.String(http.StatusBadRequest, "Error reading request")
+		return
+	}
+	// Nothing in the request is parsed before the caller is known
+	principal, err := authenticateDirectEvent(c.Request, body, time.Now())
+	if err != nil {
+		slog.Warn("Rejected unauthenticated CloudEvent", "client_ip", c.ClientIP(), "error", err)
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	ce, err := readCloudEvent(c.Request, body)
+	if err != nil {
+		slog.Warn("Failed to read CloudEvent", "error", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnsupportedMedia) {
+			status = http.StatusUnsupportedMediaType
+		}
+		c.String(status, err.Error())
+		return
+	}
+	logger := slog.With("event_id", ce.ID, "ce_source", ce.Source, "ce_type", ce.Type)
+	event, err := ce.shiftEvent()
+	if err == nil {
+		err = validateEvent(event)
+	}
+	if err != nil {
+		logger.Warn("Invalid CloudEvent", "error", err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger.Info("CloudEvent received", "shift_event_id", event.ID, "detail_type", event.DetailType, "zone_id", event.Detail.Metadata.AwayFrom)
+	if err := handleEvent(withPrincipal(c.Request.Context(), principal), event); err != nil {
+		c.String(http.StatusServiceUnavailable, "Failed to queue event")
+		return
+	}
+	c.Status(http.StatusOK)
+}
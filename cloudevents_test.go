@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postCloudEvent posts body to /events with the given headers, authenticated with an API key
+func postCloudEvent(t *testing.T, body string, headers map[string]string) (int, string) {
+	req, err := http.NewRequest("POST", "/events", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-API-Key", "key")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func useCloudEventsTest(t *testing.T) *memoryQueue {
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.APIKey = directEventsAPIKey, "key"
+		c.Region = "us-east-1"
+	})
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	return queue
+}
+
+func pendingEvents(t *testing.T, queue *memoryQueue) []Event {
+	pending, err := queue.Pending(context.Background())
+	require.NoError(t, err)
+	var events []Event
+	for _, p := range pending {
+		events = append(events, p.Event)
+	}
+	return events
+}
+
+func TestStructuredCloudEvent(t *testing.T) {
+	queue := useCloudEventsTest(t)
+	code, _ := postCloudEvent(t, `{
+		"specversion": "1.0",
+		"id": "inc-42",
+		"source": "//incidents.example.com/incidents/42",
+		"type": "zonal-shift.started",
+		"time": "2024-10-01T08:00:00Z",
+		"datacontenttype": "application/json",
+		"severity": "sev1",
+		"data": {"zoneId": "use1-az2", "notes": "Packet loss in use1-az2", "expiryTime": "2024-10-01T12:00:00Z"}
+	}`, map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"})
+	require.Equal(t, http.StatusOK, code)
+
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 1)
+	assert.Equal(t, Event{
+		Version:    "0",
+		ID:         cloudEventID("//incidents.example.com/incidents/42", "inc-42"),
+		DetailType: triggerStarted,
+		Source:     "//incidents.example.com/incidents/42",
+		Time:       "2024-10-01T08:00:00Z",
+		Region:     "us-east-1",
+		Detail: Detail{Metadata: Metadata{
+			AwayFrom:   "use1-az2",
+			Notes:      "Packet loss in use1-az2",
+			ExpiryTime: "2024-10-01T12:00:00Z",
+		}},
+	}, events[0])
+}
+
+func TestBinaryCloudEvent(t *testing.T) {
+	queue := useCloudEventsTest(t)
+	headers := map[string]string{
+		"Content-Type":   "application/json",
+		"ce-specversion": "1.0",
+		"ce-id":          "inc-42-resolved",
+		"ce-source":      "//incidents.example.com/incidents/42",
+		"ce-type":        "zonal-shift.ended",
+		"ce-subject":     "use1-az2",
+	}
+	code, _ := postCloudEvent(t, `{"region": "us-east-1"}`, headers)
+	require.Equal(t, http.StatusOK, code)
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 1)
+	assert.Equal(t, triggerEnded, events[0].DetailType)
+	assert.Equal(t, "use1-az2", events[0].Detail.Metadata.AwayFrom)
+	assert.True(t, isShiftEnd(events[0]))
+
+	// Without data the subject and AWS_REGION are enough
+	headers["ce-id"] = "inc-43"
+	code, _ = postCloudEvent(t, "", headers)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestCloudEventsFromSourcesSharingAnID(t *testing.T) {
+	queue := useCloudEventsTest(t)
+	structured := map[string]string{"Content-Type": "application/cloudevents+json"}
+	for _, source := range []string{"incident-bot", "deploy-bot"} {
+		code, _ := postCloudEvent(t, `{"specversion": "1.0", "id": "1", "source": "`+source+`", "type": "zonal-shift.started", "subject": "use1-az1"}`, structured)
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	// Each source numbers its own events, so neither replaces the other
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 2)
+	assert.NotEqual(t, events[0].ID, events[1].ID)
+	assert.ElementsMatch(t, []string{cloudEventID("incident-bot", "1"), cloudEventID("deploy-bot", "1")}, []string{events[0].ID, events[1].ID})
+}
+
+func TestBinaryCloudEventHMACSignsHeaders(t *testing.T) {
+	queue := useCloudEventsTest(t)
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.HMACSecret = directEventsHMAC, "shared"
+		c.Region = "us-east-1"
+	})
+	body := `{"region": "us-east-1"}`
+	headers := map[string]string{
+		"Content-Type":   "application/json",
+		"ce-specversion": "1.0",
+		"ce-id":          "inc-44",
+		"ce-source":      "//incidents.example.com/incidents/44",
+		"ce-type":        "zonal-shift.started",
+		"ce-subject":     "use1-az2",
+	}
+	sign := func(headers map[string]string) map[string]string {
+		header := http.Header{}
+		for name, value := range headers {
+			header.Set(name, value)
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signed := maps.Clone(headers)
+		signed[timestampHeader] = timestamp
+		signed[signatureHeader] = signRequest("shared", timestamp, header, []byte(body))
+		return signed
+	}
+
+	// The attributes are in the headers, so a signature over the body alone
+	// does not let them be changed
+	signed := sign(headers)
+	signed["ce-subject"] = "use1-az3"
+	code, _ := postCloudEvent(t, body, signed)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	signed = sign(headers)
+	signed["ce-type"] = "zonal-shift.ended"
+	code, _ = postCloudEvent(t, body, signed)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Empty(t, pendingEvents(t, queue))
+
+	code, _ = postCloudEvent(t, body, sign(headers))
+	require.Equal(t, http.StatusOK, code)
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 1)
+	assert.Equal(t, "use1-az2", events[0].Detail.Metadata.AwayFrom)
+}
+
+func TestCloudEventsAreRefused(t *testing.T) {
+	queue := useCloudEventsTest(t)
+	structured := map[string]string{"Content-Type": "application/cloudevents+json"}
+	for name, test := range map[string]struct {
+		body    string
+		headers map[string]string
+		status  int
+		message string
+	}{
+		"not a CloudEvent":   {`{}`, map[string]string{"Content-Type": "application/json"}, http.StatusUnsupportedMediaType, "expected Content-Type"},
+		"batch":              {`[]`, map[string]string{"Content-Type": "application/cloudevents-batch+json"}, http.StatusUnsupportedMediaType, "batched CloudEvents are not supported"},
+		"invalid JSON":       {`{`, structured, http.StatusBadRequest, "invalid structured CloudEvent"},
+		"old specversion":    {`{"specversion": "0.3", "id": "1", "source": "s", "type": "zonal-shift.started"}`, structured, http.StatusBadRequest, `unsupported CloudEvents specversion "0.3"`},
+		"unknown type":       {`{"specversion": "1.0", "id": "1", "source": "s", "type": "com.example.deploy"}`, structured, http.StatusBadRequest, `unsupported CloudEvents type "com.example.deploy"`},
+		"no zone":            {`{"specversion": "1.0", "id": "1", "source": "s", "type": "zonal-shift.started"}`, structured, http.StatusBadRequest, "missing detail.metadata.awayFrom"},
+		"bad expiry":         {`{"specversion": "1.0", "id": "1", "source": "s", "type": "zonal-shift.started", "data": {"zoneId": "use1-az1", "expiryTime": "soon"}}`, structured, http.StatusBadRequest, `invalid expiryTime "soon"`},
+		"non-JSON data":      {`zone=use1-az1`, map[string]string{"Content-Type": "text/plain", "ce-specversion": "1.0", "ce-id": "1", "ce-source": "s", "ce-type": "zonal-shift.started"}, http.StatusBadRequest, `unsupported CloudEvents datacontenttype "text/plain"`},
+		"missing attributes": {`{"specversion": "1.0", "type": "zonal-shift.started"}`, structured, http.StatusBadRequest, "missing id, source or type"},
+		"invalid event time": {`{"specversion": "1.0", "id": "1", "source": "s", "type": "zonal-shift.started", "time": "yesterday", "data": {"zoneId": "use1-az1"}}`, structured, http.StatusBadRequest, `invalid CloudEvents time "yesterday"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code, body := postCloudEvent(t, test.body, test.headers)
+			assert.Equal(t, test.status, code)
+			assert.Contains(t, body, test.message)
+		})
+	}
+	assert.Empty(t, pendingEvents(t, queue))
+
+	// CloudEvents authenticate like direct events
+	useTestConfig(t, func(c *Config) {})
+	code, _ := postCloudEvent(t, `{"specversion": "1.0", "id": "1", "source": "s", "type": "zonal-shift.started", "subject": "use1-az1"}`, structured)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// and are turned away before anything in them is read
+	for _, headers := range []map[string]string{structured, {"Content-Type": "application/json"}} {
+		code, _ = postCloudEvent(t, `{`, headers)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+}
+
+func TestCloudEventStartsShift(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	queue := useCloudEventsTest(t)
+
+	code, _ := postCloudEvent(t, `{"specversion": "1.0", "id": "inc-7", "source": "incident-bot", "type": "zonal-shift.started", "subject": "us-east-1c"}`,
+		map[string]string{"Content-Type": "application/cloudevents+json"})
+	require.Equal(t, http.StatusOK, code)
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 1)
+	record, err := processReceivedEvent(context.Background(), events[0], time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeApplied, record.Outcome)
+	assert.Equal(t, []string{"us-east-1c"}, getTestNodePool(t, client, "default").removedZones())
+}
+
+func TestShiftStartedByIDEndsByName(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	queue := useCloudEventsTest(t)
+	structured := map[string]string{"Content-Type": "application/cloudevents+json"}
+	ctx := context.Background()
+
+	code, _ := postCloudEvent(t, `{"specversion": "1.0", "id": "inc-8", "source": "incident-bot", "type": "zonal-shift.started", "subject": "use1-az3"}`, structured)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = postCloudEvent(t, `{"specversion": "1.0", "id": "inc-9", "source": "incident-bot", "type": "zonal-shift.ended", "subject": "us-east-1c"}`, structured)
+	require.Equal(t, http.StatusOK, code)
+	events := pendingEvents(t, queue)
+	require.Len(t, events, 2)
+
+	_, err := processReceivedEvent(ctx, events[0], time.Now())
+	require.NoError(t, err)
+	shifts := store.ActiveShifts()
+	require.Len(t, shifts, 1)
+	assert.Equal(t, "use1-az3", shifts[0].ZoneID)
+
+	// The shift is stored by zone ID, so the event naming the zone ends it
+	_, err = processReceivedEvent(ctx, events[1], time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, store.ActiveShifts())
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+}
+
+func TestCloudEventsConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig([]string{"--cloudevents-start-types", "a,b", "--cloudevents-end-types", "b"})
+	assert.ErrorContains(t, err, `CloudEvents type "b" cannot both start and end shifts`)
+	_, err = loadConfig([]string{"--cloudevents-end-types", ","})
+	assert.ErrorContains(t, err, "cloudEvents.startTypes and cloudEvents.endTypes must be set")
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultQueueMaxAttempts is how many times a failing event is processed before it is dropped
+	defaultQueueMaxAttempts = 5
+
+	// redacted replaces secrets when the configuration is logged
+	redacted = "REDACTED"
+)
+
+// Config is the server configuration. Each setting comes from, in increasing
+// order of precedence, its default, the YAML file named by --config or
+// CONFIG_FILE, its environment variable and its flag.
+type Config struct {
+	// ListenAddress is the host:port the HTTP server listens on
+	ListenAddress string    `json:"listenAddress"`
+	TLS           TLSConfig `json:"tls"`
+	// ProbeAddress, if set, serves the probes and metrics in plain HTTP on a
+	// separate host:port, and no longer on ListenAddress
+	ProbeAddress string `json:"probeAddress,omitempty"`
+	// AllowedTopics, if set, limits the SNS topics messages are accepted from
+	AllowedTopics []string `json:"allowedTopics,omitempty"`
+	// SNSConfirmation is how subscriptions to allowed topics are confirmed: url
+	// (fetch the checked SubscribeURL) or api (call SNS ConfirmSubscription)
+	SNSConfirmation string `json:"snsConfirmation"`
+	// SNSSilenceWindow, if set, is how long a topic may go without a message,
+	// heartbeats included, before an alert is raised
+	SNSSilenceWindow metav1.Duration   `json:"snsSilenceWindow,omitempty"`
+	DirectEvents     DirectEventAuth   `json:"directEvents"`
+	CloudEvents      CloudEventsConfig `json:"cloudEvents"`
+	// Triggers map AWS Health, FIS and other non-ARC events to shifts; they
+	// are only read from the config file
+	Triggers []TriggerRule `json:"triggers,omitempty"`
+	// ZoneKey is the node label NodePool zone requirements use
+	ZoneKey string `json:"zoneKey"`
+	// NodePoolSelector is a label selector limiting which NodePools are managed
+	NodePoolSelector string `json:"nodePoolSelector,omitempty"`
+	// MinRemainingZones is the fewest zones a shift may leave a NodePool able to use
+	MinRemainingZones int `json:"minRemainingZones"`
+	// StateBackend is memory or configmap
+	StateBackend   string `json:"stateBackend"`
+	LeaderElection bool   `json:"leaderElection"`
+	// PracticeRuns is how ARC practice runs are handled: ignore, observe or rehearse
+	PracticeRuns string `json:"practiceRuns"`
+	// DryRun plans and logs NodePool changes without making them
+	DryRun   bool          `json:"dryRun"`
+	Queue    QueueConfig   `json:"queue"`
+	Timeouts TimeoutConfig `json:"timeouts"`
+	// EventTimeout bounds processing one event, including every Kubernetes and AWS call it makes
+	EventTimeout metav1.Duration `json:"eventTimeout"`
+	// ShutdownTimeout bounds how long a stopping server waits for queued and in-flight work
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+	// CheckpointFile, if set, keeps the memory backend's unfinished events and
+	// active shifts across restarts
+	CheckpointFile string    `json:"checkpointFile,omitempty"`
+	Log            logConfig `json:"log"`
+	AdminAPIToken  string    `json:"adminAPIToken,omitempty"`
+	// Region is the AWS region used for events, shifts and AWS clients that name none
+	Region string      `json:"region,omitempty"`
+	Shifts ShiftConfig `json:"shifts"`
+	// Policy is the name of the ZonalShiftPolicy the service follows
+	Policy string `json:"policy"`
+	// ReconcileInterval is how often every NodePool is rechecked
+	ReconcileInterval metav1.Duration   `json:"reconcileInterval"`
+	ZonalShifts       ZonalShiftsConfig `json:"zonalShifts"`
+	Notify            NotifyConfig      `json:"notify"`
+	Audit             AuditConfig       `json:"audit"`
+}
+
+// ShiftConfig controls when active shifts expire
+type ShiftConfig struct {
+	// DefaultTTL is the expiry given to shifts whose event carries none
+	DefaultTTL metav1.Duration `json:"defaultTTL"`
+	// ExpiryCheckInterval is how often expired shifts are looked for
+	ExpiryCheckInterval metav1.Duration `json:"expiryCheckInterval"`
+	// StatusChecker, if arc, confirms with ARC that a shift has ended before it is restored
+	StatusChecker string `json:"statusChecker,omitempty"`
+}
+
+// ZonalShiftsConfig controls the ZonalShift objects recording each shift
+type ZonalShiftsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Retention is how long a restored ZonalShift is kept
+	Retention metav1.Duration `json:"retention"`
+}
+
+// NotifyConfig is where notifications are sent and how
+type NotifyConfig struct {
+	NotificationTargets
+	// Retries is how many times a failed delivery is retried
+	Retries int `json:"retries"`
+	// Templates replace the message of a notification kind, such as shift-applied
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// AuditConfig is where the audit log is written
+type AuditConfig struct {
+	// File, if set, is appended to and rotated once it reaches MaxSize bytes
+	File    string `json:"file,omitempty"`
+	MaxSize int    `json:"maxSize"`
+	// ConfigMap also keeps up to ConfigMapMaxRecords records in a ConfigMap
+	ConfigMap           bool `json:"configMap"`
+	ConfigMapMaxRecords int  `json:"configMapMaxRecords"`
+}
+
+// TLSConfig names the certificate the server presents; it serves plain HTTP when both are empty
+type TLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientCAFile is the CA client certificates are verified against
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// ClientAuth is none, optional (verify a client certificate if one is
+	// presented) or require
+	ClientAuth string `json:"clientAuth,omitempty"`
+	// AdminClients and EventClients are the common names of verified client
+	// certificates that may call the admin API and post direct events
+	AdminClients []string `json:"adminClients,omitempty"`
+	EventClients []string `json:"eventClients,omitempty"`
+}
+
+// QueueConfig controls how the leader works through queued events
+type QueueConfig struct {
+	// PollInterval is how often the leader looks for events enqueued by other replicas
+	PollInterval metav1.Duration `json:"pollInterval"`
+	// StallThreshold is how long an event may wait before the leader reports not ready
+	StallThreshold metav1.Duration `json:"stallThreshold"`
+	// MaxAttempts is how many times a failing event is processed before it is dropped
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+// TimeoutConfig bounds the HTTP server's connections
+type TimeoutConfig struct {
+	ReadHeader metav1.Duration `json:"readHeader"`
+	Read       metav1.Duration `json:"read"`
+	Write      metav1.Duration `json:"write"`
+	Idle       metav1.Duration `json:"idle"`
+}
+
+// defaultConfig returns the configuration used when nothing is set
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:   ":8080",
+		ZoneKey:         "topology.kubernetes.io/zone",
+		SNSConfirmation: snsConfirmByURL,
+		CloudEvents: CloudEventsConfig{
+			StartTypes: []string{"zonal-shift.started"},
+			EndTypes:   []string{"zonal-shift.ended"},
+		},
+		DirectEvents: DirectEventAuth{
+			Mode:         directEventsDisabled,
+			APIKeyHeader: "X-API-Key",
+			MaxSkew:      metav1.Duration{Duration: 5 * time.Minute},
+		},
+		MinRemainingZones: defaultSafetyPolicy.MinZones,
+		StateBackend:      "memory",
+		PracticeRuns:      practiceRunsObserve,
+		Queue: QueueConfig{
+			PollInterval:   metav1.Duration{Duration: defaultQueuePollInterval},
+			StallThreshold: metav1.Duration{Duration: defaultQueueStallThreshold},
+			MaxAttempts:    defaultQueueMaxAttempts,
+		},
+		Timeouts: TimeoutConfig{
+			ReadHeader: metav1.Duration{Duration: 10 * time.Second},
+			Read:       metav1.Duration{Duration: 30 * time.Second},
+			Write:      metav1.Duration{Duration: 30 * time.Second},
+			Idle:       metav1.Duration{Duration: 2 * time.Minute},
+		},
+		EventTimeout:    metav1.Duration{Duration: 2 * time.Minute},
+		ShutdownTimeout: metav1.Duration{Duration: 25 * time.Second},
+		Log:             logConfig{Level: "info", Format: "json", Output: "stdout"},
+		Shifts: ShiftConfig{
+			DefaultTTL:          metav1.Duration{Duration: defaultShiftTTL},
+			ExpiryCheckInterval: metav1.Duration{Duration: defaultExpiryCheckInterval},
+		},
+		Policy:            defaultPolicyName,
+		ReconcileInterval: metav1.Duration{Duration: defaultReconcileInterval},
+		ZonalShifts:       ZonalShiftsConfig{Retention: metav1.Duration{Duration: defaultZonalShiftRetention}},
+		Notify:            NotifyConfig{Retries: defaultNotifyRetries},
+		Audit:             AuditConfig{MaxSize: defaultAuditMaxSize, ConfigMapMaxRecords: defaultAuditConfigMapRecords},
+	}
+}
+
+// appConfig is the configuration in use; serve and the CLI replace it with the loaded one
+var appConfig = defaultConfig()
+
+// applyConfig makes c the configuration in use
+func applyConfig(c *Config) {
+	appConfig = c
+	zoneLabelKey = c.ZoneKey
+}
+
+// loadConfig builds the configuration from defaults, the YAML file, the
+// environment and the serve flags in args, and validates it
+func loadConfig(args []string) (*Config, error) {
+	// The file is read before the flags that override it, so look for --config first
+	path := os.Getenv("CONFIG_FILE")
+	scan := newConfigFlags(defaultConfig(), &path)
+	scan.SetOutput(io.Discard)
+	// Errors are reported by the second parse
+	scan.Parse(args)
+
+	c := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := newConfigFlags(c, &path).Parse(args); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newConfigFlags binds the serve flags to c, so only the flags given change it
+func newConfigFlags(c *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "path to a YAML config file")
+	fs.StringVar(&c.ListenAddress, "listen-address", c.ListenAddress, "host:port to listen on")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile, "TLS certificate to serve with")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile, "TLS private key to serve with")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca-file", c.TLS.ClientCAFile, "CA to verify client certificates against")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "client certificates: none, optional or require")
+	fs.Func("tls-admin-clients", "comma-separated client certificate common names allowed to call the admin API", func(value string) error {
+		c.TLS.AdminClients = splitList(value)
+		return nil
+	})
+	fs.Func("tls-event-clients", "comma-separated client certificate common names allowed to post direct events", func(value string) error {
+		c.TLS.EventClients = splitList(value)
+		return nil
+	})
+	fs.StringVar(&c.ProbeAddress, "probe-address", c.ProbeAddress, "host:port serving probes and metrics in plain HTTP")
+	fs.Func("allowed-topics", "comma-separated SNS topic ARNs to accept messages from", func(value string) error {
+		c.AllowedTopics = splitList(value)
+		return nil
+	})
+	fs.StringVar(&c.SNSConfirmation, "sns-confirmation", c.SNSConfirmation, "how SNS subscriptions are confirmed: url or api")
+	fs.DurationVar(&c.SNSSilenceWindow.Duration, "sns-silence-window", c.SNSSilenceWindow.Duration, "alert when an SNS topic sends nothing for this long; 0 disables")
+	fs.StringVar(&c.DirectEvents.Mode, "direct-event-auth", c.DirectEvents.Mode, "how direct EventBridge events authenticate: disabled, api-key, basic or hmac")
+	fs.Func("cloudevents-start-types", "comma-separated CloudEvents types that start a shift", func(value string) error {
+		c.CloudEvents.StartTypes = splitList(value)
+		return nil
+	})
+	fs.Func("cloudevents-end-types", "comma-separated CloudEvents types that end a shift", func(value string) error {
+		c.CloudEvents.EndTypes = splitList(value)
+		return nil
+	})
+	fs.StringVar(&c.ZoneKey, "zone-key", c.ZoneKey, "node label used by NodePool zone requirements")
+	fs.StringVar(&c.NodePoolSelector, "nodepool-selector", c.NodePoolSelector, "label selector limiting the managed NodePools")
+	fs.IntVar(&c.MinRemainingZones, "min-remaining-zones", c.MinRemainingZones, "fewest zones a shift may leave a NodePool")
+	fs.StringVar(&c.StateBackend, "state-backend", c.StateBackend, "where queued events and active shifts are kept: memory or configmap")
+	fs.BoolVar(&c.LeaderElection, "leader-election", c.LeaderElection, "elect a leader among replicas")
+	fs.StringVar(&c.PracticeRuns, "practice-runs", c.PracticeRuns, "how ARC practice runs are handled: ignore, observe or rehearse")
+	fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "log NodePool changes without making them")
+	fs.DurationVar(&c.Queue.PollInterval.Duration, "queue-poll-interval", c.Queue.PollInterval.Duration, "how often the leader looks for queued events")
+	fs.DurationVar(&c.Queue.StallThreshold.Duration, "queue-stall-threshold", c.Queue.StallThreshold.Duration, "how long an event may wait before the leader reports not ready")
+	fs.IntVar(&c.Queue.MaxAttempts, "queue-max-attempts", c.Queue.MaxAttempts, "times a failing event is processed before it is dropped")
+	fs.DurationVar(&c.EventTimeout.Duration, "event-timeout", c.EventTimeout.Duration, "how long processing one event may take before it fails and is retried")
+	fs.DurationVar(&c.ShutdownTimeout.Duration, "shutdown-timeout", c.ShutdownTimeout.Duration, "how long to wait for queued and in-flight work when stopping")
+	fs.StringVar(&c.CheckpointFile, "checkpoint-file", c.CheckpointFile, "file keeping unfinished events and active shifts across restarts with the memory backend")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "json or text")
+	fs.StringVar(&c.Region, "region", c.Region, "AWS region used when an event or shift names none")
+	fs.DurationVar(&c.Shifts.DefaultTTL.Duration, "shift-default-ttl", c.Shifts.DefaultTTL.Duration, "expiry of shifts whose event carries none")
+	fs.DurationVar(&c.Shifts.ExpiryCheckInterval.Duration, "shift-expiry-check-interval", c.Shifts.ExpiryCheckInterval.Duration, "how often expired shifts are looked for")
+	fs.StringVar(&c.Shifts.StatusChecker, "shift-status-checker", c.Shifts.StatusChecker, "confirm expiry with arc before restoring; unset trusts the expiry")
+	fs.StringVar(&c.Policy, "zonal-shift-policy", c.Policy, "name of the ZonalShiftPolicy to follow")
+	fs.DurationVar(&c.ReconcileInterval.Duration, "reconcile-interval", c.ReconcileInterval.Duration, "how often every NodePool is rechecked")
+	fs.BoolVar(&c.ZonalShifts.Enabled, "zonal-shift-resources", c.ZonalShifts.Enabled, "record every shift as a ZonalShift object")
+	fs.StringVar(&c.Audit.File, "audit-log-file", c.Audit.File, "file the audit log is appended to")
+	return fs
+}
+
+// loadEnv overrides settings with the environment variables that are set
+func (c *Config) loadEnv() error {
+	envString(&c.ListenAddress, "LISTEN_ADDRESS")
+	if port := os.Getenv("PORT"); port != "" && os.Getenv("LISTEN_ADDRESS") == "" {
+		c.ListenAddress = ":" + port
+	}
+	envString(&c.TLS.CertFile, "TLS_CERT_FILE")
+	envString(&c.TLS.KeyFile, "TLS_KEY_FILE")
+	envString(&c.TLS.ClientCAFile, "TLS_CLIENT_CA_FILE")
+	envString(&c.TLS.ClientAuth, "TLS_CLIENT_AUTH")
+	if value := os.Getenv("TLS_ADMIN_CLIENTS"); value != "" {
+		c.TLS.AdminClients = splitList(value)
+	}
+	if value := os.Getenv("TLS_EVENT_CLIENTS"); value != "" {
+		c.TLS.EventClients = splitList(value)
+	}
+	envString(&c.ProbeAddress, "PROBE_ADDRESS")
+	if value := os.Getenv("ALLOWED_TOPIC_ARNS"); value != "" {
+		c.AllowedTopics = splitList(value)
+	}
+	envString(&c.SNSConfirmation, "SNS_CONFIRMATION")
+	envString(&c.DirectEvents.Mode, "DIRECT_EVENT_AUTH")
+	envString(&c.DirectEvents.APIKeyHeader, "DIRECT_EVENT_API_KEY_HEADER")
+	envString(&c.DirectEvents.APIKey, "DIRECT_EVENT_API_KEY")
+	envString(&c.DirectEvents.Username, "DIRECT_EVENT_USERNAME")
+	envString(&c.DirectEvents.Password, "DIRECT_EVENT_PASSWORD")
+	envString(&c.DirectEvents.HMACSecret, "DIRECT_EVENT_HMAC_SECRET")
+	if value := os.Getenv("CLOUDEVENTS_START_TYPES"); value != "" {
+		c.CloudEvents.StartTypes = splitList(value)
+	}
+	if value := os.Getenv("CLOUDEVENTS_END_TYPES"); value != "" {
+		c.CloudEvents.EndTypes = splitList(value)
+	}
+	envString(&c.ZoneKey, "ZONE_LABEL_KEY")
+	envString(&c.NodePoolSelector, "MANAGED_NODEPOOL_SELECTOR")
+	envString(&c.StateBackend, "STATE_BACKEND")
+	envString(&c.PracticeRuns, "PRACTICE_RUNS")
+	envString(&c.CheckpointFile, "CHECKPOINT_FILE")
+	envString(&c.Log.Level, "LOG_LEVEL")
+	envString(&c.Log.Format, "LOG_FORMAT")
+	envString(&c.Log.Output, "LOG_OUTPUT")
+	envString(&c.AdminAPIToken, "ADMIN_API_TOKEN")
+	envString(&c.Region, "AWS_REGION")
+	envString(&c.Shifts.StatusChecker, "SHIFT_STATUS_CHECKER")
+	envString(&c.Policy, "ZONAL_SHIFT_POLICY")
+	envString(&c.Notify.WebhookURL, "NOTIFY_WEBHOOK_URL")
+	envString(&c.Notify.SlackWebhookURL, "NOTIFY_SLACK_WEBHOOK_URL")
+	envString(&c.Notify.SNSTopicARN, "NOTIFY_SNS_TOPIC_ARN")
+	for kind := range defaultNotifyTemplates {
+		if text := os.Getenv(notifyTemplateVariable(kind)); text != "" {
+			if c.Notify.Templates == nil {
+				c.Notify.Templates = map[string]string{}
+			}
+			c.Notify.Templates[kind] = text
+		}
+	}
+	envString(&c.Audit.File, "AUDIT_LOG_FILE")
+	return errors.Join(
+		envInt(&c.MinRemainingZones, "MIN_REMAINING_ZONES"),
+		envBool(&c.LeaderElection, "LEADER_ELECTION"),
+		envBool(&c.DryRun, "DRY_RUN"),
+		envDuration(&c.Queue.PollInterval, "QUEUE_POLL_INTERVAL"),
+		envDuration(&c.Queue.StallThreshold, "QUEUE_STALL_THRESHOLD"),
+		envInt(&c.Queue.MaxAttempts, "QUEUE_MAX_ATTEMPTS"),
+		envDuration(&c.Timeouts.ReadHeader, "HTTP_READ_HEADER_TIMEOUT"),
+		envDuration(&c.Timeouts.Read, "HTTP_READ_TIMEOUT"),
+		envDuration(&c.Timeouts.Write, "HTTP_WRITE_TIMEOUT"),
+		envDuration(&c.Timeouts.Idle, "HTTP_IDLE_TIMEOUT"),
+		envDuration(&c.SNSSilenceWindow, "SNS_SILENCE_WINDOW"),
+		envDuration(&c.DirectEvents.MaxSkew, "DIRECT_EVENT_MAX_SKEW"),
+		envDuration(&c.EventTimeout, "EVENT_TIMEOUT"),
+		envDuration(&c.ShutdownTimeout, "SHUTDOWN_TIMEOUT"),
+		envDuration(&c.Shifts.DefaultTTL, "SHIFT_DEFAULT_TTL"),
+		envDuration(&c.Shifts.ExpiryCheckInterval, "SHIFT_EXPIRY_CHECK_INTERVAL"),
+		envDuration(&c.ReconcileInterval, "RECONCILE_INTERVAL"),
+		envBool(&c.ZonalShifts.Enabled, "ZONAL_SHIFT_RESOURCES"),
+		envDuration(&c.ZonalShifts.Retention, "ZONAL_SHIFT_RETENTION"),
+		envInt(&c.Notify.Retries, "NOTIFY_RETRIES"),
+		envInt(&c.Audit.MaxSize, "AUDIT_LOG_MAX_SIZE"),
+		envBool(&c.Audit.ConfigMap, "AUDIT_CONFIGMAP"),
+		envInt(&c.Audit.ConfigMapMaxRecords, "AUDIT_CONFIGMAP_MAX_RECORDS"),
+	)
+}
+
+func envString(dst *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*dst = value
+	}
+}
+
+func envInt(dst *int, name string) error {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dst = n
+	}
+	return nil
+}
+
+func envBool(dst *bool, name string) error {
+	if value := os.Getenv(name); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		*dst = b
+	}
+	return nil
+}
+
+func envDuration(dst *metav1.Duration, name string) error {
+	if value := os.Getenv(name); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		dst.Duration = d
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validate reports every setting the server cannot start with
+func (c *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid listenAddress %q: %v", c.ListenAddress, err))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.certFile and tls.keyFile must be set together"))
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if file != "" {
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, fmt.Errorf("unreadable TLS file: %v", err))
+			}
+		}
+	}
+	switch c.TLS.ClientAuth {
+	case "", clientAuthNone:
+		if c.TLS.ClientCAFile != "" {
+			errs = append(errs, errors.New("tls.clientCAFile requires tls.clientAuth optional or require"))
+		}
+		if len(c.TLS.AdminClients) > 0 || len(c.TLS.EventClients) > 0 {
+			errs = append(errs, errors.New("tls.adminClients and tls.eventClients require tls.clientAuth optional or require"))
+		}
+	case clientAuthOptional, clientAuthRequire:
+		if c.TLS.ClientCAFile == "" || c.TLS.CertFile == "" {
+			errs = append(errs, fmt.Errorf("tls.clientAuth %s requires tls.certFile and tls.clientCAFile", c.TLS.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown tls.clientAuth %q", c.TLS.ClientAuth))
+	}
+	if c.ProbeAddress != "" {
+		if _, _, err := net.SplitHostPort(c.ProbeAddress); err != nil {
+			errs = append(errs, fmt.Errorf("invalid probeAddress %q: %v", c.ProbeAddress, err))
+		} else if c.ProbeAddress == c.ListenAddress {
+			errs = append(errs, errors.New("probeAddress must differ from listenAddress"))
+		}
+	}
+	for _, topic := range c.AllowedTopics {
+		if !strings.HasPrefix(topic, "arn:") || strings.Count(topic, ":") != 5 {
+			errs = append(errs, fmt.Errorf("invalid allowed topic ARN %q", topic))
+		}
+	}
+	if c.SNSConfirmation != snsConfirmByURL && c.SNSConfirmation != snsConfirmByAPI {
+		errs = append(errs, fmt.Errorf("unknown snsConfirmation %q", c.SNSConfirmation))
+	}
+	if c.SNSSilenceWindow.Duration < 0 {
+		errs = append(errs, errors.New("snsSilenceWindow must not be negative"))
+	}
+	errs = append(errs, c.DirectEvents.validate()...)
+	errs = append(errs, c.CloudEvents.validate()...)
+	errs = append(errs, validateTriggers(c.Triggers)...)
+	if !slices.Contains([]string{practiceRunsIgnore, practiceRunsObserve, practiceRunsRehearse}, c.PracticeRuns) {
+		errs = append(errs, fmt.Errorf("unknown practiceRuns mode %q", c.PracticeRuns))
+	}
+	if c.ZoneKey == "" {
+		errs = append(errs, errors.New("zoneKey must be set"))
+	}
+	if _, err := labels.Parse(c.NodePoolSelector); err != nil {
+		errs = append(errs, fmt.Errorf("invalid nodePoolSelector %q: %v", c.NodePoolSelector, err))
+	}
+	if c.MinRemainingZones < 1 {
+		errs = append(errs, fmt.Errorf("minRemainingZones must be at least 1, got %d", c.MinRemainingZones))
+	}
+	if !slices.Contains([]string{"memory", "configmap"}, c.StateBackend) {
+		errs = append(errs, fmt.Errorf("unknown stateBackend %q", c.StateBackend))
+	}
+	if c.LeaderElection && c.StateBackend != "configmap" {
+		errs = append(errs, errors.New("leaderElection requires stateBackend configmap"))
+	}
+	if c.Queue.PollInterval.Duration <= 0 || c.Queue.StallThreshold.Duration <= 0 {
+		errs = append(errs, errors.New("queue.pollInterval and queue.stallThreshold must be positive"))
+	}
+	if c.Queue.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("queue.maxAttempts must be at least 1, got %d", c.Queue.MaxAttempts))
+	}
+	for _, d := range []metav1.Duration{c.Timeouts.ReadHeader, c.Timeouts.Read, c.Timeouts.Write, c.Timeouts.Idle} {
+		if d.Duration < 0 {
+			errs = append(errs, fmt.Errorf("timeouts must not be negative, got %s", d.Duration))
+		}
+	}
+	if c.EventTimeout.Duration <= 0 || c.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("eventTimeout and shutdownTimeout must be positive"))
+	}
+	if c.CheckpointFile != "" && c.StateBackend != "memory" {
+		errs = append(errs, errors.New("checkpointFile is only used with stateBackend memory"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level %q", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("invalid log format %q", c.Log.Format))
+	}
+	if c.Shifts.DefaultTTL.Duration <= 0 || c.Shifts.ExpiryCheckInterval.Duration <= 0 {
+		errs = append(errs, errors.New("shifts.defaultTTL and shifts.expiryCheckInterval must be positive"))
+	}
+	if c.Shifts.StatusChecker != "" && c.Shifts.StatusChecker != statusCheckerARC {
+		errs = append(errs, fmt.Errorf("unknown shifts.statusChecker %q", c.Shifts.StatusChecker))
+	}
+	if c.Policy == "" {
+		errs = append(errs, errors.New("policy must be set"))
+	}
+	if c.ReconcileInterval.Duration <= 0 || c.ZonalShifts.Retention.Duration <= 0 {
+		errs = append(errs, errors.New("reconcileInterval and zonalShifts.retention must be positive"))
+	}
+	errs = append(errs, c.Notify.validate()...)
+	if c.Audit.MaxSize < 1 || c.Audit.ConfigMapMaxRecords < 1 {
+		errs = append(errs, errors.New("audit.maxSize and audit.configMapMaxRecords must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of the configuration safe to log
+func (c Config) redacted() Config {
+	// Webhook URLs carry their own credentials
+	for _, secret := range []*string{&c.AdminAPIToken, &c.DirectEvents.APIKey, &c.DirectEvents.Password, &c.DirectEvents.HMACSecret,
+		&c.Notify.WebhookURL, &c.Notify.SlackWebhookURL} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return c
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestConfig makes a default configuration, changed by set, the one in use for the test
+func useTestConfig(t *testing.T, set func(*Config)) {
+	original := appConfig
+	c := defaultConfig()
+	set(c)
+	applyConfig(c)
+	t.Cleanup(func() { applyConfig(original) })
+}
+
+// clearConfigEnv unsets the environment variables loadConfig reads
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{"CONFIG_FILE", "LISTEN_ADDRESS", "PORT", "TLS_CERT_FILE", "TLS_KEY_FILE",
+		"ALLOWED_TOPIC_ARNS", "ZONE_LABEL_KEY", "MANAGED_NODEPOOL_SELECTOR", "MIN_REMAINING_ZONES",
+		"STATE_BACKEND", "PRACTICE_RUNS", "LEADER_ELECTION", "DRY_RUN", "QUEUE_POLL_INTERVAL", "QUEUE_STALL_THRESHOLD",
+		"QUEUE_MAX_ATTEMPTS", "HTTP_READ_HEADER_TIMEOUT", "HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT",
+		"HTTP_IDLE_TIMEOUT", "LOG_LEVEL", "LOG_FORMAT", "LOG_OUTPUT", "ADMIN_API_TOKEN", "EVENT_TIMEOUT",
+		"SHUTDOWN_TIMEOUT", "CHECKPOINT_FILE", "TLS_CLIENT_CA_FILE", "TLS_CLIENT_AUTH", "PROBE_ADDRESS",
+		"SNS_CONFIRMATION", "SNS_SILENCE_WINDOW", "DIRECT_EVENT_AUTH", "CLOUDEVENTS_START_TYPES", "CLOUDEVENTS_END_TYPES",
+		"DIRECT_EVENT_API_KEY_HEADER", "DIRECT_EVENT_API_KEY", "DIRECT_EVENT_USERNAME", "DIRECT_EVENT_PASSWORD",
+		"DIRECT_EVENT_HMAC_SECRET", "DIRECT_EVENT_MAX_SKEW", "TLS_ADMIN_CLIENTS", "TLS_EVENT_CLIENTS", "AWS_REGION", "SHIFT_DEFAULT_TTL", "SHIFT_EXPIRY_CHECK_INTERVAL",
+		"SHIFT_STATUS_CHECKER", "ZONAL_SHIFT_POLICY", "RECONCILE_INTERVAL", "ZONAL_SHIFT_RESOURCES", "ZONAL_SHIFT_RETENTION",
+		"NOTIFY_WEBHOOK_URL", "NOTIFY_SLACK_WEBHOOK_URL", "NOTIFY_SNS_TOPIC_ARN", "NOTIFY_RETRIES", "AUDIT_LOG_FILE",
+		"AUDIT_LOG_MAX_SIZE", "AUDIT_CONFIGMAP", "AUDIT_CONFIGMAP_MAX_RECORDS"} {
+		t.Setenv(name, "")
+	}
+	for kind := range defaultNotifyTemplates {
+		t.Setenv(notifyTemplateVariable(kind), "")
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	clearConfigEnv(t)
+	c, err := loadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig(), c)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, `
+listenAddress: ":9000"
+zoneKey: example.com/zone
+minRemainingZones: 2
+dryRun: true
+queue:
+  pollInterval: 5s
+  maxAttempts: 3
+log:
+  level: debug
+`)
+
+	// The file overrides the defaults
+	c, err := loadConfig([]string{"--config", path})
+	require.NoError(t, err)
+	assert.Equal(t, ":9000", c.ListenAddress)
+	assert.Equal(t, "example.com/zone", c.ZoneKey)
+	assert.Equal(t, 2, c.MinRemainingZones)
+	assert.True(t, c.DryRun)
+	assert.Equal(t, 5*time.Second, c.Queue.PollInterval.Duration)
+	assert.Equal(t, defaultQueueStallThreshold, c.Queue.StallThreshold.Duration)
+	assert.Equal(t, 3, c.Queue.MaxAttempts)
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, "json", c.Log.Format)
+
+	// The environment overrides the file, and flags override both
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("MIN_REMAINING_ZONES", "3")
+	t.Setenv("QUEUE_POLL_INTERVAL", "10s")
+	t.Setenv("ALLOWED_TOPIC_ARNS", "arn:aws:sns:us-east-1:123456789012:a, arn:aws:sns:us-east-1:123456789012:b")
+	c, err = loadConfig([]string{"--min-remaining-zones=4", "--dry-run=false"})
+	require.NoError(t, err)
+	assert.Equal(t, ":9000", c.ListenAddress)
+	assert.Equal(t, 4, c.MinRemainingZones)
+	assert.False(t, c.DryRun)
+	assert.Equal(t, 10*time.Second, c.Queue.PollInterval.Duration)
+	assert.Equal(t, []string{"arn:aws:sns:us-east-1:123456789012:a", "arn:aws:sns:us-east-1:123456789012:b"}, c.AllowedTopics)
+
+	// PORT is still honoured when LISTEN_ADDRESS is not set
+	t.Setenv("PORT", "8443")
+	c, err = loadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, ":8443", c.ListenAddress)
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := loadConfig([]string{"--config", writeConfigFile(t, "listenAdress: \":9000\"\n")})
+	assert.ErrorContains(t, err, "invalid config file")
+
+	t.Setenv("MIN_REMAINING_ZONES", "two")
+	_, err = loadConfig(nil)
+	assert.ErrorContains(t, err, "invalid MIN_REMAINING_ZONES")
+	t.Setenv("MIN_REMAINING_ZONES", "")
+
+	_, err = loadConfig([]string{"--unknown-flag"})
+	assert.Error(t, err)
+
+	// Every invalid setting is reported at once
+	_, err = loadConfig([]string{
+		"--listen-address", "8080",
+		"--tls-cert-file", "cert.pem",
+		"--allowed-topics", "my-topic",
+		"--nodepool-selector", "team in (",
+		"--min-remaining-zones", "0",
+		"--state-backend", "redis",
+		"--leader-election",
+		"--queue-max-attempts", "0",
+		"--log-level", "loud",
+		"--log-format", "xml",
+	})
+	require.Error(t, err)
+	for _, message := range []string{
+		"invalid listenAddress",
+		"tls.certFile and tls.keyFile must be set together",
+		"unreadable TLS file",
+		`invalid allowed topic ARN "my-topic"`,
+		"invalid nodePoolSelector",
+		"minRemainingZones must be at least 1",
+		`unknown stateBackend "redis"`,
+		"leaderElection requires stateBackend configmap",
+		"queue.maxAttempts must be at least 1",
+		`invalid log level "loud"`,
+		`invalid log format "xml"`,
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+}
+
+func TestLoadConfigServiceSettings(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeConfigFile(t, `
+region: eu-west-1
+shifts:
+  defaultTTL: 6h
+  statusChecker: arc
+notify:
+  slackWebhookURL: https://hooks.slack.com/services/T0/B0/x
+  retries: 1
+  templates:
+    shift-applied: "{{.ZoneID}} drained"
+audit:
+  file: /var/log/zonal-shift/audit.log
+`)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("SHIFT_EXPIRY_CHECK_INTERVAL", "30s")
+	t.Setenv("ZONAL_SHIFT_RESOURCES", "true")
+	t.Setenv("AUDIT_CONFIGMAP", "true")
+	t.Setenv(notifyTemplateVariable(notifyShiftRefused), "{{.ZoneID}} refused")
+	c, err := loadConfig([]string{"--config", path, "--reconcile-interval", "1m"})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", c.Region)
+	assert.Equal(t, 6*time.Hour, c.Shifts.DefaultTTL.Duration)
+	assert.Equal(t, 30*time.Second, c.Shifts.ExpiryCheckInterval.Duration)
+	assert.Equal(t, statusCheckerARC, c.Shifts.StatusChecker)
+	assert.Equal(t, defaultPolicyName, c.Policy)
+	assert.Equal(t, time.Minute, c.ReconcileInterval.Duration)
+	assert.True(t, c.ZonalShifts.Enabled)
+	assert.Equal(t, defaultZonalShiftRetention, c.ZonalShifts.Retention.Duration)
+	assert.Equal(t, "https://hooks.slack.com/services/T0/B0/x", c.Notify.SlackWebhookURL)
+	assert.Equal(t, 1, c.Notify.Retries)
+	assert.Equal(t, map[string]string{notifyShiftApplied: "{{.ZoneID}} drained", notifyShiftRefused: "{{.ZoneID}} refused"}, c.Notify.Templates)
+	assert.Equal(t, "/var/log/zonal-shift/audit.log", c.Audit.File)
+	assert.True(t, c.Audit.ConfigMap)
+	assert.Equal(t, defaultAuditConfigMapRecords, c.Audit.ConfigMapMaxRecords)
+
+	// Settings that used to fall back to their defaults now stop the server
+	t.Setenv("SHIFT_EXPIRY_CHECK_INTERVAL", "0s")
+	t.Setenv("SHIFT_STATUS_CHECKER", "ec2")
+	t.Setenv("NOTIFY_RETRIES", "-1")
+	t.Setenv("NOTIFY_SNS_TOPIC_ARN", "alerts")
+	t.Setenv(notifyTemplateVariable(notifyShiftRefused), "{{.ZoneID")
+	t.Setenv("AUDIT_CONFIGMAP_MAX_RECORDS", "0")
+	_, err = loadConfig([]string{"--config", path, "--zonal-shift-policy", ""})
+	require.Error(t, err)
+	for _, message := range []string{
+		"shifts.defaultTTL and shifts.expiryCheckInterval must be positive",
+		`unknown shifts.statusChecker "ec2"`,
+		"policy must be set",
+		"notify.retries must not be negative",
+		`invalid notify.snsTopicARN "alerts"`,
+		"invalid shift-refused template",
+		"audit.maxSize and audit.configMapMaxRecords must be at least 1",
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := defaultConfig()
+	c.AdminAPIToken = "secret"
+	c.Notify.SlackWebhookURL = "https://hooks.slack.com/services/secret"
+	redactedConfig := c.redacted()
+	assert.Equal(t, redacted, redactedConfig.AdminAPIToken)
+	assert.Equal(t, "secret", c.AdminAPIToken)
+
+	data, err := json.Marshal(redactedConfig)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+}
+
+func TestAllowedTopics(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{"arn:aws:sns:us-east-1:123456789012:zonal-shift"} })
+
+	send := func(topic string) int {
+		body, err := json.Marshal(signSNSMessage(t, SNSMessage{
+			Type:     "Notification",
+			TopicArn: topic,
+			Message:  `{"version": "0", "id": "abc123", "detail-type": "Autoshift In Progress", "source": "aws.arc", "region": "us-east-1", "detail": {"version": "0.0.1", "metadata": {"awayFrom": "use1-az1"}}}`,
+		}))
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", "/sns", bytes.NewReader(body))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusForbidden, send("arn:aws:sns:us-east-1:123456789012:other"))
+	assert.Equal(t, http.StatusOK, send("arn:aws:sns:us-east-1:123456789012:zonal-shift"))
+}
+
+func TestDryRunLeavesNodePoolsUnchanged(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestConfig(t, func(c *Config) { c.DryRun = true })
+	processor := NewProcessor(client, testZones)
+	configureProcessor(processor)
+
+	ctx := context.Background()
+	changes, err := processor.PlanEvent(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	pool := getTestNodePool(t, client, "default")
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Empty(t, pool.removedZones())
+
+	// A processed event starts no shift and sends no notification
+	useTestProcessor(t, processor)
+	webhook := &recordingServer{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	record, err := processReceivedEvent(ctx, testShiftEvent("Autoshift In Progress"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeDryRun, record.Outcome)
+	assert.Equal(t, []string{"default"}, record.NodePools)
+	assert.Empty(t, store.ActiveShifts())
+	n.Wait()
+	assert.Empty(t, webhook.requests)
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Modes of the directEvents.mode setting
+const (
+	directEventsDisabled = "disabled"
+	directEventsAPIKey   = "api-key"
+	directEventsBasic    = "basic"
+	directEventsHMAC     = "hmac"
+)
+
+const (
+	// signatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp, a dot, any CloudEvents headers and the body, keyed with the
+	// shared secret
+	signatureHeader = "X-Zonal-Shift-Signature"
+	// timestampHeader carries the Unix time the request was signed at
+	timestampHeader = "X-Zonal-Shift-Timestamp"
+)
+
+// DirectEventAuth authenticates EventBridge events posted directly, such as by
+// an API destination, rather than wrapped in an SNS message
+type DirectEventAuth struct {
+	// Mode is disabled, api-key, basic or hmac. Direct events are rejected when disabled.
+	Mode string `json:"mode"`
+	// APIKeyHeader and APIKey are the header and value an api-key connection sends
+	APIKeyHeader string `json:"apiKeyHeader,omitempty"`
+	APIKey       string `json:"apiKey,omitempty"`
+	// Username and Password are the credentials a basic connection sends
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// HMACSecret signs requests in hmac mode
+	HMACSecret string `json:"hmacSecret,omitempty"`
+	// MaxSkew is how far a signed timestamp may be from now; a signature is
+	// accepted once within it
+	MaxSkew metav1.Duration `json:"maxSkew"`
+}
+
+// validate reports the settings the configured mode is missing
+func (a DirectEventAuth) validate() []error {
+	var errs []error
+	switch a.Mode {
+	case directEventsDisabled:
+	case directEventsAPIKey:
+		if a.APIKeyHeader == "" || a.APIKey == "" {
+			errs = append(errs, errors.New("directEvents mode api-key requires apiKeyHeader and apiKey"))
+		}
+	case directEventsBasic:
+		if a.Username == "" || a.Password == "" {
+			errs = append(errs, errors.New("directEvents mode basic requires username and password"))
+		}
+	case directEventsHMAC:
+		if a.HMACSecret == "" {
+			errs = append(errs, errors.New("directEvents mode hmac requires hmacSecret"))
+		}
+		if a.MaxSkew.Duration <= 0 {
+			errs = append(errs, errors.New("directEvents.maxSkew must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown directEvents mode %q", a.Mode))
+	}
+	return errs
+}
+
+// errDirectEventsDisabled is returned for direct events when no authentication is configured
+var errDirectEventsDisabled = errors.New("direct events are disabled")
+
+// authenticateDirectEvent checks the credentials on a direct event request
+// against the configured mode. A verified client certificate named in
+// tls.eventClients is accepted in any mode, and its principal returned.
+func authenticateDirectEvent(r *http.Request, body []byte, now time.Time) (string, error) {
+	if principal, ok := clientPrincipal(r, appConfig.TLS.EventClients); ok {
+		return principal, nil
+	}
+	return "", checkDirectEventCredentials(r, body, now)
+}
+
+// checkDirectEventCredentials checks the shared credentials of the configured mode
+func checkDirectEventCredentials(r *http.Request, body []byte, now time.Time) error {
+	auth := appConfig.DirectEvents
+	switch auth.Mode {
+	case directEventsAPIKey:
+		if !secretEqual(r.Header.Get(auth.APIKeyHeader), auth.APIKey) {
+			return errors.New("missing or wrong API key")
+		}
+		return nil
+	case directEventsBasic:
+		username, password, ok := r.BasicAuth()
+		// Compare both so a wrong username takes as long as a wrong password
+		usernameOK, passwordOK := secretEqual(username, auth.Username), secretEqual(password, auth.Password)
+		if !ok || !usernameOK || !passwordOK {
+			return errors.New("missing or wrong basic credentials")
+		}
+		return nil
+	case directEventsHMAC:
+		return verifySignature(r.Context(), r.Header.Get(signatureHeader), r.Header.Get(timestampHeader), r.Header, body, auth, now)
+	}
+	return errDirectEventsDisabled
+}
+
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// signRequest returns the signature header value for a request signed at
+// timestamp. A binary CloudEvent carries its attributes in ce-* headers, so
+// those are signed too, each as a lowercase "name:value" line in name order.
+func signRequest(secret, timestamp string, header http.Header, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	var names []string
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), cloudEventsHeaderPrefix) {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	for _, name := range names {
+		mac.Write([]byte(strings.ToLower(name) + ":" + strings.Join(header.Values(name), ",") + "\n"))
+	}
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks an HMAC signature and rejects it if its timestamp is
+// outside the allowed skew or it has already been used
+func verifySignature(ctx context.Context, signature, timestamp string, header http.Header, body []byte, auth DirectEventAuth, now time.Time) error {
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("missing %s or %s header", signatureHeader, timestampHeader)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header %q", timestampHeader, timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	// Hex is case-insensitive, so compare and remember one form
+	signature = strings.ToLower(signature)
+	if skew := now.Sub(signedAt); skew > auth.MaxSkew.Duration || skew < -auth.MaxSkew.Duration {
+		return fmt.Errorf("signature timestamp %s is outside the allowed skew of %s", signedAt.UTC().Format(time.RFC3339), auth.MaxSkew.Duration)
+	}
+	if !hmac.Equal([]byte(signature), []byte(signRequest(auth.HMACSecret, timestamp, header, body))) {
+		return errors.New("wrong signature")
+	}
+	fresh, err := usedSignatures.use(ctx, signature, signedAt.Add(auth.MaxSkew.Duration), now)
+	if err != nil {
+		return fmt.Errorf("failed to check signature for reuse: %v", err)
+	}
+	if !fresh {
+		return errors.New("signature has already been used")
+	}
+	return nil
+}
+
+// signatureStore remembers used signatures until their timestamp leaves the
+// allowed skew, after which they are rejected as too old anyway
+type signatureStore interface {
+	// use records a signature valid until expires, reporting false if it was already recorded
+	use(ctx context.Context, signature string, expires, now time.Time) (bool, error)
+}
+
+// usedSignatures is the replica's own signatureCache, or with the configmap
+// state backend the state ConfigMap, so a signature used on one replica is
+// refused on every other
+var usedSignatures signatureStore = newSignatureCache()
+
+// signatureCache keeps used signatures in memory
+type signatureCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{expires: map[string]time.Time{}}
+}
+
+func (c *signatureCache) use(_ context.Context, signature string, expires, now time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for s, at := range c.expires {
+		if at.Before(now) {
+			delete(c.expires, s)
+		}
+	}
+	if _, ok := c.expires[signature]; ok {
+		return false, nil
+	}
+	c.expires[signature] = expires
+	return true, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDirectEvent = `{"version": "0", "id": "direct-1", "detail-type": "Autoshift In Progress", "source": "aws.arc", "region": "us-east-1", "detail": {"version": "0.0.1", "metadata": {"awayFrom": "use1-az1"}}}`
+
+func postDirectEvent(t *testing.T, header http.Header) int {
+	req, err := http.NewRequest("POST", "/sns", bytes.NewBufferString(testDirectEvent))
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestDirectEventsDisabledByDefault(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) {})
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, nil))
+}
+
+func TestDirectEventAPIKey(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.APIKey = directEventsAPIKey, "key"
+	})
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, nil))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, http.Header{"X-Api-Key": {"wrong"}}))
+	assert.Equal(t, http.StatusOK, postDirectEvent(t, http.Header{"X-Api-Key": {"key"}}))
+}
+
+func TestDirectEventBasicAuth(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.Username, c.DirectEvents.Password = directEventsBasic, "eventbridge", "secret"
+	})
+	basic := func(username, password string) http.Header {
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.SetBasicAuth(username, password)
+		return req.Header
+	}
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, nil))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, basic("eventbridge", "wrong")))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, basic("someone", "secret")))
+	assert.Equal(t, http.StatusOK, postDirectEvent(t, basic("eventbridge", "secret")))
+}
+
+func TestDirectEventHMAC(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.HMACSecret = directEventsHMAC, "shared"
+	})
+	signed := func(secret string, at time.Time) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		return http.Header{
+			signatureHeader: {signRequest(secret, timestamp, nil, []byte(testDirectEvent))},
+			timestampHeader: {timestamp},
+		}
+	}
+	now := time.Now()
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, nil))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, signed("other", now)))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, signed("shared", now.Add(-10*time.Minute))))
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, signed("shared", now.Add(10*time.Minute))))
+
+	header := signed("shared", now)
+	assert.Equal(t, http.StatusOK, postDirectEvent(t, header))
+	// The same signed request cannot be replayed while its timestamp is still accepted
+	assert.Equal(t, http.StatusUnauthorized, postDirectEvent(t, header))
+}
+
+func TestSignaturesAreSharedThroughStateConfigMap(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	replicaA, replicaB := newConfigMapState(clientset, "default"), newConfigMapState(clientset, "default")
+	now := time.Now()
+
+	// A signature used on one replica is refused on another
+	fresh, err := replicaA.use(ctx, "sha256=0a1b", now.Add(5*time.Minute), now)
+	require.NoError(t, err)
+	assert.True(t, fresh)
+	fresh, err = replicaB.use(ctx, "sha256=0a1b", now.Add(5*time.Minute), now)
+	require.NoError(t, err)
+	assert.False(t, fresh)
+
+	// Expired signatures are dropped instead of piling up
+	later := now.Add(10 * time.Minute)
+	fresh, err = replicaB.use(ctx, "sha256=2c3d", later.Add(5*time.Minute), later)
+	require.NoError(t, err)
+	assert.True(t, fresh)
+	cm, _, err := replicaA.get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{configMapSignaturePrefix + "2c3d"}, slices.Collect(maps.Keys(cm.Data)))
+}
+
+func TestDirectEventAuthValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig([]string{"--direct-event-auth", "hmac"})
+	assert.ErrorContains(t, err, "directEvents mode hmac requires hmacSecret")
+	_, err = loadConfig([]string{"--direct-event-auth", "oauth"})
+	assert.ErrorContains(t, err, `unknown directEvents mode "oauth"`)
+
+	t.Setenv("DIRECT_EVENT_HMAC_SECRET", "shared")
+	c, err := loadConfig([]string{"--direct-event-auth", "hmac"})
+	require.NoError(t, err)
+	assert.Equal(t, redacted, c.redacted().DirectEvents.HMACSecret)
+}
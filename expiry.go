@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/arczonalshift"
+	arctypes "github.com/aws/aws-sdk-go-v2/service/arczonalshift/types"
+)
+
+const (
+	// defaultShiftTTL is how long a shift lasts when neither the event nor
+	// SHIFT_DEFAULT_TTL says otherwise
+	defaultShiftTTL = 24 * time.Hour
+
+	// defaultExpiryCheckInterval is how often expired shifts are looked for
+	defaultExpiryCheckInterval = time.Minute
+
+	// defaultExpiryRecheck is how long an expired shift is kept when the
+	// status checker reports it is still under way
+	defaultExpiryRecheck = 10 * time.Minute
+
+	// statusCheckerARC confirms with ARC that a shift has ended before it is restored
+	statusCheckerARC = "arc"
+
+	// Event source and detail type used when a shift is restored on expiry
+	expiryEventSource = "zonal-shift.expiry"
+	shiftExpired      = "Shift Expired"
+)
+
+// ShiftStatusChecker confirms with an outside source whether a shift is still under way
+type ShiftStatusChecker interface {
+	ShiftActive(ctx context.Context, shift Shift) (bool, error)
+}
+
+// arcClient is the part of the ARC zonal shift API the status checker uses
+type arcClient interface {
+	ListAutoshifts(ctx context.Context, params *arczonalshift.ListAutoshiftsInput, optFns ...func(*arczonalshift.Options)) (*arczonalshift.ListAutoshiftsOutput, error)
+	ListZonalShifts(ctx context.Context, params *arczonalshift.ListZonalShiftsInput, optFns ...func(*arczonalshift.Options)) (*arczonalshift.ListZonalShiftsOutput, error)
+}
+
+// arcStatusChecker asks Route 53 ARC, in the shift's region, whether an
+// autoshift or zonal shift away from the zone is still active
+type arcStatusChecker struct {
+	// region is asked about shifts that do not record their own
+	region string
+	// newClient creates the client for a region
+	newClient func(ctx context.Context, region string) (arcClient, error)
+
+	mu      sync.Mutex
+	clients map[string]arcClient
+}
+
+// newARCStatusChecker creates a checker using the default AWS config
+func newARCStatusChecker(region string) ShiftStatusChecker {
+	return &arcStatusChecker{region: region, newClient: newARCClient}
+}
+
+// newARCClient creates an ARC client for region using the default AWS config
+func newARCClient(ctx context.Context, region string) (arcClient, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return arczonalshift.NewFromConfig(awsCfg), nil
+}
+
+// clientFor returns the client for the shift's region, creating it on first use
+func (a *arcStatusChecker) clientFor(ctx context.Context, shift Shift) (arcClient, error) {
+	region := shift.Region
+	if region == "" {
+		region = a.region
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if client, ok := a.clients[region]; ok {
+		return client, nil
+	}
+	client, err := a.newClient(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	if a.clients == nil {
+		a.clients = map[string]arcClient{}
+	}
+	a.clients[region] = client
+	return client, nil
+}
+
+func (a *arcStatusChecker) ShiftActive(ctx context.Context, shift Shift) (bool, error) {
+	client, err := a.clientFor(ctx, shift)
+	if err != nil {
+		return false, err
+	}
+	autoshifts := arczonalshift.NewListAutoshiftsPaginator(client, &arczonalshift.ListAutoshiftsInput{
+		Status: arctypes.AutoshiftExecutionStatusActive,
+	})
+	for autoshifts.HasMorePages() {
+		page, err := autoshifts.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to list autoshifts: %v", err)
+		}
+		for _, item := range page.Items {
+			if aws.ToString(item.AwayFrom) == shift.ZoneID {
+				return true, nil
+			}
+		}
+	}
+
+	zonalShifts := arczonalshift.NewListZonalShiftsPaginator(client, &arczonalshift.ListZonalShiftsInput{
+		Status: arctypes.ZonalShiftStatusActive,
+	})
+	for zonalShifts.HasMorePages() {
+		page, err := zonalShifts.NextPage(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to list zonal shifts: %v", err)
+		}
+		for _, item := range page.Items {
+			if aws.ToString(item.AwayFrom) == shift.ZoneID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ExpiryReconciler restores shifts whose expiry has passed, covering for end
+// events that never arrived
+type ExpiryReconciler struct {
+	// Interval is how often expired shifts are looked for
+	Interval time.Duration
+	// Recheck is how long to wait before looking again at an expired shift
+	// that the checker says is still active
+	Recheck time.Duration
+	// Checker, if set, must confirm a shift has ended before it is restored.
+	// Manual shifts are never checked since ARC does not know about them.
+	Checker ShiftStatusChecker
+
+	now func() time.Time
+}
+
+// newExpiryReconcilerFromConfig configures the reconciler from the shift
+// settings. The arc status checker confirms expiry with ARC before restoring.
+func newExpiryReconcilerFromConfig() *ExpiryReconciler {
+	r := &ExpiryReconciler{
+		Interval: appConfig.Shifts.ExpiryCheckInterval.Duration,
+		Recheck:  defaultExpiryRecheck,
+	}
+	if appConfig.Shifts.StatusChecker == statusCheckerARC {
+		r.Checker = newARCStatusChecker(appConfig.Region)
+	}
+	return r
+}
+
+// Run reconciles on every interval until ctx is done
+func (r *ExpiryReconciler) Run(ctx context.Context) {
+	slog.Info("Checking for expired shifts", "interval", r.Interval)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reconcile(ctx)
+		}
+	}
+}
+
+// reconcile restores every expired shift that the checker agrees has ended
+func (r *ExpiryReconciler) reconcile(ctx context.Context) {
+	now := time.Now()
+	if r.now != nil {
+		now = r.now()
+	}
+
+	for _, shift := range store.ActiveShifts() {
+		if shift.ExpiresAt == nil || shift.ExpiresAt.After(now) {
+			continue
+		}
+		if r.Checker != nil && shift.Source != manualEventSource {
+			active, err := r.Checker.ShiftActive(ctx, shift)
+			if err != nil {
+				slog.Warn("Failed to confirm shift has ended, will retry", "shift_id", shift.ID, "zone_id", shift.ZoneID, "error", err)
+				continue
+			}
+			if active {
+				recheck := now.Add(r.Recheck)
+				slog.Info("Shift expired but is still active", "shift_id", shift.ID, "zone_id", shift.ZoneID, "recheck_at", recheck)
+				store.ExtendShift(shift.ID, recheck)
+				continue
+			}
+		}
+
+		slog.Info("Shift expired, restoring", "shift_id", shift.ID, "zone_id", shift.ZoneID, "expired_at", *shift.ExpiresAt)
+		// The zone is restored in the region the shift was started in
+		region := shift.Region
+		if region == "" {
+			region = appConfig.Region
+		}
+		event := Event{
+			Version:    "0",
+			ID:         newShiftID(),
+			DetailType: shiftExpired,
+			Source:     expiryEventSource,
+			Time:       now.UTC().Format(time.RFC3339),
+			Region:     region,
+			Detail:     Detail{Metadata: Metadata{AwayFrom: shift.ZoneID, Notes: "shift " + shift.ID + " expired", ShiftType: shiftTypeOf(shift)}},
+		}
+		if _, err := updateKarpenterNodePool(ctx, event); err != nil {
+			slog.Error("Failed to restore shift, will retry", "shift_id", shift.ID, "zone_id", shift.ZoneID, "error", err)
+		}
+	}
+}
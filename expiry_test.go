@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/arczonalshift"
+	arctypes "github.com/aws/aws-sdk-go-v2/service/arczonalshift/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeARCClient serves canned ARC list responses
+type fakeARCClient struct {
+	autoshiftsAwayFrom  []string
+	zonalShiftsAwayFrom []string
+	err                 error
+}
+
+func (f *fakeARCClient) ListAutoshifts(ctx context.Context, params *arczonalshift.ListAutoshiftsInput, optFns ...func(*arczonalshift.Options)) (*arczonalshift.ListAutoshiftsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &arczonalshift.ListAutoshiftsOutput{}
+	for _, zone := range f.autoshiftsAwayFrom {
+		out.Items = append(out.Items, arctypes.AutoshiftSummary{AwayFrom: aws.String(zone), Status: arctypes.AutoshiftExecutionStatusActive})
+	}
+	return out, nil
+}
+
+func (f *fakeARCClient) ListZonalShifts(ctx context.Context, params *arczonalshift.ListZonalShiftsInput, optFns ...func(*arczonalshift.Options)) (*arczonalshift.ListZonalShiftsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &arczonalshift.ListZonalShiftsOutput{}
+	for _, zone := range f.zonalShiftsAwayFrom {
+		out.Items = append(out.Items, arctypes.ZonalShiftSummary{AwayFrom: aws.String(zone), Status: arctypes.ZonalShiftStatusActive})
+	}
+	return out, nil
+}
+
+// testARCChecker is an ARC status checker answering from client in every region
+func testARCChecker(client arcClient) *arcStatusChecker {
+	return &arcStatusChecker{newClient: func(ctx context.Context, region string) (arcClient, error) { return client, nil }}
+}
+
+func TestARCStatusChecker(t *testing.T) {
+	ctx := context.Background()
+	shift := Shift{ZoneID: "use1-az1"}
+
+	active, err := testARCChecker(&fakeARCClient{autoshiftsAwayFrom: []string{"use1-az1"}}).ShiftActive(ctx, shift)
+	require.NoError(t, err)
+	assert.True(t, active)
+
+	active, err = testARCChecker(&fakeARCClient{zonalShiftsAwayFrom: []string{"use1-az1"}}).ShiftActive(ctx, shift)
+	require.NoError(t, err)
+	assert.True(t, active)
+
+	active, err = testARCChecker(&fakeARCClient{autoshiftsAwayFrom: []string{"use1-az2"}}).ShiftActive(ctx, shift)
+	require.NoError(t, err)
+	assert.False(t, active)
+
+	_, err = testARCChecker(&fakeARCClient{err: errors.New("throttled")}).ShiftActive(ctx, shift)
+	assert.Error(t, err)
+}
+
+func TestExpiryReconcilerRestoresExpiredShift(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.Shifts.DefaultTTL.Duration = time.Hour })
+
+	_, err := updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	shifts := store.ActiveShifts()
+	require.Len(t, shifts, 1)
+	require.NotNil(t, shifts[0].ExpiresAt)
+	expiresAt := *shifts[0].ExpiresAt
+
+	arc := &fakeARCClient{autoshiftsAwayFrom: []string{"use1-az1"}}
+	checker := testARCChecker(arc)
+	reconciler := &ExpiryReconciler{Recheck: time.Minute, Checker: checker, now: func() time.Time { return expiresAt.Add(-time.Second) }}
+
+	// Not yet expired
+	reconciler.reconcile(context.Background())
+	assert.Len(t, store.ActiveShifts(), 1)
+
+	// Expired, but ARC says it is still under way
+	reconciler.now = func() time.Time { return expiresAt.Add(time.Second) }
+	reconciler.reconcile(context.Background())
+	shifts = store.ActiveShifts()
+	require.Len(t, shifts, 1)
+	assert.Equal(t, expiresAt.Add(time.Second+time.Minute), *shifts[0].ExpiresAt)
+
+	// ARC agrees it has ended
+	*arc = fakeARCClient{}
+	reconciler.now = func() time.Time { return expiresAt.Add(2 * time.Minute) }
+	reconciler.reconcile(context.Background())
+	assert.Empty(t, store.ActiveShifts())
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+	assert.Equal(t, shiftExpired, store.RecentEvents()[0].DetailType)
+}
+
+// regionZoneResolver records the regions zones are looked up in
+type regionZoneResolver struct {
+	fakeZoneResolver
+	regions []string
+}
+
+func (r *regionZoneResolver) Zones(ctx context.Context, region string) ([]AvailabilityZone, error) {
+	r.regions = append(r.regions, region)
+	return r.fakeZoneResolver, nil
+}
+
+func TestExpiryUsesShiftRegion(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.Region = "us-east-1" })
+	resolver := &regionZoneResolver{fakeZoneResolver: testZones}
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, resolver))
+
+	expiresAt := time.Now().Add(-time.Minute)
+	store.StartShift(Shift{ID: "eu", ZoneID: "use1-az1", Region: "eu-west-1", Source: "aws.arc", StartedAt: expiresAt.Add(-time.Hour), ExpiresAt: &expiresAt})
+	var checked []string
+	checker := &arcStatusChecker{region: "us-east-1", newClient: func(ctx context.Context, region string) (arcClient, error) {
+		checked = append(checked, region)
+		return &fakeARCClient{}, nil
+	}}
+	(&ExpiryReconciler{Checker: checker}).reconcile(context.Background())
+
+	assert.Equal(t, []string{"eu-west-1"}, checked)
+	assert.Equal(t, []string{"eu-west-1"}, slices.Compact(resolver.regions))
+	assert.Empty(t, store.ActiveShifts())
+
+	// Clients are kept per region, and shifts without one use the default
+	_, err := checker.ShiftActive(context.Background(), Shift{ZoneID: "use1-az1", Region: "eu-west-1"})
+	require.NoError(t, err)
+	_, err = checker.ShiftActive(context.Background(), Shift{ZoneID: "use1-az1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eu-west-1", "us-east-1"}, checked)
+}
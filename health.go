@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// readinessTimeout bounds how long /readyz waits for all checks together
+	readinessTimeout = 5 * time.Second
+
+	// defaultQueueStallThreshold is how long an event may wait in the queue
+	// before the leader reports the queue as wedged
+	defaultQueueStallThreshold = 5 * time.Minute
+)
+
+// readinessCheck is one dependency /readyz reports on
+type readinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a readinessCheck as reported by /readyz
+type checkResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// readinessChecks are run by /readyz; serve fills them in for the cluster it runs in
+var readinessChecks []readinessCheck
+
+// newReadinessChecks checks the Kubernetes client, the Karpenter NodePool API,
+// AWS credentials and the event queue
+func newReadinessChecks(ctx context.Context, k8sConfig *rest.Config) []readinessCheck {
+	var discoveryClient discovery.DiscoveryInterface
+	var k8sErr error
+	if k8sConfig == nil {
+		k8sErr = errors.New("not running in a cluster")
+	} else if discoveryClient, k8sErr = discovery.NewDiscoveryClientForConfig(k8sConfig); k8sErr != nil {
+		k8sErr = fmt.Errorf("failed to create discovery client: %v", k8sErr)
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region := appConfig.Region; region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	var credentials aws.CredentialsProvider
+	awsCfg, awsErr := config.LoadDefaultConfig(ctx, opts...)
+	if awsErr == nil {
+		credentials = awsCfg.Credentials
+	}
+
+	return []readinessCheck{
+		{Name: "kubernetes", Check: func(ctx context.Context) error { return k8sErr }},
+		{Name: "nodepool-api", Check: func(ctx context.Context) error {
+			if k8sErr != nil {
+				return k8sErr
+			}
+			return checkNodePoolAPI(discoveryClient)
+		}},
+		{Name: "aws-credentials", Check: func(ctx context.Context) error {
+			if awsErr != nil {
+				return fmt.Errorf("failed to load AWS config: %v", awsErr)
+			}
+			return checkAWSCredentials(ctx, credentials)
+		}},
+		{Name: "event-queue", Check: func(ctx context.Context) error {
+			return checkEventQueue(ctx, eventQueue, appConfig.Queue.StallThreshold.Duration, time.Now())
+		}},
+	}
+}
+
+// checkNodePoolAPI confirms the API server serves Karpenter NodePools
+func checkNodePoolAPI(client discovery.DiscoveryInterface) error {
+	groupVersion := nodePoolGVR.GroupVersion().String()
+	resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s: %v", groupVersion, err)
+	}
+	if !slices.ContainsFunc(resources.APIResources, func(r metav1.APIResource) bool { return r.Name == nodePoolGVR.Resource }) {
+		return fmt.Errorf("%s does not serve %s", groupVersion, nodePoolGVR.Resource)
+	}
+	return nil
+}
+
+// checkAWSCredentials confirms the AWS credential chain yields usable credentials
+func checkAWSCredentials(ctx context.Context, provider aws.CredentialsProvider) error {
+	if provider == nil {
+		return errors.New("no AWS credentials provider configured")
+	}
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve AWS credentials: %v", err)
+	}
+	if creds.Expired() {
+		return errors.New("AWS credentials have expired")
+	}
+	return nil
+}
+
+// checkEventQueue reports the queue as wedged when this replica leads and an
+// event has waited longer than threshold. Followers only enqueue, so they stay
+// ready and keep accepting events while the leader is stuck.
+func checkEventQueue(ctx context.Context, queue EventQueue, threshold time.Duration, now time.Time) error {
+	pending, err := queue.Pending(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read queued events: %v", err)
+	}
+	if !leading.Load() || len(pending) == 0 {
+		return nil
+	}
+	if waited := now.Sub(pending[0].EnqueuedAt); waited > threshold {
+		return fmt.Errorf("event %s has been queued for %s", pending[0].Event.ID, waited.Round(time.Second))
+	}
+	return nil
+}
+
+// handleHealthz reports that the process is alive
+func handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz runs every readiness check and reports each result, failing if
+// any check fails or the server is shutting down
+func handleReadyz(c *gin.Context) {
+	if shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	status, ready := http.StatusOK, "ok"
+	results := make([]checkResult, 0, len(readinessChecks))
+	for _, check := range readinessChecks {
+		start := time.Now()
+		err := check.Check(ctx)
+		result := checkResult{Name: check.Name, OK: err == nil, Duration: time.Since(start).Round(time.Millisecond).String()}
+		if err != nil {
+			result.Error = err.Error()
+			status, ready = http.StatusServiceUnavailable, "unavailable"
+		}
+		results = append(results, result)
+	}
+	c.JSON(status, gin.H{"status": ready, "checks": results})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestReadinessChecks(t *testing.T) {
+	discovery := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{}}
+	assert.Error(t, checkNodePoolAPI(discovery))
+	discovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "karpenter.sh/v1",
+		APIResources: []metav1.APIResource{{Name: "nodepools"}, {Name: "nodeclaims"}},
+	}}
+	assert.NoError(t, checkNodePoolAPI(discovery))
+
+	ctx := context.Background()
+	assert.NoError(t, checkAWSCredentials(ctx, aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	})))
+	assert.Error(t, checkAWSCredentials(ctx, aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, errors.New("no EC2 IMDS role found")
+	})))
+
+	originalLeading := leading.Load()
+	t.Cleanup(func() { leading.Store(originalLeading) })
+	queue := newMemoryQueue()
+	require.NoError(t, queue.Enqueue(ctx, Event{ID: "stuck"}))
+	later := time.Now().Add(time.Hour)
+
+	leading.Store(false)
+	assert.NoError(t, checkEventQueue(ctx, queue, time.Minute, later))
+	leading.Store(true)
+	assert.NoError(t, checkEventQueue(ctx, queue, time.Minute, time.Now()))
+	assert.ErrorContains(t, checkEventQueue(ctx, queue, time.Minute, later), "stuck")
+}
+
+func TestReadyzReportsEachCheck(t *testing.T) {
+	original := readinessChecks
+	t.Cleanup(func() { readinessChecks = original })
+
+	var awsErr error
+	readinessChecks = []readinessCheck{
+		{Name: "kubernetes", Check: func(ctx context.Context) error { return nil }},
+		{Name: "aws-credentials", Check: func(ctx context.Context) error { return awsErr }},
+	}
+
+	readyz := func() (int, struct {
+		Status string
+		Checks []checkResult
+	}) {
+		req, err := http.NewRequest("GET", "/readyz", nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		var body struct {
+			Status string
+			Checks []checkResult
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return rr.Code, body
+	}
+
+	code, body := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body.Status)
+	assert.Len(t, body.Checks, 2)
+
+	awsErr = errors.New("failed to retrieve AWS credentials")
+	code, body = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", body.Status)
+	assert.True(t, body.Checks[0].OK)
+	assert.False(t, body.Checks[1].OK)
+	assert.Equal(t, "failed to retrieve AWS credentials", body.Checks[1].Error)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// leaseName is the Lease the replicas compete for
+	leaseName = "zonal-shift"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leading reports whether this replica may mutate NodePools. Without leader
+// election the only replica always leads.
+var leading atomic.Bool
+
+// runControllers does the work only one replica may do at a time: draining the
+// event queue, expiring shifts and reconciling NodePools. It starts once
+// policySynced is closed, so nothing is done under a policy not yet read, and
+// returns when ctx is done.
+func runControllers(ctx context.Context, k8sConfig *rest.Config, policySynced <-chan struct{}) {
+	select {
+	case <-policySynced:
+	case <-ctx.Done():
+		return
+	}
+	if err := store.Load(ctx); err != nil {
+		slog.Error("Failed to load active shifts", "error", err)
+	}
+
+	go runEventWorker(ctx, eventQueue, appConfig.Queue.PollInterval.Duration)
+	go newExpiryReconcilerFromConfig().Run(ctx)
+	if k8sConfig != nil {
+		go func() {
+			if err := runNodePoolReconciler(ctx, k8sConfig); err != nil {
+				slog.Error("Node pool reconciler failed", "error", err)
+			}
+		}()
+	}
+	<-ctx.Done()
+}
+
+// runLeaderElection competes for the Lease and runs the controllers while this
+// replica holds it. Followers keep their view of active shifts up to date so
+// the admin API answers the same on every replica.
+func runLeaderElection(ctx context.Context, k8sConfig *rest.Config, policySynced <-chan struct{}) error {
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create clientset: %v", err)
+	}
+	identity := replicaIdentity()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: podNamespace()},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	go followShifts(ctx, appConfig.Queue.PollInterval.Duration)
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					slog.Info("Started leading", "identity", identity)
+					leading.Store(true)
+					runControllers(ctx, k8sConfig, policySynced)
+				},
+				OnStoppedLeading: func() {
+					slog.Info("Stopped leading", "identity", identity)
+					leading.Store(false)
+				},
+				OnNewLeader: func(current string) {
+					if current != identity {
+						slog.Info("New leader elected", "leader", current)
+					}
+				},
+			},
+		})
+	}
+	return nil
+}
+
+// replicaIdentity names this replica in the Lease and in audit records
+func replicaIdentity() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// followShifts reloads active shifts from the backend while this replica is not leading
+func followShifts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if leading.Load() {
+				continue
+			}
+			if err := store.Load(ctx); err != nil {
+				slog.Warn("Failed to load active shifts", "error", err)
+			}
+		}
+	}
+}
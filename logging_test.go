@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupLoggingWritesJSON(t *testing.T) {
+	original := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	path := filepath.Join(t.TempDir(), "zonal-shift.log")
+	require.NoError(t, setupLogging(logConfig{Level: "warn", Format: "json", Output: path}))
+
+	slog.Info("dropped below the level")
+	slog.Warn("Refusing to remove zone from node pool", "nodepool", "default", "zone_id", "use1-az1")
+
+	req, err := http.NewRequest("GET", "/api/v1/shifts", nil)
+	require.NoError(t, err)
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "default", record["nodepool"])
+	assert.Equal(t, "use1-az1", record["zone_id"])
+
+	assert.Error(t, setupLogging(logConfig{Level: "loud"}))
+	assert.Error(t, setupLogging(logConfig{Level: "info", Format: "xml"}))
+}
+
+func TestGinWritesThroughSlog(t *testing.T) {
+	original, originalMode := slog.Default(), gin.Mode()
+	originalOut, originalErr := gin.DefaultWriter, gin.DefaultErrorWriter
+	t.Cleanup(func() {
+		slog.SetDefault(original)
+		gin.SetMode(originalMode)
+		gin.DefaultWriter, gin.DefaultErrorWriter = originalOut, originalErr
+	})
+
+	path := filepath.Join(t.TempDir(), "zonal-shift.log")
+	require.NoError(t, setupLogging(logConfig{Level: "info", Format: "json", Output: path}))
+	assert.Equal(t, gin.ReleaseMode, gin.Mode())
+	fmt.Fprintln(gin.DefaultErrorWriter, "[GIN] something went wrong")
+	fmt.Fprintln(gin.DefaultWriter, "[GIN] below the level")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "ERROR", record["level"])
+	assert.Equal(t, "something went wrong", record["msg"])
+	assert.Equal(t, "gin", record["component"])
+}
+
+func TestRequestLoggerUsesSlog(t *testing.T) {
+	original := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(original) })
+
+	path := filepath.Join(t.TempDir(), "zonal-shift.log")
+	require.NoError(t, setupLogging(logConfig{Level: "info", Format: "json", Output: path}))
+
+	useAdminToken(t)
+	req, err := http.NewRequest("GET", "/api/v1/shifts", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(data))), &record))
+	assert.Equal(t, "HTTP request", record["msg"])
+	assert.Equal(t, "/api/v1/shifts", record["path"])
+	assert.Equal(t, float64(http.StatusOK), record["status"])
+}
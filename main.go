@@ -4,16 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
 	"net/http"
 	"os"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-
+	"k8s.io/client-go/tools/record"
 )
 
 // SNSMessage represents the structure of an SNS notification
@@ -23,6 +30,8 @@ type SNSMessage struct {
 	TopicArn         string `json:"TopicArn"`
 	Message          string `json:"Message"`
 	SubscribeURL     string `json:"SubscribeURL"`
+	Token            string `json:"Token"`
+	Subject          string `json:"Subject,omitempty"`
 	Timestamp        string `json:"Timestamp"`
 	SignatureVersion string `json:"SignatureVersion"`
 	Signature        string `json:"Signature"`
@@ -41,395 +50,570 @@ type Event struct {
 	Detail     Detail   `json:"detail"`
 }
 
-type Detail struct {
-	Version  string   `json:"version"`
-	Data     string   `json:"data"`
-	Metadata Metadata `json:"metadata"`
+// validateEvent rejects events that are missing the fields needed to act on them
+func validateEvent(event Event) error {
+	if event.Version == "" {
+		return errors.New("event is missing version")
+	}
+	if event.Detail.Metadata.AwayFrom == "" {
+		return errors.New("event is missing detail.metadata.awayFrom")
+	}
+	return nil
+}
+
+// isShiftEnd reports whether the event signals that a shift has finished and
+// the zone should be given back to the node pools
+func isShiftEnd(event Event) bool {
+	if isPracticeRunEnd(event) {
+		return true
+	}
+	detailType := strings.ToLower(event.DetailType)
+	for _, suffix := range []string{"completed", "cancelled", "canceled", "ended", "expired"} {
+		if strings.HasSuffix(detailType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newRouter creates the gin router serving the SNS endpoint, the admin API, the probes and metrics
+func newRouter() *gin.Engine {
+	router := newEventRouter()
+	registerProbeRoutes(router)
+	return router
 }
 
-type Metadata struct {
-	AwayFrom string `json:"awayFrom"`
-	Notes    string `json:"notes"`
+// newEventRouter creates the gin router serving the SNS and CloudEvents endpoints and the admin API
+func newEventRouter() *gin.Engine {
+	// Creates a gin router that logs requests through slog and recovers from panics
+	router := gin.New()
+	router.Use(requestLogger(), gin.Recovery())
+
+	// Register your handler
+	router.POST("/sns", handleSNS)
+	router.POST("/events", handleCloudEvent)
+	registerAdminRoutes(router.Group("/api/v1"))
+
+	return router
 }
 
-// NodePool represents the structure of a Karpenter NodePool
-type NodePool struct {
-    APIVersion string `json:"apiVersion"`
-    Kind       string `json:"kind"`
-    Metadata   struct {
-        Name      string            `json:"name"`
-        Namespace string            `json:"namespace"`
-        Labels    map[string]string `json:"labels,omitempty"`
-    } `json:"metadata"`
-    Spec struct {
-        Template struct {
-            Spec struct {
-                Requirements []struct {
-                    Key      string   `json:"key"`
-                    Operator string   `json:"operator"`
-                    Values   []string `json:"values"`
-                } `json:"requirements"`
-                NodeClassRef struct {
-                    Name string `json:"name"`
-					Kind string `json:"kind"`
-					Group string `json:"group"`
-                } `json:"nodeClassRef"`
-            } `json:"spec"`
-        } `json:"template"`
-        Limits struct {
-            CPU    string `json:"cpu,omitempty"`
-            Memory string `json:"memory,omitempty"`
-        } `json:"limits,omitempty"`
-    } `json:"spec"`
+// newProbeRouter creates the gin router serving only the probes and metrics
+func newProbeRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	registerProbeRoutes(router)
+	return router
 }
 
+func registerProbeRoutes(router *gin.Engine) {
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/healthz", handleHealthz)
+	router.GET("/readyz", handleReadyz)
+}
 
-func init() {
-	// Open log file
-	logFile, err := os.OpenFile("/var/log/zonal-shift.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// serve runs the HTTP server that receives zonal shift events
+func serve(args []string) error {
+	c, err := loadConfig(args)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		return err
+	}
+	applyConfig(c)
+	if err := setupLogging(c.Log); err != nil {
+		return err
 	}
+	slog.Info("Loaded configuration", "config", c.redacted())
 
-	// Configure logger to write to file
-	log.SetOutput(logFile)
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-}
+	// The controllers get their own context, so they keep running while a
+	// signalled server drains its queue
+	ctx, stopControllers := context.WithCancel(context.Background())
+	defer stopControllers()
+	var controllers sync.WaitGroup
+	k8sConfig, err := rest.InClusterConfig()
+	if err != nil {
+		slog.Warn("Not running in a cluster, node pool reconciler disabled", "error", err)
+		k8sConfig = nil
+	}
+	if err := setupStateBackend(k8sConfig); err != nil {
+		return err
+	}
+	if err := restoreCheckpoint(ctx, c.CheckpointFile); err != nil {
+		return err
+	}
+	readinessChecks = newReadinessChecks(ctx, k8sConfig)
+	n, err := newNotifierFromConfig(ctx)
+	if err != nil {
+		return err
+	}
+	notifier.Store(n)
+	var clientset kubernetes.Interface
+	if k8sConfig != nil {
+		if eventRecorder, err = newEventRecorder(k8sConfig); err != nil {
+			return err
+		}
+		if clientset, err = kubernetes.NewForConfig(k8sConfig); err != nil {
+			return fmt.Errorf("failed to create clientset: %v", err)
+		}
+	}
+	if auditLog, err = newAuditLogFromConfig(clientset); err != nil {
+		return err
+	}
+	if window := c.SNSSilenceWindow.Duration; window > 0 {
+		go runSubscriptionWatcher(ctx, window)
+	}
+	// The controllers wait for the policy to be read before acting on anything
+	policySynced := make(chan struct{})
+	if k8sConfig != nil {
+		go func() {
+			if err := runPolicyWatcher(ctx, k8sConfig, policySynced); err != nil {
+				slog.Error("ZonalShiftPolicy watcher failed", "error", err)
+			}
+		}()
+	} else {
+		close(policySynced)
+	}
+	if c.LeaderElection {
+		if k8sConfig == nil {
+			return errors.New("leader election requires running in a cluster")
+		}
+		controllers.Add(1)
+		go func() {
+			defer controllers.Done()
+			if err := runLeaderElection(ctx, k8sConfig, policySynced); err != nil {
+				slog.Error("Leader election failed", "error", err)
+			}
+		}()
+	} else {
+		leading.Store(true)
+		controllers.Add(1)
+		go func() {
+			defer controllers.Done()
+			runControllers(ctx, k8sConfig, policySynced)
+		}()
+	}
 
-func main() {
-	// Creates a gin router with default middleware (logger and recovery)
-	router := gin.Default()
+	router := newRouter()
+	if c.ProbeAddress != "" {
+		router = newEventRouter()
+	}
+	server := newHTTPServer(c, c.ListenAddress, router)
+	if c.TLS.CertFile != "" {
+		reloader, err := newTLSReloader(c.TLS)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = reloader.serverConfig()
+	}
 
-	// Register your handler
-	router.POST("/sns", handleSNS)
+	// Start the servers
+	serverErr := make(chan error, 2)
+	go func() {
+		slog.Info("Listening", "address", c.ListenAddress, "tls", c.TLS.CertFile != "", "client_auth", c.TLS.ClientAuth)
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	var probeServer *http.Server
+	if c.ProbeAddress != "" {
+		probeServer = newHTTPServer(c, c.ProbeAddress, newProbeRouter())
+		go func() {
+			slog.Info("Serving probes and metrics", "address", c.ProbeAddress)
+			serverErr <- probeServer.ListenAndServe()
+		}()
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("failed to start server: %v", err)
+	case <-signals.Done():
+	}
+	// A second signal stops the process at once
+	stopSignals()
+	slog.Info("Shutting down", "timeout", c.ShutdownTimeout.Duration)
+	err = shutdown(server, stopControllers, &controllers, c.ShutdownTimeout.Duration)
+	// The probes keep answering, reporting not ready, until everything else has stopped
+	if probeServer != nil {
+		probeServer.Close()
 	}
+	return err
+}
 
-	// Start the server
-	if err := router.Run(":" + port); err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
-		os.Exit(1)
+// newHTTPServer creates a server for handler on address with the configured timeouts
+func newHTTPServer(c *Config, address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: c.Timeouts.ReadHeader.Duration,
+		ReadTimeout:       c.Timeouts.Read.Duration,
+		WriteTimeout:      c.Timeouts.Write.Duration,
+		IdleTimeout:       c.Timeouts.Idle.Duration,
 	}
 }
-func handleSNS(c *gin.Context) {
-	log.Println("[handleSNS] Request received")
 
+func handleSNS(c *gin.Context) {
 	// Read the raw body
 	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("[handleSNS] Error reading body: %v", err)
+		slog.Warn("Failed to read request body", "error", err)
 		c.String(http.StatusBadRequest, "Error reading request")
 		return
 	}
 
-	log.Printf("[handleSNS] Raw body received: %s", string(body))
+	slog.Debug("Raw body received", "body", string(body))
 
 	// First try to parse as SNS message
 	var snsMessage SNSMessage
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&snsMessage); err != nil {
-		log.Printf("[handleSNS] Not an SNS message, trying direct event format: %v", err)
+		slog.Debug("Not an SNS message, trying direct event format", "error", err)
 	} else if snsMessage.Type != "" {
-		// Handle SNS message
-		if snsMessage.Type == "SubscriptionConfirmation" {
-			log.Println("[handleSNS] Processing subscription confirmation")
-			resp, err := http.Get(snsMessage.SubscribeURL)
+		logger := slog.With("message_id", snsMessage.MessageId, "topic_arn", snsMessage.TopicArn)
+		if snsMessageTypeLabel(snsMessage.Type) == "unsupported" {
+			logger.Warn("Unsupported SNS message type", "type", snsMessage.Type)
+			snsMessagesTotal.WithLabelValues("unsupported").Inc()
+			c.String(http.StatusBadRequest, "Unsupported SNS message type")
+			return
+		}
+		// Nothing in the message is trusted, or recorded, before its signature is checked
+		if err := snsSignatures.verify(c.Request.Context(), snsMessage); err != nil {
+			logger.Warn("Rejected SNS message without a valid signature", "client_ip", c.ClientIP(), "error", err)
+			c.String(http.StatusForbidden, "Invalid signature")
+			return
+		}
+		if topics := appConfig.AllowedTopics; len(topics) > 0 && !slices.Contains(topics, snsMessage.TopicArn) {
+			logger.Warn("Rejected message from a topic that is not allowed")
+			c.String(http.StatusForbidden, "Topic not allowed")
+			return
+		}
+		subscriptions.received(snsMessage.TopicArn, time.Now())
+		snsMessagesTotal.WithLabelValues(snsMessageTypeLabel(snsMessage.Type)).Inc()
+		switch snsMessage.Type {
+		case snsSubscriptionConfirmation:
+			logger.Info("Processing subscription confirmation")
+			err := confirmSubscription(c.Request.Context(), snsMessage)
+			snsConfirmationsTotal.WithLabelValues(resultLabel(err)).Inc()
+			if errors.Is(err, errConfirmationRefused) {
+				logger.Warn("Refused subscription confirmation", "error", err)
+				c.String(http.StatusForbidden, "Subscription confirmation refused")
+				return
+			}
 			if err != nil {
-				log.Printf("[handleSNS] Subscription confirmation failed: %v", err)
+				logger.Error("Subscription confirmation failed", "error", err)
 				c.String(http.StatusInternalServerError, "Failed to confirm subscription")
 				return
 			}
-			defer resp.Body.Close()
-			log.Println("[handleSNS] Subscription confirmed successfully")
+			subscriptions.confirmed(snsMessage.TopicArn, time.Now())
+			logger.Info("Subscription confirmed")
 			c.Status(http.StatusOK)
 			return
-		}
 
-		if snsMessage.Type == "Notification" {
-			log.Println("[handleSNS] Processing SNS notification")
-			var event Event
-			if err := json.Unmarshal([]byte(snsMessage.Message), &event); err != nil {
-				log.Printf("[handleSNS] Failed to parse event from SNS message: %v", err)
+		case snsUnsubscribeConfirmation:
+			// The subscription is already gone; resubscribing is left to whoever removed it
+			subscriptions.unsubscribed(snsMessage.TopicArn, time.Now())
+			logger.Warn("Subscription removed, no more events will arrive from this topic")
+			notifier.Load().Notify(Notification{Kind: notifySubscriptionRemoved, TopicArn: snsMessage.TopicArn, Time: time.Now()})
+			c.Status(http.StatusOK)
+			return
+
+		case snsNotification:
+			logger.Info("Processing SNS notification")
+			event, skip, err := decodeEvent([]byte(snsMessage.Message))
+			if err != nil {
+				logger.Warn("Failed to parse event from SNS message", "error", err)
 				c.String(http.StatusBadRequest, "Invalid event format in SNS message")
 				return
 			}
-			handleEvent(event)
+			if skip != "" {
+				logger.Info("Skipping event", "event_id", event.ID, "reason", skip)
+				c.Status(http.StatusOK)
+				return
+			}
+			if isHeartbeat(event) {
+				logger.Debug("Received heartbeat", "event_id", event.ID)
+				c.Status(http.StatusOK)
+				return
+			}
+			if err := validateEvent(event); err != nil {
+				logger.Warn("Invalid event in SNS message", "event_id", event.ID, "error", err)
+				c.String(http.StatusBadRequest, "Invalid event in SNS message")
+				return
+			}
+			if err := handleEvent(c.Request.Context(), event); err != nil {
+				c.String(http.StatusServiceUnavailable, "Failed to queue event")
+				return
+			}
 			c.Status(http.StatusOK)
 			return
 		}
 	}
 
-	// Try parsing as direct EventBridge event
-	var event Event
-	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&event); err != nil {
-		log.Printf("[handleSNS] Failed to parse as direct event: %v", err)
+	// Try parsing as direct EventBridge event, once the caller is known
+	principal, err := authenticateDirectEvent(c.Request, body, time.Now())
+	if err != nil {
+		slog.Warn("Rejected unauthenticated direct event", "client_ip", c.ClientIP(), "error", err)
+		c.String(http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	event, skip, err := decodeEvent(body)
+	if err != nil {
+		slog.Warn("Failed to parse as direct event", "error", err)
 		c.String(http.StatusBadRequest, "Invalid message format")
 		return
 	}
+	if skip != "" {
+		slog.Info("Skipping direct event", "event_id", event.ID, "reason", skip)
+		c.Status(http.StatusOK)
+		return
+	}
+	if err := validateEvent(event); err != nil {
+		slog.Warn("Invalid direct event", "event_id", event.ID, "error", err)
+		c.String(http.StatusBadRequest, "Invalid event")
+		return
+	}
 
-	log.Printf("[handleSNS] Direct event received - ID: %s, Type: %s, AZ: %s",
-		event.ID,
-		event.DetailType,
-		event.Detail.Metadata.AwayFrom)
+	slog.Info("Direct event received", "event_id", event.ID, "detail_type", event.DetailType, "zone_id", event.Detail.Metadata.AwayFrom)
 
-	handleEvent(event)
+	if err := handleEvent(withPrincipal(c.Request.Context(), principal), event); err != nil {
+		c.String(http.StatusServiceUnavailable, "Failed to queue event")
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
-// handleEvent processes the event regardless of how it was received
-func handleEvent(event Event) {
-	go func() {
-		log.Println("[handleSNS] Starting updateKarpenterNodePool")
-		updateKarpenterNodePool(event)
-		log.Println("[handleSNS] Completed updateKarpenterNodePool")
-	}()
-}
-
-// CreateNodePool creates a new Karpenter NodePool
-func CreateNodePool(ctx context.Context, namespace string,nodepoolName string, nodePoolSpec []byte) error {
-    k8sConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Printf("[CreateNodePool] Failed to create cluster config: %v", err)
-		return fmt.Errorf("failed to create cluster config: %v", err)
+// handleEvent queues the event for processing regardless of how it was received
+func handleEvent(ctx context.Context, event Event) error {
+	if shuttingDown.Load() {
+		slog.Warn("Refusing event while shutting down", "event_id", event.ID)
+		return errShuttingDown
 	}
-	
-	clientset, err := kubernetes.NewForConfig(k8sConfig)
-	if err != nil {
-		log.Printf("[CreateNodePool] Failed to create clientset: %v", err)
-		return fmt.Errorf("Failed to create clientset")
+	if event.ID == "" {
+		event.ID = newShiftID()
 	}
-	
-	
-	resp, err := clientset.RESTClient().Post().AbsPath("/apis/karpenter.sh/v1/nodepools").Body(nodePoolSpec).DoRaw(context.TODO())
-	if err != nil {
-		log.Printf("[CreateNodePool] Failed to CreateNodePool node pools: %v", err)
-		return fmt.Errorf("Failed to update node pools")
+	if err := eventQueue.Enqueue(ctx, event); err != nil {
+		slog.Error("Failed to queue event", "event_id", event.ID, "error", err)
+		return err
 	}
-	log.Printf("[CreateNodePool] Succesfully created node pools: %v", nodepoolName)
-	resp_json, err := json.Marshal(resp)
-	log.Printf("[CreateNodePool] Response: %v", resp_json)
-
+	slog.Info("Queued event", "event_id", event.ID, "detail_type", event.DetailType, "zone_id", event.Detail.Metadata.AwayFrom)
+	notifyWorker()
 	return nil
 }
 
+// eventRecorder records Kubernetes Events for the server; serve sets it when running in a cluster
+var eventRecorder record.EventRecorder
 
-// Create a function to identity the updated Availability zones after ignoring the AwayFrom zone. 
-func getUpdatedZones(event Event) ([]string) {
-	region := event.Region
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(region),
-	)
-	if err != nil {
-		log.Printf("Failed to load AWS config: %v", err)
-	}
-	ec2Client := ec2.NewFromConfig(awsCfg)
-	//get list of availability zones which are part of the region in event and store it in input variable
-	input := &ec2.DescribeAvailabilityZonesInput{}
-	output, err := ec2Client.DescribeAvailabilityZones(context.TODO(),input)
-	//log.Printf("[updateKarpenterNodePool] Retrieved %d AZs from event", output.AvailabilityZones)
-	log.Printf("[updateKarpenterNodePool] Retrieved %d AZs from event", output.AvailabilityZones)
+// newProcessor builds the Processor used by the server; tests replace it with fakes
+var newProcessor = func() (*Processor, error) {
+	client, err := newDynamicClient(nil)
 	if err != nil {
-		log.Printf("[updateKarpenterNodePool] Failed to describe availability zones: %v", err)
-	}
-	log.Printf("[updateKarpenterNodePool] Retrieved %d AZs from EC2 API", len(output.AvailabilityZones))
-	//
-	var updatedZones []string
-	for _, az := range output.AvailabilityZones {
-		log.Printf("[updateKarpenterNodePool] Checking AZ: ZoneId=%s, ZoneName=%s", *az.ZoneId, *az.ZoneName)
-		if *az.ZoneId != event.Detail.Metadata.AwayFrom {
-			log.Printf("[updateKarpenterNodePool] Including AZ %s in updated zones", *az.ZoneName)
-			updatedZones = append(updatedZones, *az.ZoneName)
-		} else {
-			log.Printf("[updateKarpenterNodePool] Excluding AZ %s as it matches AwayFrom zone", *az.ZoneName)
-		}
+		return nil, err
 	}
-	// Log the updated zones
-	log.Printf("[updateKarpenterNodePool] Updated zones: %v", updatedZones)
-	//return updatedZones to the calling function
-	return updatedZones
+	processor := NewProcessor(client, newEC2ZoneResolver())
+	configureProcessor(processor)
+	processor.Recorder = eventRecorder
+	processor.Audit = auditLog
+	return processor, nil
 }
 
-// updateKarpenterNodePool updates the Karpenter node pool based on the event
-func updateKarpenterNodePool(event Event) {
-	log.Printf("[updateKarpenterNodePool] Processing event for AZ: %s", event.Detail.Metadata.AwayFrom)
+// processingMu makes sure only one event changes NodePools at a time
+var processingMu sync.Mutex
 
-	k8sConfig, err := rest.InClusterConfig()
+// updateKarpenterNodePool updates the Karpenter node pools based on the event
+// and records the outcome in the store
+func updateKarpenterNodePool(ctx context.Context, event Event) (EventRecord, error) {
+	return processReceivedEvent(ctx, event, time.Now())
+}
+
+// processReceivedEvent is updateKarpenterNodePool for an event received at
+// receivedAt, such as one that waited in the queue
+func processReceivedEvent(ctx context.Context, event Event, receivedAt time.Time) (EventRecord, error) {
+	processingMu.Lock()
+	defer processingMu.Unlock()
+
+	// The deadline starts once the event has its turn, not while it waits for the lock
+	timeout := appConfig.EventTimeout.Duration
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	slog.Info("Processing event", "event_id", event.ID, "detail_type", event.DetailType, "zone_id", event.Detail.Metadata.AwayFrom)
+
+	record := EventRecord{
+		ID:         event.ID,
+		DetailType: event.DetailType,
+		Source:     event.Source,
+		ZoneID:     event.Detail.Metadata.AwayFrom,
+		ReceivedAt: receivedAt,
+	}
+	err := processEvent(ctx, event, &record)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %v", timeout, err)
+	}
+	if isPracticeRun(event) && record.Outcome != outcomeIgnored {
+		recordPracticeRun(event, &record, err)
+	}
+	record.CompletedAt = time.Now()
 	if err != nil {
-		log.Printf("[updateKarpenterNodePool] Failed to create cluster config: %v", err)
-		return
+		record.Outcome = outcomeFailed
+		record.Error = err.Error()
+	}
+	store.RecordEvent(record)
+	observeEvent(record)
+	// A failure the queue retries is only notified once the last attempt fails
+	if n, ok := notificationFor(event, record); ok && !(record.Outcome == outcomeFailed && willRetry(ctx)) {
+		notifier.Load().Notify(n)
 	}
+	return record, err
+}
 
-	clientset, err := kubernetes.NewForConfig(k8sConfig)
+// processEvent plans and applies the node pool changes for an event
+func processEvent(ctx context.Context, event Event, record *EventRecord) error {
+	logger := slog.With("event_id", event.ID, "zone_id", event.Detail.Metadata.AwayFrom)
+	processor, err := newProcessor()
 	if err != nil {
-		log.Printf("[updateKarpenterNodePool] Failed to create clientset: %v", err)
-		return
+		logger.Error("Failed to create processor", "error", err)
+		return err
 	}
 
-	log.Println("[updateKarpenterNodePool] Retrieving Karpenter node pools...")
-	nodePools, err := clientset.RESTClient().Get().AbsPath("/apis/karpenter.sh/v1/nodepools").DoRaw(context.TODO())
+	if reason := processor.ignores(event); reason != "" {
+		logger.Info("Ignoring event", "source", event.Source, "reason", reason)
+		record.Outcome, record.Reason = outcomeIgnored, reason
+		return nil
+	}
+	if isPracticeRun(event) {
+		switch appConfig.PracticeRuns {
+		case practiceRunsIgnore:
+			logger.Info("Ignoring practice run", "detail_type", event.DetailType)
+			record.Outcome, record.Reason = outcomeIgnored, "practice runs are ignored"
+			return nil
+		case practiceRunsObserve:
+			return observePracticeRun(ctx, processor, event, record)
+		}
+	}
+	// Shifts are stored by zone ID, whichever way the event names the zone
+	zone, err := processor.ResolveZone(ctx, event.Region, event.Detail.Metadata.AwayFrom)
 	if err != nil {
-		log.Printf("[updateKarpenterNodePool] Failed to get node pools: %v", err)
-		return
+		logger.Error("Failed to resolve zone", "error", err)
+		return err
+	}
+	// A practice run and a real shift for the same zone are kept apart, and
+	// the zone only comes back once neither is active
+	practice := isPracticeShift(event)
+	if isShiftEnd(event) {
+		if other, ok := store.ShiftForZone(zone.ID, !practice); ok {
+			logger.Info("Not restoring the zone, another shift for it is active", "shift_id", other.ID, "practice", other.Practice)
+			if shift, ok := store.EndShift(zone.ID, practice); ok {
+				logger.Info("Shift ended", "shift_id", shift.ID)
+			}
+			record.Outcome, record.Reason = outcomeNoChanges, "shift "+other.ID+" for the zone is still active"
+			return nil
+		}
 	}
 
-	var nodePoolList struct {
-		Items []struct {
-			Metadata struct {
-				Name string `json:"name"`
-			} `json:"metadata"`
-			Spec struct {
-				Template struct {
-					Spec struct {
-						Requirements []struct {
-							Key      string   `json:"key"`
-							Operator string   `json:"operator"`
-							Values   []string `json:"values"`
-						} `json:"requirements"`
-					} `json:"spec"`
-				} `json:"template"`
-			} `json:"spec"`
-		} `json:"items"`
-	}
-
-	if err := json.Unmarshal(nodePools, &nodePoolList); err != nil {
-		log.Printf("[updateKarpenterNodePool] Failed to parse node pools: %v", err)
-		return
+	changes, err := processor.PlanEvent(ctx, event)
+	if err != nil {
+		logger.Error("Failed to plan node pool changes", "error", err)
+		return err
 	}
 
-	log.Printf("[updateKarpenterNodePool] Found %d node pools", len(nodePoolList.Items))
-	// Let's log the raw JSON for debugging
-	rawJSON, _ := json.MarshalIndent(nodePoolList, "", "  ")
-	log.Printf("[updateKarpenterNodePool] Raw node pool list: %s", string(rawJSON))
-
-	// Check if the length of the nodepool is 2 and the nodepool names are "general-purpose" and "system"
-	if len(nodePoolList.Items) == 2 && 
-	   ((nodePoolList.Items[0].Metadata.Name == "general-purpose" && nodePoolList.Items[1].Metadata.Name == "system") ||
-	    (nodePoolList.Items[1].Metadata.Name == "general-purpose" && nodePoolList.Items[0].Metadata.Name == "system")) {
-		log.Println("[updateKarpenterNodePool] Found 2 EKS Auto mode default node pools, creating a new node pool")
-		//create a new node pool zonal-shift-karpenter copying the "general-purpose" nodepool
-		// Create a new NodePool with the correct structure
-		nodePoolItem := NodePool{
-			APIVersion: "karpenter.sh/v1",
-			Kind:       "NodePool",
-			Metadata: struct {
-				Name      string            `json:"name"`
-				Namespace string            `json:"namespace"`
-				Labels    map[string]string `json:"labels,omitempty"`
-			}{
-				Name: "zonal-shift-karpenter",
-				Namespace: "default",
-			},
-		}
-		
-		// Copy over the requirements from the existing nodepool
-		// but don't try to directly assign the Spec which has a different structure
-		
-		// Initialize the template and spec structures
-		nodePoolItem.Spec.Template.Spec.Requirements = make([]struct {
-			Key      string   `json:"key"`
-			Operator string   `json:"operator"`
-			Values   []string `json:"values"`
-		}, 0)
-		
-		// Copy requirements from the existing nodepool
-		for _, req := range nodePoolList.Items[0].Spec.Template.Spec.Requirements {
-			nodePoolItem.Spec.Template.Spec.Requirements = append(
-				nodePoolItem.Spec.Template.Spec.Requirements,
-				struct {
-					Key      string   `json:"key"`
-					Operator string   `json:"operator"`
-					Values   []string `json:"values"`
-				}{
-					Key:      req.Key,
-					Operator: req.Operator,
-					Values:   req.Values,
-				},
-			)
+	var diff bytes.Buffer
+	writeDiff(&diff, changes)
+	logger.Info("Planned node pool changes", "diff", diff.String())
+	if processor.Planned != nil {
+		processor.Planned(changes)
+	}
+
+	applyErr := processor.Apply(ctx, changes)
+	for _, change := range changes {
+		switch {
+		case change.Refused != "":
+			record.Refused = append(record.Refused, change.Name)
+		case change.Error == "":
+			record.NodePools = append(record.NodePools, change.Name)
 		}
-		nodePoolItem.APIVersion = "karpenter.sh/v1"
-		nodePoolItem.Kind = "NodePool"
-		nodePoolItem.Metadata.Name = "zonal-shift-karpenter"
-		
-		// Copy the node class reference from the existing node pool
-		nodePoolItem.Spec.Template.Spec.NodeClassRef.Name = "default"
-		nodePoolItem.Spec.Template.Spec.NodeClassRef.Kind = "NodeClass"
-		nodePoolItem.Spec.Template.Spec.NodeClassRef.Group = "eks.amazonaws.com"
-
-		log.Printf("[updateKarpenterNodePool] Calling function getUpdatedZones to get healthy zones")
-		updatedZones := getUpdatedZones(event)
-		
-		// Update the requirements with the new zones
-		zoneRequirementExists := false
-		for i, req := range nodePoolItem.Spec.Template.Spec.Requirements {
-			if req.Key == "topology.kubernetes.io/zone" {
-				nodePoolItem.Spec.Template.Spec.Requirements[i].Values = updatedZones
-				zoneRequirementExists = true
-				break
+	}
+
+	switch {
+	case len(record.NodePools) > 0 && processor.DryRun:
+		record.Outcome = outcomeDryRun
+	case len(record.NodePools) > 0:
+		record.Outcome = outcomeApplied
+	case len(record.Refused) > 0:
+		record.Outcome = outcomeRefused
+	default:
+		record.Outcome = outcomeNoChanges
+	}
+	// Nothing was changed, so there is no shift to start or end
+	if processor.DryRun {
+		logger.Info("Dry run, not recording the shift", "nodepools", record.NodePools)
+		return applyErr
+	}
+	if isShiftEnd(event) {
+		// A shift that could not be fully restored stays active until a retry finishes it
+		if applyErr != nil {
+			if shift, ok := store.ShiftForZone(zone.ID, practice); ok {
+				recordShiftOutcomes(ctx, shift.ID, changes)
 			}
+			return applyErr
 		}
-		
-		// If no zone requirement exists, add one
-		if !zoneRequirementExists {
-			nodePoolItem.Spec.Template.Spec.Requirements = append(nodePoolItem.Spec.Template.Spec.Requirements, struct {
-				Key      string   `json:"key"`
-				Operator string   `json:"operator"`
-				Values   []string `json:"values"`
-			}{
-				Key:      "topology.kubernetes.io/zone",
-				Operator: "In",
-				Values:   updatedZones,
-			})
-		}
-		
-		// Convert nodePoolItem to JSON
-		newNodePoolJSON, err := json.Marshal(nodePoolItem)
-		if err != nil {
-			log.Printf("[updateKarpenterNodePool] Failed to marshal new node pool: %v", err)
-			return
+		if shift, ok := store.EndShift(zone.ID, practice); ok {
+			logger.Info("Shift ended", "shift_id", shift.ID)
+			recordShiftOutcomes(ctx, shift.ID, changes)
 		}
-		log.Printf("[updateKarpenterNodePool] Creating new node pool: %s", nodePoolItem.Metadata.Name)
-		ctx := context.Background()
-		err = CreateNodePool(ctx, "default", "zonal-shift-karpenter", newNodePoolJSON)
-		} else {
-		for _, pool := range nodePoolList.Items {
-			log.Printf("[updateKarpenterNodePool] Processing node pool: %s", pool.Metadata.Name)
-			log.Printf("[updateKarpenterNodePool] Number of requirements: %d", len(pool.Spec.Template.Spec.Requirements))
-			for i, req := range pool.Spec.Template.Spec.Requirements {
-				log.Printf("[updateKarpenterNodePool] Checking requirement %d: Key=%s", i, req.Key)
-				if req.Key == "topology.kubernetes.io/zone" {
-					log.Printf("[updateKarpenterNodePool] Node pool %s has a zone requirement: %+v", pool.Metadata.Name, req.Values)
-					updatedZones := getUpdatedZones(event)
-					if len(updatedZones) != len(req.Values) {
-						log.Printf("[updateKarpenterNodePool] Zone list changed for node pool %s:", pool.Metadata.Name)
-						log.Printf("[updateKarpenterNodePool] Original zones: %v", req.Values)
-						log.Printf("[updateKarpenterNodePool] Updated zones: %v", updatedZones)
-						log.Printf("[updateKarpenterNodePool] Updating node pool %s to remove AZ %s",
-							pool.Metadata.Name, event.Detail.Metadata.AwayFrom)
-						pool.Spec.Template.Spec.Requirements[i].Values = updatedZones
-						//Update the Nodepool with the updatedzones using clientset
-						pool_json, err := json.Marshal(pool)
-						if err != nil {
-							log.Printf("[updateKarpenterNodePool] Failed to parse Nodepool : %v", err)
-							return (err)
-						}
-						log.Printf("[CreateNodePool] pool_json: %v", pool_json)
-						resp_update, err := clientset.RESTClient().Put().AbsPath("/apis/karpenter.sh/v1/nodepools").Body(pool_json).DoRaw(context.TODO())
-						if err != nil {
-							log.Printf("[updateKarpenterNodePool] Failed to update node pools: %v", err)
-							return (err)
-						}
-						resp_update_json, err := json.Marshal(resp_update)
-						log.Printf("[CreateNodePool] Response: %v", resp_update_json)
-						
-		// No need to set NodeClassRef here as it's not accessible in this struct
-					} else {
-						log.Printf("[updateKarpenterNodePool] No changes needed for node pool %s - zones unchanged",
-							pool.Metadata.Name)
-					}
-				}
-			}
+		return nil
+	}
+	// A shift that changed no pool because every change failed is left to the retry
+	if applyErr != nil && len(record.NodePools) == 0 {
+		return applyErr
+	}
+	startedAt := eventTime(event)
+	expiresAt := eventExpiry(event)
+	if expiresAt == nil {
+		defaultExpiry := startedAt.Add(appConfig.Shifts.DefaultTTL.Duration)
+		expiresAt = &defaultExpiry
+	}
+	shift := store.StartShift(Shift{
+		ID:        event.ID,
+		ZoneID:    zone.ID,
+		Zone:      zone.Name,
+		Region:    event.Region,
+		Source:    event.Source,
+		EventID:   event.ID,
+		Reason:    event.Detail.Metadata.Notes,
+		StartedAt: startedAt,
+		ExpiresAt: expiresAt,
+		Resources: event.Resources,
+		NodePools: record.NodePools,
+		Practice:  practice,
+	})
+	logger.Info("Shift is active", "shift_id", shift.ID, "zone", shift.Zone, "nodepools", shift.NodePools)
+	recordShiftOutcomes(ctx, shift.ID, changes)
+	return applyErr
+}
+
+// eventExpiry returns when the shift in the event is due to end, if it says
+func eventExpiry(event Event) *time.Time {
+	t, err := time.Parse(time.RFC3339, event.Detail.Metadata.ExpiryTime)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// eventTime returns when the shift in the event started, or else when the
+// event happened, falling back to now
+func eventTime(event Event) time.Time {
+	for _, value := range []string{event.Detail.Metadata.StartTime, event.Time} {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t
 		}
 	}
-}
\ No newline at end of file
+	return time.Now()
+}
@@ -23,19 +23,21 @@ func TestSNSSubscriptionConfirmation(t *testing.T) {
 		Transport: &MockRoundTripper{
 			MockDo: func(req *http.Request) (*http.Response, error) {
 				assert.Equal(t, "GET", req.Method)
-				return &http.Response{StatusCode: http.StatusOK}, nil
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
 			},
 		},
 	}
 
-	// Create a sample SNS message
+	// Create a sample SNS message for an allowed topic
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
 	msg := SNSMessage{
 		Type:         "SubscriptionConfirmation",
-		SubscribeURL: "http://example.com/confirm",
+		TopicArn:     testTopicArn,
+		SubscribeURL: testSubscribeURL,
 	}
 
 	// Simulate an HTTP request with the above message
-	reqBody, err := json.Marshal(msg)
+	reqBody, err := json.Marshal(signSNSMessage(t, msg))
 	assert.NoError(t, err)
 
 	req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer(reqBody))
@@ -43,24 +45,30 @@ func TestSNSSubscriptionConfirmation(t *testing.T) {
 
 	// Capture the response
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(handleSNS) // Ensure this refers to handleSNS defined in main.go
-	handler.ServeHTTP(rr, req)
+	newRouter().ServeHTTP(rr, req)
 
 	// Assert that the subscription was confirmed successfully
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
 func TestInvalidSNSMessage(t *testing.T) {
-	// Simulate invalid JSON input
-	req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer([]byte("{invalid-json")))
-	assert.NoError(t, err)
-
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(handleSNS) // Ensure this refers to handleSNS defined in main.go
-	handler.ServeHTTP(rr, req)
+	useTestConfig(t, func(c *Config) {
+		c.DirectEvents.Mode, c.DirectEvents.APIKey = directEventsAPIKey, "key"
+	})
+	send := func(apiKey string) int {
+		// Simulate invalid JSON input
+		req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer([]byte("{invalid-json")))
+		assert.NoError(t, err)
+		req.Header.Set("X-API-Key", apiKey)
+
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
 
-	// Assert the response status code is 400 Bad Request
-	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	// The body is not even parsed for an unauthenticated caller
+	assert.Equal(t, http.StatusUnauthorized, send("wrong"))
+	assert.Equal(t, http.StatusBadRequest, send("key"))
 }
 
 func TestInvalidEventParsing(t *testing.T) {
@@ -70,18 +78,17 @@ func TestInvalidEventParsing(t *testing.T) {
 		Message: "{invalid-event}",
 	}
 
-	reqBody, err := json.Marshal(msg)
+	reqBody, err := json.Marshal(signSNSMessage(t, msg))
 	assert.NoError(t, err)
 
 	req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer(reqBody))
 	assert.NoError(t, err)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(handleSNS) // Ensure this refers to handleSNS defined in main.go
-	handler.ServeHTTP(rr, req)
+	newRouter().ServeHTTP(rr, req)
 
 	// Assert that the server responds with an error
-	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
 func TestValidEvent(t *testing.T) {
 	// Create a valid SNS message with a valid event
@@ -105,15 +112,14 @@ func TestValidEvent(t *testing.T) {
 	}
 
 	// Simulate an HTTP request with the above message
-	reqBody, err := json.Marshal(msg)
+	reqBody, err := json.Marshal(signSNSMessage(t, msg))
 	assert.NoError(t, err)
 
 	req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer(reqBody))
 	assert.NoError(t, err)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(handleSNS)
-	handler.ServeHTTP(rr, req)
+	newRouter().ServeHTTP(rr, req)
 
 	// Assert that the event parsing was successful
 	assert.Equal(t, http.StatusOK, rr.Code)
@@ -140,15 +146,14 @@ func TestInvalidEvent(t *testing.T) {
 	}
 
 	// Simulate an HTTP request with the above message
-	reqBody, err := json.Marshal(msg)
+	reqBody, err := json.Marshal(signSNSMessage(t, msg))
 	assert.NoError(t, err)
 
 	req, err := http.NewRequest("POST", "/sns", bytes.NewBuffer(reqBody))
 	assert.NoError(t, err)
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(handleSNS)
-	handler.ServeHTTP(rr, req)
+	newRouter().ServeHTTP(rr, req)
 
 	// Assert that the event is invalid and responds with an error
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
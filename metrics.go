@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const metricsNamespace = "zonal_shift"
+
+var (
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_total",
+		Help:      "Events processed, by detail type and outcome.",
+	}, []string{"detail_type", "outcome"})
+
+	snsConfirmationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sns_confirmations_total",
+		Help:      "SNS subscription confirmations, by result.",
+	}, []string{"result"})
+
+	snsMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sns_messages_total",
+		Help:      "SNS messages received from allowed topics, by type.",
+	}, []string{"type"})
+
+	nodePoolOperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nodepool_operations_total",
+		Help:      "NodePool updates and creates, by result.",
+	}, []string{"operation", "result"})
+
+	notificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notifications_total",
+		Help:      "Notification delivery attempts, by sink and result.",
+	}, []string{"sink", "result"})
+
+	eventDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_processing_duration_seconds",
+		Help:      "Time from receiving an event to finishing processing it, including time spent queued.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"detail_type"})
+
+	apiCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_call_duration_seconds",
+		Help:      "Latency of Kubernetes and EC2 API calls, by API, operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "operation", "result"})
+
+	auditWriteFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_write_failures_total",
+		Help:      "Audit records that could not be written.",
+	})
+
+	excludedZones = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "nodepool_excluded_zones",
+		Help:      "Zones currently removed from each NodePool by a shift.",
+	}, []string{"nodepool"})
+)
+
+func init() {
+	prometheus.MustRegister(activeShiftsCollector{
+		desc: prometheus.NewDesc(metricsNamespace+"_active_shifts", "Active shifts, by zone.", []string{"zone_id", "zone"}, nil),
+	})
+}
+
+// activeShiftsCollector reports the shifts in the store at scrape time, so
+// ended shifts disappear without having to be deleted
+type activeShiftsCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c activeShiftsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c activeShiftsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[[2]string]int{}
+	for _, shift := range store.ActiveShifts() {
+		counts[[2]string{shift.ZoneID, shift.Zone}]++
+	}
+	for zone, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), zone[0], zone[1])
+	}
+}
+
+// resultLabel turns an error into the result label of a metric
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeAPICall records the latency of a call to api that started at start
+func observeAPICall(api, operation string, start time.Time, err error) {
+	apiCallDuration.WithLabelValues(api, operation, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeEvent counts a processed event and how long it took since it was received
+func observeEvent(record EventRecord) {
+	eventsTotal.WithLabelValues(record.DetailType, record.Outcome).Inc()
+	eventDuration.WithLabelValues(record.DetailType).Observe(record.CompletedAt.Sub(record.ReceivedAt).Seconds())
+}
+
+// recordExcludedZones updates the excluded zones gauge for a NodePool
+func recordExcludedZones(obj *unstructured.Unstructured) {
+	pool, err := decodeNodePool(obj)
+	if err != nil {
+		return
+	}
+	excludedZones.WithLabelValues(pool.Metadata.Name).Set(float64(len(pool.removedZones())))
+}
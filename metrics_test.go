@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsReportShift(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+
+	applied := eventsTotal.WithLabelValues("Autoshift In Progress", outcomeApplied)
+	updated := nodePoolOperationsTotal.WithLabelValues("update", "success")
+	appliedBefore, updatedBefore := testutil.ToFloat64(applied), testutil.ToFloat64(updated)
+
+	_, err := updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	assert.Equal(t, appliedBefore+1, testutil.ToFloat64(applied))
+	assert.Equal(t, updatedBefore+1, testutil.ToFloat64(updated))
+	assert.Equal(t, float64(1), testutil.ToFloat64(excludedZones.WithLabelValues("default")))
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `zonal_shift_active_shifts{zone="us-east-1a",zone_id="use1-az1"} 1`)
+	assert.Contains(t, rr.Body.String(), `zonal_shift_event_processing_duration_seconds_count{detail_type="Autoshift In Progress"}`)
+
+	_, err = updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift Completed"))
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), testutil.ToFloat64(excludedZones.WithLabelValues("default")))
+}
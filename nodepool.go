@@ -0,0 +1,848 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+// zoneLabelKey is the label NodePool zone requirements use, the well-known
+// topology.kubernetes.io/zone unless the zoneKey setting overrides it
+var zoneLabelKey = "topology.kubernetes.io/zone"
+
+const (
+	// removedZonesAnnotation records the zones this service removed from a pool,
+	// so that a restore only gives back what a shift took away
+	removedZonesAnnotation = "zonalshift.karpenter.aws/removed-zones"
+
+	// shiftIDsAnnotation records the shift that removed each zone, as
+	// comma-separated zone=shift-id pairs
+	shiftIDsAnnotation = "zonalshift.karpenter.aws/shift-ids"
+
+	// updatedAtAnnotation records when this service last changed a pool
+	updatedAtAnnotation = "zonalshift.karpenter.aws/updated-at"
+
+	// autoModePoolName is the pool created when only the EKS Auto Mode defaults exist
+	autoModePoolName = "zonal-shift-karpenter"
+
+	// nodePoolLabelKey is the label Karpenter puts on the NodeClaims of a NodePool
+	nodePoolLabelKey = "karpenter.sh/nodepool"
+)
+
+var (
+	nodePoolGVR  = schema.GroupVersionResource{Group: "karpenter.sh", Version: "v1", Resource: "nodepools"}
+	nodeClaimGVR = schema.GroupVersionResource{Group: "karpenter.sh", Version: "v1", Resource: "nodeclaims"}
+)
+
+// Requirement is a single node selector requirement of a NodePool template
+type Requirement struct {
+	Key       string   `json:"key"`
+	Operator  string   `json:"operator"`
+	Values    []string `json:"values,omitempty"`
+	MinValues *int64   `json:"minValues,omitempty"`
+}
+
+// NodePool represents the structure of a Karpenter NodePool
+type NodePool struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Requirements []Requirement `json:"requirements"`
+				NodeClassRef struct {
+					Name  string `json:"name"`
+					Kind  string `json:"kind"`
+					Group string `json:"group"`
+				} `json:"nodeClassRef"`
+			} `json:"spec"`
+		} `json:"template"`
+		Limits map[string]interface{} `json:"limits,omitempty"`
+	} `json:"spec"`
+}
+
+// zoneRequirement returns the index of the zone requirement, or -1 if the pool has none
+func (p *NodePool) zoneRequirement() int {
+	for i, req := range p.Spec.Template.Spec.Requirements {
+		if req.Key == zoneLabelKey {
+			return i
+		}
+	}
+	return -1
+}
+
+// removedZones returns the zones recorded in the removed-zones annotation
+func (p *NodePool) removedZones() []string {
+	value := p.Metadata.Annotations[removedZonesAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// shiftIDs returns the shift recorded in the shift-ids annotation for each removed zone
+func (p *NodePool) shiftIDs() map[string]string {
+	ids := map[string]string{}
+	for _, pair := range strings.Split(p.Metadata.Annotations[shiftIDsAnnotation], ",") {
+		if zone, id, ok := strings.Cut(pair, "="); ok {
+			ids[zone] = id
+		}
+	}
+	return ids
+}
+
+// AvailabilityZone pairs a zone ID, as used in zonal shift events, with the
+// zone name that NodePool requirements use
+type AvailabilityZone struct {
+	ID   string
+	Name string
+}
+
+// ZoneResolver lists the availability zones of a region
+type ZoneResolver interface {
+	Zones(ctx context.Context, region string) ([]AvailabilityZone, error)
+}
+
+// ec2ZoneResolver resolves zones through the EC2 DescribeAvailabilityZones API
+type ec2ZoneResolver struct{}
+
+func newEC2ZoneResolver() ZoneResolver {
+	return ec2ZoneResolver{}
+}
+
+func (ec2ZoneResolver) Zones(ctx context.Context, region string) ([]AvailabilityZone, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		slog.Error("Failed to load AWS config", "error", err)
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	start := time.Now()
+	output, err := ec2.NewFromConfig(awsCfg).DescribeAvailabilityZones(ctx, &ec2.DescribeAvailabilityZonesInput{})
+	observeAPICall("ec2", "DescribeAvailabilityZones", start, err)
+	if err != nil {
+		slog.Error("Failed to describe availability zones", "region", region, "error", err)
+		return nil, fmt.Errorf("failed to describe availability zones: %v", err)
+	}
+	slog.Debug("Retrieved availability zones from EC2", "region", region, "count", len(output.AvailabilityZones))
+
+	var zones []AvailabilityZone
+	for _, az := range output.AvailabilityZones {
+		if az.ZoneId == nil || az.ZoneName == nil {
+			continue
+		}
+		zones = append(zones, AvailabilityZone{ID: *az.ZoneId, Name: *az.ZoneName})
+	}
+	return zones, nil
+}
+
+// lookupZone finds a zone by ID or by name
+func lookupZone(zones []AvailabilityZone, idOrName string) (AvailabilityZone, bool) {
+	for _, az := range zones {
+		if az.ID == idOrName || az.Name == idOrName {
+			return az, true
+		}
+	}
+	return AvailabilityZone{}, false
+}
+
+// getUpdatedZones returns the names of all zones except the one being shifted away from
+func getUpdatedZones(zones []AvailabilityZone, awayFrom string) []string {
+	var updatedZones []string
+	for _, az := range zones {
+		if az.ID != awayFrom && az.Name != awayFrom {
+			slog.Debug("Including zone in updated zones", "zone", az.Name)
+			updatedZones = append(updatedZones, az.Name)
+		} else {
+			slog.Debug("Excluding zone as it matches awayFrom", "zone", az.Name, "zone_id", az.ID)
+		}
+	}
+	sort.Strings(updatedZones)
+	slog.Debug("Updated zones", "zones", updatedZones)
+	return updatedZones
+}
+
+// kubeconfigRESTConfig loads a client config from the kubeconfig loading rules,
+// honouring an explicit path and context when they are set
+func kubeconfigRESTConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	k8sConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	return k8sConfig, nil
+}
+
+// newDynamicClient builds a client for the given config, falling back to the
+// in-cluster service account when k8sConfig is nil
+func newDynamicClient(k8sConfig *rest.Config) (dynamic.Interface, error) {
+	if k8sConfig == nil {
+		var err error
+		k8sConfig, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cluster config: %v", err)
+		}
+	}
+	client, err := dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+	return client, nil
+}
+
+// NodePoolChange is a zone change the processor intends to make to a single NodePool.
+// A refused change is reported but never applied.
+type NodePoolChange struct {
+	Name     string
+	Create   bool
+	Operator string
+	OldZones []string
+	NewZones []string
+	Refused  string
+
+	// Zone is the zone removed or, when Restore is set, given back
+	Zone    string
+	Restore bool
+	ShiftID string
+	// EventID is the event the change answers. Changes made without one, such
+	// as drift corrections, are reported to Kubernetes by their caller.
+	EventID string
+	// Source is what asked for the change, recorded in the audit log
+	Source string
+	// Error is why applying the change failed, set by Apply
+	Error string
+
+	object *unstructured.Unstructured
+}
+
+// Processor turns zonal shift events into NodePool changes
+type Processor struct {
+	client dynamic.Interface
+	zones  ZoneResolver
+
+	// Policy decides which changes are refused
+	Policy SafetyPolicy
+	// Selector is a label selector limiting which NodePools are managed
+	Selector string
+	// NodePools, if set, limits the managed NodePools to these names
+	NodePools []string
+	// EvacuateNodes deletes the NodeClaims of a shifted NodePool in the removed zone
+	EvacuateNodes bool
+	// AutoModePool configures the pool created when only the EKS Auto Mode defaults exist
+	AutoModePool AutoModePoolSpec
+	// AllowedSources and AllowedResources, if set, limit the events acted on
+	AllowedSources   []string
+	AllowedResources []string
+	// Recorder, if set, records a Kubernetes Event on every NodePool changed for an event
+	Recorder record.EventRecorder
+	// Audit, if set, records every NodePool mutation
+	Audit AuditLog
+	// DryRun logs the changes Apply would make instead of making them
+	DryRun bool
+	// Planned, if set, is called with the changes planned for each event before they are applied
+	Planned func([]NodePoolChange)
+
+	zoneCacheMu sync.Mutex
+	zoneCache   map[string][]AvailabilityZone
+}
+
+// NewProcessor creates a Processor using the given cluster client and zone resolver
+func NewProcessor(client dynamic.Interface, zones ZoneResolver) *Processor {
+	return &Processor{client: client, zones: zones, Policy: defaultSafetyPolicy}
+}
+
+// regionZones returns the zones of a region, asking the resolver only once per region
+func (p *Processor) regionZones(ctx context.Context, region string) ([]AvailabilityZone, error) {
+	p.zoneCacheMu.Lock()
+	defer p.zoneCacheMu.Unlock()
+
+	if zones, ok := p.zoneCache[region]; ok {
+		return zones, nil
+	}
+	zones, err := p.zones.Zones(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	if p.zoneCache == nil {
+		p.zoneCache = map[string][]AvailabilityZone{}
+	}
+	p.zoneCache[region] = zones
+	return zones, nil
+}
+
+// ResolveZone finds a zone of the region by ID or by name
+func (p *Processor) ResolveZone(ctx context.Context, region, zone string) (AvailabilityZone, error) {
+	zones, err := p.regionZones(ctx, region)
+	if err != nil {
+		return AvailabilityZone{}, err
+	}
+	az, ok := lookupZone(zones, zone)
+	if !ok {
+		return AvailabilityZone{}, fmt.Errorf("zone %s not found in region %s", zone, region)
+	}
+	return az, nil
+}
+
+// listNodePools returns every managed NodePool in the cluster
+func (p *Processor) listNodePools(ctx context.Context) ([]unstructured.Unstructured, error) {
+	slog.Debug("Retrieving Karpenter node pools", "selector", p.Selector)
+	start := time.Now()
+	list, err := p.client.Resource(nodePoolGVR).List(ctx, metav1.ListOptions{LabelSelector: p.Selector})
+	observeAPICall("kubernetes", "list", start, err)
+	if err != nil {
+		slog.Error("Failed to get node pools", "error", err)
+		return nil, fmt.Errorf("failed to get node pools: %v", err)
+	}
+	pools := slices.DeleteFunc(list.Items, func(pool unstructured.Unstructured) bool {
+		return len(p.NodePools) > 0 && !slices.Contains(p.NodePools, pool.GetName())
+	})
+	slog.Debug("Found node pools", "count", len(pools))
+	return pools, nil
+}
+
+// manages reports whether a NodePool is selected by Selector and NodePools
+func (p *Processor) manages(obj *unstructured.Unstructured) (bool, error) {
+	selector, err := labels.Parse(p.Selector)
+	if err != nil {
+		return false, fmt.Errorf("invalid node pool selector %q: %v", p.Selector, err)
+	}
+	if !selector.Matches(labels.Set(obj.GetLabels())) {
+		return false, nil
+	}
+	return len(p.NodePools) == 0 || slices.Contains(p.NodePools, obj.GetName()), nil
+}
+
+// PlanEvent computes the changes for an event, restoring the zone when the
+// event ends a shift and removing it otherwise
+func (p *Processor) PlanEvent(ctx context.Context, event Event) ([]NodePoolChange, error) {
+	var changes []NodePoolChange
+	var err error
+	if isShiftEnd(event) {
+		changes, err = p.PlanRestore(ctx, event.Region, event.Detail.Metadata.AwayFrom)
+	} else {
+		changes, err = p.PlanShift(ctx, event)
+	}
+	for i := range changes {
+		changes[i].EventID, changes[i].Source = event.ID, event.Source
+	}
+	return changes, err
+}
+
+// PlanShift computes the changes needed to move every NodePool away from the
+// zone named in the event
+func (p *Processor) PlanShift(ctx context.Context, event Event) ([]NodePoolChange, error) {
+	zones, err := p.regionZones(ctx, event.Region)
+	if err != nil {
+		return nil, err
+	}
+	away, err := p.ResolveZone(ctx, event.Region, event.Detail.Metadata.AwayFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := p.listNodePools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A shift for a zone that is already shifted joins the existing one
+	shiftID := event.ID
+	if existing, ok := store.ShiftForZone(away.ID, isPracticeShift(event)); ok {
+		shiftID = existing.ID
+	}
+
+	// Check if the only node pools are the EKS Auto Mode "general-purpose" and "system" defaults
+	if generalPurpose := autoModeDefaultPool(pools); generalPurpose != nil && p.AutoModePool.enabled() {
+		name := p.AutoModePool.name()
+		slog.Info("Found only the EKS Auto Mode default node pools, planning a new node pool", "nodepool", name)
+		updatedZones := getUpdatedZones(zones, away.ID)
+		if reason := p.Policy.check(len(updatedZones)); reason != "" {
+			slog.Warn("Refusing to create node pool", "nodepool", name, "reason", reason)
+			return []NodePoolChange{{Name: name, Create: true, Operator: "In", NewZones: updatedZones, Refused: reason, Zone: away.Name, ShiftID: shiftID}}, nil
+		}
+		change, err := planAutoModePool(generalPurpose, p.AutoModePool, updatedZones, away.Name, shiftID)
+		if err != nil {
+			return nil, err
+		}
+		return []NodePoolChange{*change}, nil
+	}
+
+	var changes []NodePoolChange
+	for i := range pools {
+		change, err := p.planPoolShift(&pools[i], away.Name, shiftID, len(zones))
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// PlanRestore computes the changes needed to give a zone back to the NodePools
+// that a previous shift removed it from
+func (p *Processor) PlanRestore(ctx context.Context, region, zone string) ([]NodePoolChange, error) {
+	restored, err := p.ResolveZone(ctx, region, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	pools, err := p.listNodePools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []NodePoolChange
+	for i := range pools {
+		change, err := planPoolRestore(&pools[i], restored.Name)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// NodePoolStatus shows the zones a NodePool had before any shift next to the zones it has now
+type NodePoolStatus struct {
+	Name          string   `json:"name"`
+	Operator      string   `json:"operator,omitempty"`
+	OriginalZones []string `json:"originalZones"`
+	CurrentZones  []string `json:"currentZones"`
+	RemovedZones  []string `json:"removedZones,omitempty"`
+}
+
+// NodePoolZones reports the original and current zones of every NodePool
+func (p *Processor) NodePoolZones(ctx context.Context) ([]NodePoolStatus, error) {
+	pools, err := p.listNodePools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]NodePoolStatus, 0, len(pools))
+	for i := range pools {
+		pool, err := decodeNodePool(&pools[i])
+		if err != nil {
+			return nil, err
+		}
+		status := NodePoolStatus{Name: pool.Metadata.Name, RemovedZones: pool.removedZones()}
+		if idx := pool.zoneRequirement(); idx >= 0 {
+			req := pool.Spec.Template.Spec.Requirements[idx]
+			status.Operator = req.Operator
+			status.CurrentZones = req.Values
+			status.OriginalZones = req.Values
+			switch req.Operator {
+			case "In":
+				status.OriginalZones = mergeStrings(req.Values, status.RemovedZones)
+			case "NotIn":
+				status.OriginalZones = slices.DeleteFunc(slices.Clone(req.Values), func(z string) bool {
+					return slices.Contains(status.RemovedZones, z)
+				})
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Apply writes the planned changes to the cluster, continuing past failures
+// and recording each failure in the change's Error
+func (p *Processor) Apply(ctx context.Context, changes []NodePoolChange) error {
+	var errs []error
+	for i, change := range changes {
+		if change.Refused != "" {
+			continue
+		}
+		if p.DryRun {
+			slog.Info("Dry run, not changing node pool", "nodepool", change.Name, "create", change.Create, "old_zones", change.OldZones, "new_zones", change.NewZones)
+			continue
+		}
+		annotations := change.object.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[updatedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		change.object.SetAnnotations(annotations)
+
+		if change.Create {
+			created, err := CreateNodePool(ctx, p.client, change.object)
+			nodePoolOperationsTotal.WithLabelValues("create", resultLabel(err)).Inc()
+			p.auditChange(ctx, change, auditOperationCreate, err)
+			if err != nil {
+				changes[i].Error = err.Error()
+				errs = append(errs, err)
+				continue
+			}
+			recordExcludedZones(created)
+			p.recordEvent(created, change)
+			continue
+		}
+		slog.Info("Updating node pool zones", "nodepool", change.Name, "old_zones", change.OldZones, "new_zones", change.NewZones)
+		start := time.Now()
+		updated, err := p.client.Resource(nodePoolGVR).Update(ctx, change.object, metav1.UpdateOptions{})
+		observeAPICall("kubernetes", "update", start, err)
+		nodePoolOperationsTotal.WithLabelValues("update", resultLabel(err)).Inc()
+		p.auditChange(ctx, change, auditOperationUpdate, err)
+		if err != nil {
+			slog.Error("Failed to update node pool", "nodepool", change.Name, "error", err)
+			changes[i].Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to update node pool %s: %v", change.Name, err))
+			continue
+		}
+		recordExcludedZones(updated)
+		p.recordEvent(updated, change)
+		slog.Info("Updated node pool", "nodepool", change.Name)
+		if p.EvacuateNodes && !change.Restore && change.Zone != "" {
+			if err := p.evacuate(ctx, change.Name, change.Zone); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// evacuate deletes the NodeClaims of a NodePool in a zone, so that Karpenter
+// drains their nodes and replaces them in the zones the pool may still use
+func (p *Processor) evacuate(ctx context.Context, nodePool, zone string) error {
+	selector := labels.Set{nodePoolLabelKey: nodePool, zoneLabelKey: zone}.String()
+	start := time.Now()
+	list, err := p.client.Resource(nodeClaimGVR).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	observeAPICall("kubernetes", "list", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to list node claims of node pool %s: %v", nodePool, err)
+	}
+	var errs []error
+	for _, claim := range list.Items {
+		start := time.Now()
+		err := p.client.Resource(nodeClaimGVR).Delete(ctx, claim.GetName(), metav1.DeleteOptions{})
+		observeAPICall("kubernetes", "delete", start, err)
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete node claim %s: %v", claim.GetName(), err))
+			continue
+		}
+		slog.Info("Evacuating node claim", "nodepool", nodePool, "zone", zone, "nodeclaim", claim.GetName())
+	}
+	return errors.Join(errs...)
+}
+
+// recordEvent records a Kubernetes Event on a NodePool changed in answer to an event
+func (p *Processor) recordEvent(obj *unstructured.Unstructured, change NodePoolChange) {
+	if p.Recorder == nil || change.EventID == "" {
+		return
+	}
+	switch {
+	case change.Restore:
+		p.Recorder.Eventf(obj, corev1.EventTypeNormal, reasonShiftRestored,
+			"Restored zone %s after shift %s (event %s), zones %v -> %v", change.Zone, change.ShiftID, change.EventID, change.OldZones, change.NewZones)
+	case change.Create:
+		p.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonShiftApplied,
+			"Created with zones %v, without zone %s for shift %s (event %s)", change.NewZones, change.Zone, change.ShiftID, change.EventID)
+	default:
+		p.Recorder.Eventf(obj, corev1.EventTypeWarning, reasonShiftApplied,
+			"Removed zone %s for shift %s (event %s), zones %v -> %v", change.Zone, change.ShiftID, change.EventID, change.OldZones, change.NewZones)
+	}
+}
+
+// CreateNodePool creates a new Karpenter NodePool, returning it as stored by the API server
+func CreateNodePool(ctx context.Context, client dynamic.Interface, nodePool *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	start := time.Now()
+	created, err := client.Resource(nodePoolGVR).Create(ctx, nodePool, metav1.CreateOptions{})
+	observeAPICall("kubernetes", "create", start, err)
+	if err != nil {
+		slog.Error("Failed to create node pool", "nodepool", nodePool.GetName(), "error", err)
+		return nil, fmt.Errorf("failed to create node pool %s: %v", nodePool.GetName(), err)
+	}
+	slog.Info("Created node pool", "nodepool", nodePool.GetName())
+	return created, nil
+}
+
+// autoModeDefaultPool returns the "general-purpose" pool when the only pools in
+// the cluster are the EKS Auto Mode "general-purpose" and "system" defaults
+func autoModeDefaultPool(pools []unstructured.Unstructured) *unstructured.Unstructured {
+	if len(pools) != 2 {
+		return nil
+	}
+	names := []string{pools[0].GetName(), pools[1].GetName()}
+	sort.Strings(names)
+	if names[0] != "general-purpose" || names[1] != "system" {
+		return nil
+	}
+	if pools[0].GetName() == "general-purpose" {
+		return &pools[0]
+	}
+	return &pools[1]
+}
+
+// planAutoModePool plans a copy of the general-purpose pool restricted to the healthy zones
+func planAutoModePool(generalPurpose *unstructured.Unstructured, autoMode AutoModePoolSpec, zones []string, removed, shiftID string) (*NodePoolChange, error) {
+	spec, _, err := unstructured.NestedMap(generalPurpose.Object, "spec")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec of node pool %s: %v", generalPurpose.GetName(), err)
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(nodePoolGVR.GroupVersion().String())
+	obj.SetKind("NodePool")
+	obj.SetName(autoMode.name())
+	obj.SetLabels(map[string]string{"app.kubernetes.io/managed-by": "zonal-shift"})
+	obj.SetAnnotations(map[string]string{removedZonesAnnotation: removed, shiftIDsAnnotation: removed + "=" + shiftID})
+
+	pool, err := decodeNodePool(obj)
+	if err != nil {
+		return nil, err
+	}
+	reqs := pool.Spec.Template.Spec.Requirements
+	if i := pool.zoneRequirement(); i >= 0 {
+		reqs[i] = Requirement{Key: zoneLabelKey, Operator: "In", Values: zones}
+	} else {
+		reqs = append(reqs, Requirement{Key: zoneLabelKey, Operator: "In", Values: zones})
+	}
+	if err := setRequirements(obj, reqs); err != nil {
+		return nil, err
+	}
+	if ref := autoMode.NodeClassRef; ref != nil {
+		nodeClassRef := map[string]interface{}{"name": ref.Name, "kind": ref.Kind, "group": ref.Group}
+		if err := unstructured.SetNestedMap(obj.Object, nodeClassRef, "spec", "template", "spec", "nodeClassRef"); err != nil {
+			return nil, err
+		}
+	}
+	return &NodePoolChange{Name: autoMode.name(), Create: true, Operator: "In", NewZones: zones, Zone: removed, ShiftID: shiftID, object: obj}, nil
+}
+
+// planPoolShift plans removing zone from a pool's zone requirement for the
+// given shift, refusing the change if the safety policy does not allow it
+func (p *Processor) planPoolShift(obj *unstructured.Unstructured, zone, shiftID string, regionZones int) (*NodePoolChange, error) {
+	pool, err := decodeNodePool(obj)
+	if err != nil {
+		return nil, err
+	}
+	i := pool.zoneRequirement()
+	if i < 0 {
+		slog.Debug("Node pool has no zone requirement, skipping", "nodepool", pool.Metadata.Name)
+		return nil, nil
+	}
+	req := pool.Spec.Template.Spec.Requirements[i]
+
+	var newZones []string
+	var remaining int
+	switch req.Operator {
+	case "In":
+		if !slices.Contains(req.Values, zone) {
+			slog.Debug("No changes needed, zone not in use", "nodepool", pool.Metadata.Name, "zone", zone)
+			return nil, nil
+		}
+		newZones = slices.DeleteFunc(slices.Clone(req.Values), func(z string) bool { return z == zone })
+		remaining = len(newZones)
+	case "NotIn":
+		if slices.Contains(req.Values, zone) {
+			slog.Debug("No changes needed, zone already excluded", "nodepool", pool.Metadata.Name, "zone", zone)
+			return nil, nil
+		}
+		newZones = append(slices.Clone(req.Values), zone)
+		remaining = regionZones - len(newZones)
+	default:
+		slog.Info("Node pool uses an unsupported zone operator, skipping", "nodepool", pool.Metadata.Name, "operator", req.Operator)
+		return nil, nil
+	}
+
+	if reason := p.Policy.check(remaining); reason != "" {
+		slog.Warn("Refusing to remove zone from node pool", "nodepool", pool.Metadata.Name, "zone", zone, "reason", reason)
+		return &NodePoolChange{
+			Name:     pool.Metadata.Name,
+			Operator: req.Operator,
+			OldZones: req.Values,
+			NewZones: newZones,
+			Refused:  reason,
+			Zone:     zone,
+			ShiftID:  shiftID,
+		}, nil
+	}
+	shiftIDs := pool.shiftIDs()
+	shiftIDs[zone] = shiftID
+	change, err := buildChange(obj, pool, i, newZones, mergeStrings(pool.removedZones(), []string{zone}), shiftIDs)
+	if err != nil {
+		return nil, err
+	}
+	change.Zone, change.ShiftID = zone, shiftID
+	return change, nil
+}
+
+// planPoolRestore plans giving zone back to a pool it was previously removed from
+func planPoolRestore(obj *unstructured.Unstructured, zone string) (*NodePoolChange, error) {
+	pool, err := decodeNodePool(obj)
+	if err != nil {
+		return nil, err
+	}
+	removed := pool.removedZones()
+	if !slices.Contains(removed, zone) {
+		return nil, nil
+	}
+	removed = slices.DeleteFunc(removed, func(z string) bool { return z == zone })
+	shiftIDs := pool.shiftIDs()
+
+	i := pool.zoneRequirement()
+	if i < 0 {
+		slog.Info("Node pool no longer has a zone requirement, clearing annotation", "nodepool", pool.Metadata.Name)
+		change, err := buildChange(obj, pool, -1, nil, removed, shiftIDs)
+		if err != nil {
+			return nil, err
+		}
+		change.Zone, change.Restore, change.ShiftID = zone, true, shiftIDs[zone]
+		return change, nil
+	}
+	req := pool.Spec.Template.Spec.Requirements[i]
+
+	newZones := slices.Clone(req.Values)
+	switch req.Operator {
+	case "In":
+		if !slices.Contains(newZones, zone) {
+			newZones = append(newZones, zone)
+		}
+	case "NotIn":
+		newZones = slices.DeleteFunc(newZones, func(z string) bool { return z == zone })
+	}
+	change, err := buildChange(obj, pool, i, newZones, removed, shiftIDs)
+	if err != nil {
+		return nil, err
+	}
+	change.Zone, change.Restore, change.ShiftID = zone, true, shiftIDs[zone]
+	return change, nil
+}
+
+// buildChange copies obj with the zone requirement at index i set to zones,
+// the removed-zones annotation set to removed and the shift-ids annotation
+// set to the shifts of the removed zones
+func buildChange(obj *unstructured.Unstructured, pool *NodePool, i int, zones, removed []string, shiftIDs map[string]string) (*NodePoolChange, error) {
+	updated := obj.DeepCopy()
+	change := &NodePoolChange{Name: pool.Metadata.Name, object: updated}
+
+	if i >= 0 {
+		reqs := pool.Spec.Template.Spec.Requirements
+		change.Operator = reqs[i].Operator
+		change.OldZones = reqs[i].Values
+		change.NewZones = zones
+		reqs[i].Values = zones
+		if err := setRequirements(updated, reqs); err != nil {
+			return nil, err
+		}
+	}
+
+	annotations := updated.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	var pairs []string
+	for _, zone := range removed {
+		if id := shiftIDs[zone]; id != "" {
+			pairs = append(pairs, zone+"="+id)
+		}
+	}
+	if len(removed) > 0 {
+		annotations[removedZonesAnnotation] = strings.Join(removed, ",")
+	} else {
+		delete(annotations, removedZonesAnnotation)
+	}
+	if len(pairs) > 0 {
+		annotations[shiftIDsAnnotation] = strings.Join(pairs, ",")
+	} else {
+		delete(annotations, shiftIDsAnnotation)
+	}
+	updated.SetAnnotations(annotations)
+	return change, nil
+}
+
+// decodeNodePool converts an unstructured object into a NodePool
+func decodeNodePool(obj *unstructured.Unstructured) (*NodePool, error) {
+	var pool NodePool
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &pool); err != nil {
+		return nil, fmt.Errorf("failed to parse node pool %s: %v", obj.GetName(), err)
+	}
+	return &pool, nil
+}
+
+// setRequirements replaces the template requirements of an unstructured NodePool
+func setRequirements(obj *unstructured.Unstructured, reqs []Requirement) error {
+	values := make([]interface{}, 0, len(reqs))
+	for i := range reqs {
+		value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&reqs[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode requirement %s: %v", reqs[i].Key, err)
+		}
+		values = append(values, value)
+	}
+	return unstructured.SetNestedSlice(obj.Object, values, "spec", "template", "spec", "requirements")
+}
+
+// writeDiff prints a human-readable summary of the planned changes
+func writeDiff(w io.Writer, changes []NodePoolChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No node pool changes.")
+		return
+	}
+	for _, change := range changes {
+		if change.Refused != "" {
+			fmt.Fprintf(w, "! nodepool/%s (refused: %s)\n", change.Name, change.Refused)
+			continue
+		}
+		if change.Create {
+			fmt.Fprintf(w, "+ nodepool/%s (create)\n", change.Name)
+		} else {
+			fmt.Fprintf(w, "~ nodepool/%s\n", change.Name)
+		}
+		if change.Operator == "" {
+			fmt.Fprintf(w, "    annotation %s updated\n", removedZonesAnnotation)
+			continue
+		}
+		fmt.Fprintf(w, "    %s %s\n", zoneLabelKey, change.Operator)
+		for _, zone := range mergeStrings(change.OldZones, change.NewZones) {
+			switch {
+			case !slices.Contains(change.NewZones, zone):
+				fmt.Fprintf(w, "      - %s\n", zone)
+			case !slices.Contains(change.OldZones, zone):
+				fmt.Fprintf(w, "      + %s\n", zone)
+			default:
+				fmt.Fprintf(w, "        %s\n", zone)
+			}
+		}
+	}
+}
+
+// mergeStrings returns the sorted union of two string lists
+func mergeStrings(a, b []string) []string {
+	merged := slices.Concat(a, b)
+	sort.Strings(merged)
+	return slices.Compact(merged)
+}
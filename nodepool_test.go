@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeZoneResolver returns a fixed list of zones
+type fakeZoneResolver []AvailabilityZone
+
+func (f fakeZoneResolver) Zones(ctx context.Context, region string) ([]AvailabilityZone, error) {
+	return f, nil
+}
+
+var testZones = fakeZoneResolver{
+	{ID: "use1-az1", Name: "us-east-1a"},
+	{ID: "use1-az2", Name: "us-east-1b"},
+	{ID: "use1-az3", Name: "us-east-1c"},
+}
+
+func newTestNodePool(name string, requirements ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "karpenter.sh/v1",
+		"kind":       "NodePool",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"requirements": requirements,
+					"nodeClassRef": map[string]interface{}{"name": "default", "kind": "NodeClass", "group": "eks.amazonaws.com"},
+				},
+			},
+		},
+	}}
+}
+
+func zoneRequirementOf(operator string, zones ...interface{}) interface{} {
+	return map[string]interface{}{"key": zoneLabelKey, "operator": operator, "values": zones}
+}
+
+func newTestClient(pools ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{nodePoolGVR: "NodePoolList"}, pools...)
+}
+
+func getTestNodePool(t *testing.T, client dynamic.Interface, name string) *NodePool {
+	obj, err := client.Resource(nodePoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	pool, err := decodeNodePool(obj)
+	require.NoError(t, err)
+	return pool
+}
+
+func testShiftEvent(detailType string) Event {
+	return Event{
+		Version:    "0",
+		DetailType: detailType,
+		Region:     "us-east-1",
+		Detail:     Detail{Metadata: Metadata{AwayFrom: "use1-az1"}},
+	}
+}
+
+func TestPlanShiftAndRestore(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")),
+		newTestNodePool("exclusions", zoneRequirementOf("NotIn", "us-east-1c")),
+		newTestNodePool("no-zones"),
+	)
+	processor := NewProcessor(client, testZones)
+	ctx := context.Background()
+
+	changes, err := processor.PlanEvent(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	pool := getTestNodePool(t, client, "default")
+	assert.Equal(t, []string{"us-east-1b", "us-east-1c"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Equal(t, []string{"us-east-1a"}, pool.removedZones())
+	pool = getTestNodePool(t, client, "exclusions")
+	assert.Equal(t, []string{"us-east-1c", "us-east-1a"}, pool.Spec.Template.Spec.Requirements[0].Values)
+
+	// A second shift for the same zone is a no-op
+	changes, err = processor.PlanEvent(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	changes, err = processor.PlanEvent(ctx, testShiftEvent("Autoshift Completed"))
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	pool = getTestNodePool(t, client, "default")
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b", "us-east-1c"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Empty(t, pool.removedZones())
+	pool = getTestNodePool(t, client, "exclusions")
+	assert.Equal(t, []string{"us-east-1c"}, pool.Spec.Template.Spec.Requirements[0].Values)
+}
+
+func TestPlanShiftKeepsLastZone(t *testing.T) {
+	client := newTestClient(newTestNodePool("single", zoneRequirementOf("In", "us-east-1a")))
+	processor := NewProcessor(client, testZones)
+	ctx := context.Background()
+
+	changes, err := processor.PlanShift(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.NotEmpty(t, changes[0].Refused)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	pool := getTestNodePool(t, client, "single")
+	assert.Equal(t, []string{"us-east-1a"}, pool.Spec.Template.Spec.Requirements[0].Values)
+}
+
+func TestPlanShiftHonoursMinZones(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("two", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("three", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")),
+		newTestNodePool("exclusions", zoneRequirementOf("NotIn", "us-east-1c")),
+	)
+	processor := NewProcessor(client, testZones)
+	processor.Policy = SafetyPolicy{MinZones: 2}
+
+	changes, err := processor.PlanShift(context.Background(), testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	refused := map[string]bool{}
+	for _, change := range changes {
+		refused[change.Name] = change.Refused != ""
+	}
+	assert.Equal(t, map[string]bool{"two": true, "three": false, "exclusions": true}, refused)
+}
+
+func TestPlanShiftCreatesAutoModePool(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("general-purpose", map[string]interface{}{"key": "kubernetes.io/arch", "operator": "In", "values": []interface{}{"amd64"}}),
+		newTestNodePool("system"),
+	)
+	processor := NewProcessor(client, testZones)
+	ctx := context.Background()
+
+	changes, err := processor.PlanShift(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.True(t, changes[0].Create)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	pool := getTestNodePool(t, client, autoModePoolName)
+	require.Len(t, pool.Spec.Template.Spec.Requirements, 2)
+	assert.Equal(t, "kubernetes.io/arch", pool.Spec.Template.Spec.Requirements[0].Key)
+	assert.Equal(t, []string{"us-east-1b", "us-east-1c"}, pool.Spec.Template.Spec.Requirements[1].Values)
+	assert.Equal(t, "default", pool.Spec.Template.Spec.NodeClassRef.Name)
+}
+
+func TestApplyRecordsEventsAndAnnotations(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	recorder := record.NewFakeRecorder(10)
+	processor.Recorder = recorder
+	useTestProcessor(t, processor)
+
+	start := testShiftEvent("Autoshift In Progress")
+	start.ID = "event-1"
+	_, err := updateKarpenterNodePool(context.Background(), start)
+	require.NoError(t, err)
+
+	annotations := getTestNodePool(t, client, "default").Metadata.Annotations
+	assert.Equal(t, "us-east-1a", annotations[removedZonesAnnotation])
+	assert.Equal(t, "us-east-1a=event-1", annotations[shiftIDsAnnotation])
+	_, err = time.Parse(time.RFC3339, annotations[updatedAtAnnotation])
+	assert.NoError(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning ZonalShiftApplied Removed zone us-east-1a for shift event-1 (event event-1), zones [us-east-1a us-east-1b] -> [us-east-1b]", <-recorder.Events)
+
+	end := testShiftEvent("Autoshift Completed")
+	end.ID = "event-2"
+	_, err = updateKarpenterNodePool(context.Background(), end)
+	require.NoError(t, err)
+
+	annotations = getTestNodePool(t, client, "default").Metadata.Annotations
+	assert.NotContains(t, annotations, removedZonesAnnotation)
+	assert.NotContains(t, annotations, shiftIDsAnnotation)
+	assert.Contains(t, annotations, updatedAtAnnotation)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Normal ZonalShiftRestored Restored zone us-east-1a after shift event-1 (event event-2), zones [us-east-1b] -> [us-east-1b us-east-1a]", <-recorder.Events)
+}
+
+func TestWriteDiff(t *testing.T) {
+	var out bytes.Buffer
+	writeDiff(&out, []NodePoolChange{{
+		Name:     "default",
+		Operator: "In",
+		OldZones: []string{"us-east-1a", "us-east-1b"},
+		NewZones: []string{"us-east-1b"},
+	}})
+	assert.Equal(t, "~ nodepool/default\n    topology.kubernetes.io/zone In\n      - us-east-1a\n        us-east-1b\n", out.String())
+
+	out.Reset()
+	writeDiff(&out, nil)
+	assert.Equal(t, "No node pool changes.\n", out.String())
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Notification kinds, one per outcome the team is told about
+const (
+	notifyShiftApplied     = "shift-applied"
+	notifyShiftRestored    = "shift-restored"
+	notifyShiftRefused     = "shift-refused"
+	notifyProcessingFailed = "processing-failed"
+
+	notifySubscriptionSilent  = "subscription-silent"
+	notifySubscriptionRemoved = "subscription-removed"
+)
+
+const (
+	// defaultNotifyRetries is how many times a failed delivery is retried
+	defaultNotifyRetries = 3
+
+	// defaultNotifyBackoff is the wait before the first retry; it doubles after each one
+	defaultNotifyBackoff = time.Second
+
+	// notifyTimeout bounds a single delivery attempt
+	notifyTimeout = 10 * time.Second
+)
+
+// Notification describes a shift action for the team
+type Notification struct {
+	Kind       string    `json:"kind"`
+	EventID    string    `json:"eventId"`
+	DetailType string    `json:"detailType"`
+	Source     string    `json:"source"`
+	ZoneID     string    `json:"zoneId"`
+	Region     string    `json:"region,omitempty"`
+	NodePools  []string  `json:"nodePools,omitempty"`
+	Refused    []string  `json:"refused,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	TopicArn   string    `json:"topicArn,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// defaultNotifyTemplates render each kind of notification unless overridden
+var defaultNotifyTemplates = map[string]string{
+	notifyShiftApplied:        `Zonal shift applied: zone {{.ZoneID}} removed from node pools {{join .NodePools ", "}} (event {{.EventID}}, {{.DetailType}}){{if .Refused}}. Refused by policy for {{join .Refused ", "}}{{end}}`,
+	notifyShiftRestored:       `Zonal shift restored: zone {{.ZoneID}} given back to node pools {{join .NodePools ", "}} (event {{.EventID}}, {{.DetailType}})`,
+	notifyShiftRefused:        `Zonal shift refused by policy: zone {{.ZoneID}} kept in node pools {{join .Refused ", "}} (event {{.EventID}}, {{.DetailType}})`,
+	notifyProcessingFailed:    `Zonal shift processing failed for zone {{.ZoneID}} (event {{.EventID}}, {{.DetailType}}): {{.Error}}`,
+	notifySubscriptionSilent:  `No SNS message from {{.TopicArn}}: {{.Error}}. Zonal shift events may not be arriving.`,
+	notifySubscriptionRemoved: `SNS subscription to {{.TopicArn}} was removed. Zonal shift events will no longer arrive.`,
+}
+
+// Sink delivers rendered notifications somewhere
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, n Notification, text string) error
+}
+
+// webhookSink posts the notification and its text as JSON to a URL
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Send(ctx context.Context, n Notification, text string) error {
+	return postJSON(ctx, s.client, s.url, struct {
+		Notification
+		Text string `json:"text"`
+	}{n, text})
+}
+
+// slackSink posts the text to a Slack incoming webhook
+type slackSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackSink) Name() string { return "slack" }
+
+func (s *slackSink) Send(ctx context.Context, n Notification, text string) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": text})
+}
+
+// postJSON posts body as JSON, failing on any non-2xx response
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// snsPublisher is the part of the SNS API the SNS sink uses
+type snsPublisher interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// snsSink publishes the text to an SNS topic, with the kind as a message attribute
+type snsSink struct {
+	client   snsPublisher
+	topicArn string
+}
+
+func (s *snsSink) Name() string { return "sns" }
+
+func (s *snsSink) Send(ctx context.Context, n Notification, text string) error {
+	_, err := s.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicArn),
+		Subject:  aws.String("Zonal shift: " + n.Kind),
+		Message:  aws.String(text),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"kind": {DataType: aws.String("String"), StringValue: aws.String(n.Kind)},
+		},
+	})
+	return err
+}
+
+// Notifier renders notifications and delivers them to every sink, retrying failed deliveries
+type Notifier struct {
+	Sinks []Sink
+	// Retries is how many times a failed delivery is retried
+	Retries int
+	// Backoff is the wait before the first retry; it doubles after each one
+	Backoff time.Duration
+
+	templates map[string]*template.Template
+	wg        sync.WaitGroup
+}
+
+// NewNotifier creates a Notifier, with overrides replacing the default template of their kind
+func NewNotifier(sinks []Sink, overrides map[string]string) (*Notifier, error) {
+	n := &Notifier{Sinks: sinks, Retries: defaultNotifyRetries, Backoff: defaultNotifyBackoff, templates: map[string]*template.Template{}}
+	for kind, text := range defaultNotifyTemplates {
+		if override, ok := overrides[kind]; ok {
+			text = override
+		}
+		tmpl, err := template.New(kind).Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", kind, err)
+		}
+		n.templates[kind] = tmpl
+	}
+	return n, nil
+}
+
+// Notify delivers the notification in the background. A nil Notifier does nothing.
+func (n *Notifier) Notify(notification Notification) {
+	if n == nil || len(n.Sinks) == 0 {
+		return
+	}
+	var text bytes.Buffer
+	if err := n.templates[notification.Kind].Execute(&text, notification); err != nil {
+		slog.Error("Failed to render notification", "kind", notification.Kind, "event_id", notification.EventID, "error", err)
+		return
+	}
+	for _, sink := range n.Sinks {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.deliver(sink, notification, text.String())
+		}()
+	}
+}
+
+// Wait blocks until every notification handed to Notify has been delivered or given up on
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.wg.Wait()
+	}
+}
+
+// deliver sends a notification to one sink, backing off between attempts
+func (n *Notifier) deliver(sink Sink, notification Notification, text string) {
+	backoff := n.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err := sink.Send(ctx, notification, text)
+		cancel()
+		notificationsTotal.WithLabelValues(sink.Name(), resultLabel(err)).Inc()
+		if err == nil {
+			slog.Debug("Sent notification", "sink", sink.Name(), "kind", notification.Kind, "event_id", notification.EventID)
+			return
+		}
+		if attempt > n.Retries {
+			slog.Error("Giving up on notification", "sink", sink.Name(), "kind", notification.Kind, "event_id", notification.EventID, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("Failed to send notification, will retry", "sink", sink.Name(), "kind", notification.Kind, "event_id", notification.EventID, "attempt", attempt, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notifier sends notifications for processed events; serve sets it when sinks
+// are configured, and the ZonalShiftPolicy watcher swaps it while requests read it
+var notifier atomic.Pointer[Notifier]
+
+var (
+	// retiredNotifiers are notifiers swapped out while they may still be delivering
+	retiredNotifiers   []*Notifier
+	retiredNotifiersMu sync.Mutex
+)
+
+// replaceNotifier makes n the notifier, keeping track of the one it replaces
+// until that has delivered everything it was given
+func replaceNotifier(n *Notifier) {
+	old := notifier.Swap(n)
+	if old == nil || old == n {
+		return
+	}
+	retiredNotifiersMu.Lock()
+	retiredNotifiers = append(retiredNotifiers, old)
+	retiredNotifiersMu.Unlock()
+	go func() {
+		old.Wait()
+		retiredNotifiersMu.Lock()
+		defer retiredNotifiersMu.Unlock()
+		if i := slices.Index(retiredNotifiers, old); i >= 0 {
+			retiredNotifiers = slices.Delete(retiredNotifiers, i, i+1)
+		}
+	}()
+}
+
+// waitForNotifications waits until the notifier, and every notifier it
+// replaced, has delivered everything it was given
+func waitForNotifications() {
+	retiredNotifiersMu.Lock()
+	pending := append(slices.Clone(retiredNotifiers), notifier.Load())
+	retiredNotifiersMu.Unlock()
+	for _, n := range pending {
+		n.Wait()
+	}
+}
+
+// newNotifierFromConfig sends to the configured targets. It returns nil when
+// no target is configured.
+func newNotifierFromConfig(ctx context.Context) (*Notifier, error) {
+	return newNotifierForTargets(ctx, appConfig.Notify.NotificationTargets)
+}
+
+// newNotifierForTargets creates a Notifier sending to the given targets, with
+// the configured retries and templates. It returns nil when there are no targets.
+func newNotifierForTargets(ctx context.Context, targets NotificationTargets) (*Notifier, error) {
+	client := &http.Client{Timeout: notifyTimeout}
+	var sinks []Sink
+	if targets.WebhookURL != "" {
+		sinks = append(sinks, &webhookSink{url: targets.WebhookURL, client: client})
+	}
+	if targets.SlackWebhookURL != "" {
+		sinks = append(sinks, &slackSink{url: targets.SlackWebhookURL, client: client})
+	}
+	if targets.SNSTopicARN != "" {
+		var opts []func(*config.LoadOptions) error
+		if region := appConfig.Region; region != "" {
+			opts = append(opts, config.WithRegion(region))
+		}
+		awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %v", err)
+		}
+		sinks = append(sinks, &snsSink{client: sns.NewFromConfig(awsCfg), topicArn: targets.SNSTopicARN})
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	n, err := NewNotifier(sinks, appConfig.Notify.Templates)
+	if err != nil {
+		return nil, err
+	}
+	n.Retries = appConfig.Notify.Retries
+	return n, nil
+}
+
+// notifyTemplateVariable is the environment variable overriding the template
+// of a notification kind, such as NOTIFY_TEMPLATE_SHIFT_APPLIED
+func notifyTemplateVariable(kind string) string {
+	return "NOTIFY_TEMPLATE_" + strings.ToUpper(strings.ReplaceAll(kind, "-", "_"))
+}
+
+// validate reports why the notification settings cannot be used
+func (c NotifyConfig) validate() []error {
+	var errs []error
+	if c.Retries < 0 {
+		errs = append(errs, fmt.Errorf("notify.retries must not be negative, got %d", c.Retries))
+	}
+	if c.SNSTopicARN != "" && !arn.IsARN(c.SNSTopicARN) {
+		errs = append(errs, fmt.Errorf("invalid notify.snsTopicARN %q", c.SNSTopicARN))
+	}
+	for kind := range c.Templates {
+		if _, ok := defaultNotifyTemplates[kind]; !ok {
+			errs = append(errs, fmt.Errorf("unknown notification kind %q in notify.templates", kind))
+		}
+	}
+	if _, err := NewNotifier(nil, c.Templates); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// notificationFor returns the notification for a processed event, if its outcome warrants one
+func notificationFor(event Event, record EventRecord) (Notification, bool) {
+	n := Notification{
+		EventID:    record.ID,
+		DetailType: record.DetailType,
+		Source:     record.Source,
+		ZoneID:     record.ZoneID,
+		Region:     event.Region,
+		NodePools:  record.NodePools,
+		Refused:    record.Refused,
+		Error:      record.Error,
+		Time:       record.CompletedAt,
+	}
+	switch record.Outcome {
+	case outcomeApplied:
+		n.Kind = notifyShiftApplied
+		if isShiftEnd(event) {
+			n.Kind = notifyShiftRestored
+		}
+	case outcomeRefused:
+		n.Kind = notifyShiftRefused
+	case outcomeFailed:
+		n.Kind = notifyProcessingFailed
+	default:
+		return Notification{}, false
+	}
+	return n, true
+}
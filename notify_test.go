@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingServer is a local webhook endpoint that fails its first failures requests
+type recordingServer struct {
+	mu       sync.Mutex
+	failures int
+	requests []map[string]interface{}
+}
+
+func (s *recordingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.requests = append(s.requests, body)
+}
+
+// fakeSNSPublisher records the messages published to it
+type fakeSNSPublisher struct {
+	mu        sync.Mutex
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNSPublisher) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, params)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestNotifierDeliversToSinks(t *testing.T) {
+	webhook := &recordingServer{failures: 2}
+	webhookServer := httptest.NewServer(webhook)
+	defer webhookServer.Close()
+	slack := &recordingServer{}
+	slackServer := httptest.NewServer(slack)
+	defer slackServer.Close()
+	publisher := &fakeSNSPublisher{}
+
+	n, err := NewNotifier([]Sink{
+		&webhookSink{url: webhookServer.URL, client: webhookServer.Client()},
+		&slackSink{url: slackServer.URL, client: slackServer.Client()},
+		&snsSink{client: publisher, topicArn: "arn:aws:sns:us-east-1:123456789012:zonal-shift"},
+	}, map[string]string{notifyShiftRestored: "{{.ZoneID}} is back"})
+	require.NoError(t, err)
+	n.Backoff = 0
+
+	n.Notify(Notification{Kind: notifyShiftApplied, EventID: "event-1", DetailType: "Autoshift In Progress", ZoneID: "use1-az1", NodePools: []string{"batch", "default"}})
+	n.Notify(Notification{Kind: notifyShiftRestored, EventID: "event-2", ZoneID: "use1-az1"})
+	n.Wait()
+
+	// The webhook failed twice and was retried
+	require.Len(t, webhook.requests, 2)
+	kinds := []interface{}{webhook.requests[0]["kind"], webhook.requests[1]["kind"]}
+	assert.ElementsMatch(t, []interface{}{notifyShiftApplied, notifyShiftRestored}, kinds)
+
+	require.Len(t, slack.requests, 2)
+	texts := []interface{}{slack.requests[0]["text"], slack.requests[1]["text"]}
+	assert.ElementsMatch(t, []interface{}{
+		"Zonal shift applied: zone use1-az1 removed from node pools batch, default (event event-1, Autoshift In Progress)",
+		"use1-az1 is back",
+	}, texts)
+
+	require.Len(t, publisher.published, 2)
+	assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:zonal-shift", aws.ToString(publisher.published[0].TopicArn))
+
+	_, err = NewNotifier(nil, map[string]string{notifyShiftApplied: "{{.Zone"})
+	assert.Error(t, err)
+}
+
+func TestNotifierGivesUpAfterRetries(t *testing.T) {
+	webhook := &recordingServer{failures: 10}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	n.Backoff = 0
+	n.Notify(Notification{Kind: notifyProcessingFailed, EventID: "event-1", Error: "boom"})
+	n.Wait()
+	assert.Empty(t, webhook.requests)
+	assert.Equal(t, 10-(defaultNotifyRetries+1), webhook.failures)
+}
+
+func TestEventOutcomesAreNotified(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("single", zoneRequirementOf("In", "us-east-1a")),
+	)
+	useTestProcessor(t, NewProcessor(client, testZones))
+
+	webhook := &recordingServer{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	_, err = updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	n.Wait()
+	_, err = updateKarpenterNodePool(context.Background(), testShiftEvent("Autoshift Completed"))
+	require.NoError(t, err)
+	n.Wait()
+
+	require.Len(t, webhook.requests, 2)
+	assert.Equal(t, notifyShiftApplied, webhook.requests[0]["kind"])
+	assert.Equal(t, []interface{}{"default"}, webhook.requests[0]["nodePools"])
+	assert.Equal(t, []interface{}{"single"}, webhook.requests[0]["refused"])
+	assert.Equal(t, notifyShiftRestored, webhook.requests[1]["kind"])
+}
+
+func TestNotifierSwapsWhileRequestsNotify(t *testing.T) {
+	useTestHTTPClient(t, http.StatusOK)
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+	useTestSubscriptions(t, time.Now())
+	webhook := &recordingServer{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	// The ZonalShiftPolicy watcher swaps the notifier while SNS requests use it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			processingMu.Lock()
+			notifier.Store(n)
+			processingMu.Unlock()
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, sendSNS(t, SNSMessage{Type: snsUnsubscribeConfirmation, SubscribeURL: testSubscribeURL}))
+	}
+	wg.Wait()
+	n.Wait()
+	assert.Len(t, webhook.requests, 5)
+}
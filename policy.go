@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// SafetyPolicy limits how far a shift may narrow a NodePool. It applies to
+// autoshift-driven and manual shifts alike.
+type SafetyPolicy struct {
+	// MinZones is the fewest zones a NodePool may be left able to use
+	MinZones int
+}
+
+// defaultSafetyPolicy never lets a shift take away a pool's last zone
+var defaultSafetyPolicy = SafetyPolicy{MinZones: 1}
+
+// check returns why leaving a pool with remaining usable zones is refused, or
+// an empty string if it is allowed
+func (p SafetyPolicy) check(remaining int) string {
+	if remaining < p.MinZones {
+		return fmt.Sprintf("would leave %d zone(s), policy requires at least %d", remaining, p.MinZones)
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafetyPolicyCheck(t *testing.T) {
+	policy := SafetyPolicy{MinZones: 2}
+	assert.Empty(t, policy.check(2))
+	assert.NotEmpty(t, policy.check(1))
+}
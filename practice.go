@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Modes of the practiceRuns setting
+const (
+	// practiceRunsIgnore records practice run events and does nothing else
+	practiceRunsIgnore = "ignore"
+	// practiceRunsObserve plans and reports the changes without making them
+	practiceRunsObserve = "observe"
+	// practiceRunsRehearse shifts NodePools like a real impairment and
+	// restores them when the practice run ends
+	practiceRunsRehearse = "rehearse"
+)
+
+// shiftTypePracticeRun is the ARC shift type of practice runs, also set on the
+// events that expire or cancel a rehearsed practice run's shift
+const shiftTypePracticeRun = "PRACTICE_RUN"
+
+// PracticeRunResult is the evidence kept for a practice run event
+type PracticeRunResult struct {
+	// Mode is the practiceRuns mode the event was handled in
+	Mode         string `json:"mode"`
+	ZonalShiftID string `json:"zonalShiftId,omitempty"`
+	// ARCOutcome is the practiceRunOutcome ARC reported, if any
+	ARCOutcome string `json:"arcOutcome,omitempty"`
+	// Passed is set when every managed NodePool could be moved away from the
+	// zone, or given it back, without a refusal or an error
+	Passed bool `json:"passed"`
+}
+
+var practiceRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "practice_runs_total",
+	Help:      "Practice run events handled, by detail type, mode and whether the cluster passed.",
+}, []string{"detail_type", "mode", "passed"})
+
+// isPracticeRun reports whether the event is about an ARC practice run
+func isPracticeRun(event Event) bool {
+	return isARCEvent(event) && (strings.HasPrefix(event.DetailType, "Practice Run ") ||
+		event.Detail.Metadata.ShiftType == shiftTypePracticeRun)
+}
+
+// isPracticeShift reports whether the event starts or ends the shift of a
+// rehearsed practice run rather than a real one
+func isPracticeShift(event Event) bool {
+	if isPracticeRun(event) {
+		return true
+	}
+	switch event.Source {
+	case expiryEventSource, manualEventSource:
+		return event.Detail.Metadata.ShiftType == shiftTypePracticeRun
+	}
+	return false
+}
+
+// shiftTypeOf is the shift type the events ending shift carry
+func shiftTypeOf(shift Shift) string {
+	if shift.Practice {
+		return shiftTypePracticeRun
+	}
+	return ""
+}
+
+// isPracticeRunEnd reports whether the event ends a practice run
+func isPracticeRunEnd(event Event) bool {
+	switch event.DetailType {
+	case detailPracticeRunSucceeded, detailPracticeRunInterrupted, detailPracticeRunFailed:
+		return isARCEvent(event)
+	}
+	return false
+}
+
+// observePracticeRun plans the changes for a practice run event and records
+// them, as evidence, without applying them
+func observePracticeRun(ctx context.Context, processor *Processor, event Event, record *EventRecord) error {
+	changes, err := processor.PlanEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+	var diff bytes.Buffer
+	writeDiff(&diff, changes)
+	slog.Info("Observed practice run, not changing node pools", "event_id", event.ID, "zone_id", event.Detail.Metadata.AwayFrom, "diff", diff.String())
+	if processor.Planned != nil {
+		processor.Planned(changes)
+	}
+
+	for _, change := range changes {
+		if change.Refused != "" {
+			record.Refused = append(record.Refused, change.Name)
+		} else {
+			record.NodePools = append(record.NodePools, change.Name)
+		}
+		var refused error
+		if change.Refused != "" {
+			refused = errors.New(change.Refused)
+		}
+		processor.auditChange(ctx, change, auditOperationObserve, refused)
+	}
+	record.Outcome = outcomeObserved
+	return nil
+}
+
+// recordPracticeRun attaches the practice run evidence to a processed event's record
+func recordPracticeRun(event Event, record *EventRecord, err error) {
+	result := &PracticeRunResult{
+		Mode:         appConfig.PracticeRuns,
+		ZonalShiftID: event.Detail.Metadata.ZonalShiftID,
+		ARCOutcome:   event.Detail.Metadata.PracticeRunOutcome,
+		Passed:       err == nil && len(record.Refused) == 0,
+	}
+	record.PracticeRun = result
+	practiceRunsTotal.WithLabelValues(event.DetailType, result.Mode, boolLabel(result.Passed)).Inc()
+	slog.Info("Practice run handled", "event_id", event.ID, "zone_id", event.Detail.Metadata.AwayFrom, "detail_type", event.DetailType,
+		"mode", result.Mode, "passed", result.Passed, "arc_outcome", result.ARCOutcome, "nodepools", record.NodePools, "refused", record.Refused)
+}
+
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPracticeRunEvent(detailType, id string) Event {
+	event := testShiftEvent(detailType)
+	event.ID, event.Source = id, "aws.arc-zonal-shift"
+	event.Detail.Version = "0.0.1"
+	event.Detail.Metadata.ShiftType = "PRACTICE_RUN"
+	event.Detail.Metadata.ZonalShiftID = "practice-1"
+	event.Detail.Metadata.ExpiryTime = time.Now().Add(30 * time.Minute).UTC().Format(time.RFC3339)
+	return event
+}
+
+func TestPracticeRunIgnored(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsIgnore })
+
+	record, err := processReceivedEvent(context.Background(), testPracticeRunEvent(detailPracticeRunStarted, "practice-start"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeIgnored, record.Outcome)
+	assert.Nil(t, record.PracticeRun)
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+	assert.Empty(t, store.ActiveShifts())
+}
+
+func TestPracticeRunObserved(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")),
+		newTestNodePool("pinned", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+	)
+	processor := NewProcessor(client, testZones)
+	processor.Policy.MinZones = 2
+	l, err := newFileAuditLog(filepath.Join(t.TempDir(), "audit.log"), defaultAuditMaxSize)
+	require.NoError(t, err)
+	processor.Audit = l
+	useTestProcessor(t, processor)
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsObserve })
+
+	ctx := withPrincipal(context.Background(), "events")
+	record, err := processReceivedEvent(ctx, testPracticeRunEvent(detailPracticeRunStarted, "practice-start"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeObserved, record.Outcome)
+	assert.Equal(t, []string{"default"}, record.NodePools)
+	assert.Equal(t, []string{"pinned"}, record.Refused)
+	require.NotNil(t, record.PracticeRun)
+	assert.Equal(t, PracticeRunResult{Mode: practiceRunsObserve, ZonalShiftID: "practice-1", Passed: false}, *record.PracticeRun)
+
+	// Nothing changes, but the plan is kept as evidence
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+	assert.Empty(t, store.ActiveShifts())
+	records, err := l.Query(context.Background(), AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for _, r := range records {
+		assert.Equal(t, auditOperationObserve, r.Operation)
+		assert.Equal(t, "practice-start", r.EventID)
+		assert.Equal(t, "events", r.Principal)
+		// The refused change records why
+		assert.Equal(t, r.NodePool == "pinned", r.Error != "", r.NodePool)
+	}
+	assert.Equal(t, record, store.RecentEvents()[0])
+}
+
+func TestPracticeRunRehearsed(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsRehearse })
+
+	start := testPracticeRunEvent(detailPracticeRunStarted, "practice-start")
+	record, err := processReceivedEvent(context.Background(), start, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeApplied, record.Outcome)
+	require.NotNil(t, record.PracticeRun)
+	assert.True(t, record.PracticeRun.Passed)
+	assert.Equal(t, []string{"us-east-1a"}, getTestNodePool(t, client, "default").removedZones())
+
+	// The shift ends by itself at the end of the practice run if no end event arrives
+	shifts := store.ActiveShifts()
+	require.Len(t, shifts, 1)
+	require.NotNil(t, shifts[0].ExpiresAt)
+	assert.Equal(t, start.Detail.Metadata.ExpiryTime, shifts[0].ExpiresAt.Format(time.RFC3339))
+
+	end := testPracticeRunEvent(detailPracticeRunSucceeded, "practice-end")
+	end.Detail.Metadata.PracticeRunOutcome = "SUCCEEDED"
+	record, err = processReceivedEvent(context.Background(), end, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeApplied, record.Outcome)
+	assert.Equal(t, PracticeRunResult{Mode: practiceRunsRehearse, ZonalShiftID: "practice-1", ARCOutcome: "SUCCEEDED", Passed: true}, *record.PracticeRun)
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+	assert.Empty(t, store.ActiveShifts())
+}
+
+func TestIsPracticeRun(t *testing.T) {
+	assert.True(t, isPracticeRun(testPracticeRunEvent(detailPracticeRunFailed, "1")))
+	assert.True(t, isShiftEnd(testPracticeRunEvent(detailPracticeRunInterrupted, "1")))
+	assert.False(t, isShiftEnd(testPracticeRunEvent(detailPracticeRunStarted, "1")))
+
+	autoshift := testShiftEvent(detailAutoshiftInProgress)
+	autoshift.Source = "aws.arc-zonal-shift"
+	assert.False(t, isPracticeRun(autoshift))
+	// Only ARC says what a practice run is
+	other := testShiftEvent(detailPracticeRunStarted)
+	other.Source = "example.com"
+	assert.False(t, isPracticeRun(other))
+}
+
+func TestAutoshiftDuringRehearsal(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsRehearse })
+	ctx := context.Background()
+
+	_, err := processReceivedEvent(ctx, testPracticeRunEvent(detailPracticeRunStarted, "practice-start"), time.Now())
+	require.NoError(t, err)
+
+	// A real autoshift for the same zone gets its own shift
+	autoshift := testShiftEvent(detailAutoshiftInProgress)
+	autoshift.ID, autoshift.Source = "autoshift-start", "aws.arc-zonal-shift"
+	_, err = processReceivedEvent(ctx, autoshift, time.Now())
+	require.NoError(t, err)
+	shifts := store.ActiveShifts()
+	require.Len(t, shifts, 2)
+	practice, ok := store.ShiftForZone("use1-az1", true)
+	require.True(t, ok)
+	assert.Equal(t, "practice-start", practice.ID)
+	autoshiftShift, ok := store.ShiftForZone("use1-az1", false)
+	require.True(t, ok)
+	assert.Equal(t, "autoshift-start", autoshiftShift.ID)
+	assert.False(t, autoshiftShift.Practice)
+
+	// ARC interrupts the practice run, but the zone stays away while the autoshift lasts
+	record, err := processReceivedEvent(ctx, testPracticeRunEvent(detailPracticeRunInterrupted, "practice-end"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeNoChanges, record.Outcome)
+	assert.Equal(t, "shift autoshift-start for the zone is still active", record.Reason)
+	assert.Equal(t, []string{"us-east-1a"}, getTestNodePool(t, client, "default").removedZones())
+	shifts = store.ActiveShifts()
+	require.Len(t, shifts, 1)
+	assert.Equal(t, "autoshift-start", shifts[0].ID)
+
+	// The zone only comes back when the autoshift ends
+	completed := testShiftEvent(detailAutoshiftCompleted)
+	completed.ID, completed.Source = "autoshift-end", "aws.arc-zonal-shift"
+	record, err = processReceivedEvent(ctx, completed, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeApplied, record.Outcome)
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+	assert.Empty(t, store.ActiveShifts())
+}
+
+func TestRealShiftEndDuringRehearsal(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.PracticeRuns = practiceRunsRehearse })
+	ctx := context.Background()
+
+	autoshift := testShiftEvent(detailAutoshiftInProgress)
+	autoshift.ID, autoshift.Source = "autoshift-start", "aws.arc-zonal-shift"
+	_, err := processReceivedEvent(ctx, autoshift, time.Now())
+	require.NoError(t, err)
+	_, err = processReceivedEvent(ctx, testPracticeRunEvent(detailPracticeRunStarted, "practice-start"), time.Now())
+	require.NoError(t, err)
+
+	// Ending the autoshift leaves the zone away for the rest of the rehearsal
+	completed := testShiftEvent(detailAutoshiftCompleted)
+	completed.ID, completed.Source = "autoshift-end", "aws.arc-zonal-shift"
+	record, err := processReceivedEvent(ctx, completed, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeNoChanges, record.Outcome)
+	assert.Equal(t, []string{"us-east-1a"}, getTestNodePool(t, client, "default").removedZones())
+	shift, ok := store.ShiftForZone("use1-az1", true)
+	require.True(t, ok)
+
+	// Expiring the practice shift ends it, not a real one, and restores the zone
+	(&ExpiryReconciler{now: func() time.Time { return shift.ExpiresAt.Add(time.Second) }}).reconcile(ctx)
+	assert.Empty(t, getTestNodePool(t, client, "default").removedZones())
+	assert.Empty(t, store.ActiveShifts())
+}
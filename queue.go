@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// defaultQueuePollInterval is how often the leader looks for events
+	// enqueued by other replicas
+	defaultQueuePollInterval = 2 * time.Second
+
+	// stateConfigMapName is the ConfigMap holding the queue and active shifts
+	stateConfigMapName = "zonal-shift-state"
+)
+
+// queuedEvent is an event waiting to be processed
+type queuedEvent struct {
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	Event      Event     `json:"event"`
+	// Principal is the authenticated caller that queued a manual event
+	Principal string `json:"principal,omitempty"`
+}
+
+// EventQueue hands events received by any replica to the one that processes them
+type EventQueue interface {
+	Enqueue(ctx context.Context, event Event) error
+	// Pending returns the queued events, oldest first
+	Pending(ctx context.Context) ([]queuedEvent, error)
+	Done(ctx context.Context, id string) error
+}
+
+// ShiftBackend persists active shifts so a restarted or newly elected replica
+// can carry on with them
+type ShiftBackend interface {
+	LoadShifts(ctx context.Context) ([]Shift, error)
+	SaveShifts(ctx context.Context, shifts []Shift) error
+}
+
+// eventQueue receives events from the handlers; serve replaces it when
+// STATE_BACKEND=configmap
+var eventQueue EventQueue = newMemoryQueue()
+
+// queueWake lets a local enqueue start the worker without waiting for the next poll
+var queueWake = make(chan struct{}, 1)
+
+// notifyWorker wakes the event worker if it is idle
+func notifyWorker() {
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// memoryQueue is an EventQueue for a single replica
+type memoryQueue struct {
+	mu     sync.Mutex
+	events []queuedEvent
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{}
+}
+
+func (q *memoryQueue) Enqueue(ctx context.Context, event Event) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, queued := range q.events {
+		if queued.Event.ID == event.ID {
+			return nil
+		}
+	}
+	q.events = append(q.events, queuedEvent{EnqueuedAt: time.Now(), Event: event, Principal: principalFrom(ctx)})
+	return nil
+}
+
+func (q *memoryQueue) Pending(ctx context.Context) ([]queuedEvent, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]queuedEvent(nil), q.events...), nil
+}
+
+func (q *memoryQueue) Done(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.events {
+		if queued.Event.ID == id {
+			q.events = append(q.events[:i], q.events[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// restore puts back events checkpointed by a previous run, ahead of any queued since
+func (q *memoryQueue) restore(events []queuedEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	restored := make([]queuedEvent, 0, len(events)+len(q.events))
+	for _, queued := range events {
+		if !slices.ContainsFunc(q.events, func(e queuedEvent) bool { return e.Event.ID == queued.Event.ID }) {
+			restored = append(restored, queued)
+		}
+	}
+	q.events = append(restored, q.events...)
+}
+
+// configMapState keeps pending events and active shifts in a ConfigMap, so
+// any replica can enqueue work and a new leader picks up where the last one
+// stopped. Each pending event is its own key; active shifts are one key.
+type configMapState struct {
+	client typedcorev1.ConfigMapInterface
+	name   string
+}
+
+const (
+	configMapEventPrefix     = "event."
+	configMapShiftsKey       = "shifts"
+	configMapSignaturePrefix = "signature."
+)
+
+// configMapEventKey is the key of a pending event. Event IDs come from
+// callers and may hold characters a ConfigMap key cannot, so they are hashed.
+func configMapEventKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return configMapEventPrefix + hex.EncodeToString(sum[:])
+}
+
+func newConfigMapState(clientset kubernetes.Interface, namespace string) *configMapState {
+	return &configMapState{client: clientset.CoreV1().ConfigMaps(namespace), name: stateConfigMapName}
+}
+
+// get returns the state ConfigMap and whether it exists, or an empty one if it does not exist yet
+func (c *configMapState) get(ctx context.Context) (*corev1.ConfigMap, bool, error) {
+	cm, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: c.name}}, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get ConfigMap %s: %v", c.name, err)
+	}
+	return cm, true, nil
+}
+
+// update applies mutate to the ConfigMap data, retrying on conflicting writes from other replicas
+func (c *configMapState) update(ctx context.Context, mutate func(data map[string]string)) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cm, exists, err := c.get(ctx)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		mutate(cm.Data)
+		if !exists {
+			_, err = c.client.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// Another replica created it first, retry as an update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), c.name, err)
+			}
+			return err
+		}
+		_, err = c.client.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (c *configMapState) Enqueue(ctx context.Context, event Event) error {
+	value, err := json.Marshal(queuedEvent{EnqueuedAt: time.Now(), Event: event, Principal: principalFrom(ctx)})
+	if err != nil {
+		return err
+	}
+	key := configMapEventKey(event.ID)
+	return c.update(ctx, func(data map[string]string) {
+		if _, ok := data[key]; !ok {
+			data[key] = string(value)
+		}
+	})
+}
+
+func (c *configMapState) Pending(ctx context.Context) ([]queuedEvent, error) {
+	cm, _, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var queued []queuedEvent
+	for key, value := range cm.Data {
+		if !strings.HasPrefix(key, configMapEventPrefix) {
+			continue
+		}
+		var q queuedEvent
+		if err := json.Unmarshal([]byte(value), &q); err != nil {
+			slog.Warn("Skipping unreadable queued event", "key", key, "error", err)
+			continue
+		}
+		queued = append(queued, q)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].EnqueuedAt.Before(queued[j].EnqueuedAt) })
+	return queued, nil
+}
+
+func (c *configMapState) Done(ctx context.Context, id string) error {
+	return c.update(ctx, func(data map[string]string) {
+		delete(data, configMapEventKey(id))
+		// Events queued by earlier versions are keyed by their plain ID
+		delete(data, configMapEventPrefix+id)
+	})
+}
+
+func (c *configMapState) LoadShifts(ctx context.Context) ([]Shift, error) {
+	cm, _, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var shifts []Shift
+	if value := cm.Data[configMapShiftsKey]; value != "" {
+		if err := json.Unmarshal([]byte(value), &shifts); err != nil {
+			return nil, fmt.Errorf("failed to parse stored shifts: %v", err)
+		}
+	}
+	return shifts, nil
+}
+
+func (c *configMapState) SaveShifts(ctx context.Context, shifts []Shift) error {
+	value, err := json.Marshal(shifts)
+	if err != nil {
+		return err
+	}
+	return c.update(ctx, func(data map[string]string) {
+		data[configMapShiftsKey] = string(value)
+	})
+}
+
+// use records a direct event signature as used until expires, dropping those
+// that have expired, so every replica refuses a replayed request
+func (c *configMapState) use(ctx context.Context, signature string, expires, now time.Time) (bool, error) {
+	// Signatures are "sha256=" and hex, and = cannot appear in a key
+	key := configMapSignaturePrefix + strings.TrimPrefix(signature, "sha256=")
+	var fresh bool
+	err := c.update(ctx, func(data map[string]string) {
+		for k, value := range data {
+			if !strings.HasPrefix(k, configMapSignaturePrefix) {
+				continue
+			}
+			if at, err := time.Parse(time.RFC3339, value); err != nil || at.Before(now) {
+				delete(data, k)
+			}
+		}
+		_, used := data[key]
+		if fresh = !used; fresh {
+			data[key] = expires.UTC().Format(time.RFC3339)
+		}
+	})
+	return fresh, err
+}
+
+// setupStateBackend selects where queued events and active shifts are kept,
+// based on the stateBackend setting: "memory" (the default) or "configmap". With
+// ZONAL_SHIFT_RESOURCES=true active shifts are also kept as ZonalShift objects,
+// which a single replica then reloads them from.
+func setupStateBackend(k8sConfig *rest.Config) error {
+	var backends multiShiftBackend
+	switch backend := appConfig.StateBackend; backend {
+	case "memory":
+	case "configmap":
+		if k8sConfig == nil {
+			return errors.New("stateBackend configmap requires running in a cluster")
+		}
+		clientset, err := kubernetes.NewForConfig(k8sConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create clientset: %v", err)
+		}
+		state := newConfigMapState(clientset, podNamespace())
+		eventQueue = state
+		usedSignatures = state
+		backends = append(backends, state)
+		slog.Info("Keeping state in ConfigMap", "namespace", podNamespace(), "name", stateConfigMapName)
+	default:
+		return fmt.Errorf("unknown stateBackend %q", backend)
+	}
+
+	if appConfig.ZonalShifts.Enabled {
+		if k8sConfig == nil {
+			return errors.New("zonalShifts.enabled requires running in a cluster")
+		}
+		client, err := newDynamicClient(k8sConfig)
+		if err != nil {
+			return err
+		}
+		zonalShifts = newZonalShiftBackend(client, appConfig.ZonalShifts.Retention.Duration)
+		backends = append(backends, zonalShifts)
+		slog.Info("Recording shifts as ZonalShift objects")
+	}
+
+	switch len(backends) {
+	case 0:
+	case 1:
+		store.SetBackend(backends[0])
+	default:
+		store.SetBackend(backends)
+	}
+	return nil
+}
+
+// multiShiftBackend saves to every backend and loads from the first
+type multiShiftBackend []ShiftBackend
+
+func (m multiShiftBackend) LoadShifts(ctx context.Context) ([]Shift, error) {
+	return m[0].LoadShifts(ctx)
+}
+
+func (m multiShiftBackend) SaveShifts(ctx context.Context, shifts []Shift) error {
+	var errs []error
+	for _, backend := range m {
+		errs = append(errs, backend.SaveShifts(ctx, shifts))
+	}
+	return errors.Join(errs...)
+}
+
+// podNamespace returns the namespace the service runs in
+func podNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(namespace))
+	}
+	return metav1.NamespaceDefault
+}
+
+// drainRequest asks the event worker for a last pass over the queue before it stops
+type drainRequest struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
+// drainRequests is read by the running event worker, if any
+var drainRequests = make(chan drainRequest)
+
+// runEventWorker processes queued events until ctx is done or it is asked to
+// drain the queue. Only the leader runs it.
+func runEventWorker(ctx context.Context, queue EventQueue, interval time.Duration) {
+	slog.Info("Processing queued events", "poll_interval", interval)
+	attempts := map[string]int{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		drainQueue(ctx, queue, attempts)
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-drainRequests:
+			slog.Info("Draining queued events before stopping")
+			drainQueue(req.ctx, queue, attempts)
+			close(req.done)
+			return
+		case <-queueWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// finishQueuedEvents waits for the event worker to finish the event it is
+// processing and the ones queued after it, then stop. Events still queued when
+// ctx is done are left in the queue. It returns at once if no worker is running.
+func finishQueuedEvents(ctx context.Context) error {
+	if !leading.Load() {
+		return nil
+	}
+	req := drainRequest{ctx: ctx, done: make(chan struct{})}
+	select {
+	case drainRequests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-req.done:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryKey is the context key marking an event the queue processes again if it fails
+type retryKey struct{}
+
+// withRetry returns ctx marked as processing an event that is retried if it fails
+func withRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// willRetry reports whether ctx processes an event that is retried if it fails
+func willRetry(ctx context.Context) bool {
+	retry, _ := ctx.Value(retryKey{}).(bool)
+	return retry
+}
+
+// drainQueue processes pending events in order. An event stays queued
+// until it has been processed, so a leader that stops midway leaves it for
+// the next one; processing is idempotent, so repeating it is safe.
+func drainQueue(ctx context.Context, queue EventQueue, attempts map[string]int) {
+	pending, err := queue.Pending(ctx)
+	if err != nil {
+		slog.Error("Failed to read queued events", "error", err)
+		return
+	}
+	for _, queued := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		event := queued.Event
+		eventCtx := withPrincipal(ctx, queued.Principal)
+		if attempts[event.ID]+1 < appConfig.Queue.MaxAttempts {
+			eventCtx = withRetry(eventCtx)
+		}
+		if _, err := processReceivedEvent(eventCtx, event, queued.EnqueuedAt); err != nil {
+			attempts[event.ID]++
+			if attempts[event.ID] < appConfig.Queue.MaxAttempts {
+				// Stop here so later events, such as the end of this shift, are not applied first
+				slog.Warn("Event failed, will retry", "event_id", event.ID, "attempt", attempts[event.ID], "max_attempts", appConfig.Queue.MaxAttempts, "error", err)
+				return
+			}
+			slog.Error("Event failed too many times, dropping it", "event_id", event.ID, "attempts", appConfig.Queue.MaxAttempts, "error", err)
+		}
+		delete(attempts, event.ID)
+		if err := queue.Done(ctx, event.ID); err != nil {
+			slog.Error("Failed to remove event from the queue", "event_id", event.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStateQueuesEvents(t *testing.T) {
+	ctx := context.Background()
+	state := newConfigMapState(fake.NewSimpleClientset(), "default")
+
+	start, end := testShiftEvent("Autoshift In Progress"), testShiftEvent("Autoshift Completed")
+	start.ID, end.ID = "start", "end"
+	require.NoError(t, state.Enqueue(ctx, start))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, state.Enqueue(ctx, end))
+	require.NoError(t, state.Enqueue(ctx, start))
+
+	pending, err := state.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "start", pending[0].Event.ID)
+	assert.Equal(t, "end", pending[1].Event.ID)
+
+	require.NoError(t, state.Done(ctx, "start"))
+	pending, err = state.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "end", pending[0].Event.ID)
+}
+
+func TestConfigMapStateKeysEventsByHash(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	state := newConfigMapState(clientset, "default")
+
+	// Event IDs are chosen by callers and need not be valid ConfigMap keys
+	event := testShiftEvent("Autoshift In Progress")
+	event.ID = "incident-bot/inc 7:éé"
+	require.NoError(t, state.Enqueue(ctx, event))
+	cm, err := clientset.CoreV1().ConfigMaps("default").Get(ctx, stateConfigMapName, metav1.GetOptions{})
+	require.NoError(t, err)
+	for key := range cm.Data {
+		assert.Empty(t, validation.IsConfigMapKey(key), key)
+	}
+	pending, err := state.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, event.ID, pending[0].Event.ID)
+
+	// An event queued under its plain ID by an earlier version is still removed once done
+	cm.Data[configMapEventPrefix+"legacy"] = `{"event": {"id": "legacy"}}`
+	_, err = clientset.CoreV1().ConfigMaps("default").Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, state.Done(ctx, event.ID))
+	require.NoError(t, state.Done(ctx, "legacy"))
+	pending, err = state.Pending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestConfigMapStateSharesShifts(t *testing.T) {
+	ctx := context.Background()
+	state := newConfigMapState(fake.NewSimpleClientset(), "default")
+
+	leader := NewShiftStore()
+	leader.SetBackend(state)
+	leader.StartShift(Shift{ID: "a", ZoneID: "use1-az1"})
+	leader.StartShift(Shift{ID: "b", ZoneID: "use1-az2"})
+	leader.EndShift("use1-az1", false)
+
+	follower := NewShiftStore()
+	follower.SetBackend(state)
+	require.NoError(t, follower.Load(ctx))
+	shifts := follower.ActiveShifts()
+	require.Len(t, shifts, 1)
+	assert.Equal(t, "use1-az2", shifts[0].ZoneID)
+}
+
+func TestDrainQueueKeepsOrderOnFailure(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	processor := newProcessor
+
+	queue := newMemoryQueue()
+	start, end := testShiftEvent("Autoshift In Progress"), testShiftEvent("Autoshift Completed")
+	start.ID, end.ID = "start", "end"
+	require.NoError(t, queue.Enqueue(context.Background(), start))
+	require.NoError(t, queue.Enqueue(context.Background(), end))
+
+	// The first event fails, so the end of the shift must wait behind it
+	newProcessor = func() (*Processor, error) { return nil, errors.New("cluster unavailable") }
+	attempts := map[string]int{}
+	drainQueue(context.Background(), queue, attempts)
+	pending, _ := queue.Pending(context.Background())
+	assert.Len(t, pending, 2)
+	assert.Equal(t, 1, attempts["start"])
+
+	newProcessor = processor
+	drainQueue(context.Background(), queue, attempts)
+	pending, _ = queue.Pending(context.Background())
+	assert.Empty(t, pending)
+	assert.Empty(t, attempts)
+	assert.Empty(t, store.ActiveShifts())
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+
+	events := store.RecentEvents()
+	require.Len(t, events, 3)
+	assert.Equal(t, "end", events[0].ID)
+	assert.Equal(t, "start", events[1].ID)
+	assert.Equal(t, outcomeFailed, events[2].Outcome)
+}
+
+func TestDrainQueueNotifiesOnlyTheLastFailure(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	useTestConfig(t, func(c *Config) { c.Queue.MaxAttempts = 3 })
+	webhook := &recordingServer{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	queue := newMemoryQueue()
+	event := testShiftEvent("Autoshift In Progress")
+	event.ID = "failing"
+	require.NoError(t, queue.Enqueue(context.Background(), event))
+	newProcessor = func() (*Processor, error) { return nil, errors.New("cluster unavailable") }
+
+	// Attempts the queue retries are not notified
+	attempts := map[string]int{}
+	for range 2 {
+		drainQueue(context.Background(), queue, attempts)
+	}
+	n.Wait()
+	assert.Empty(t, webhook.requests)
+
+	// The last attempt drops the event and notifies its failure
+	drainQueue(context.Background(), queue, attempts)
+	n.Wait()
+	pending, _ := queue.Pending(context.Background())
+	assert.Empty(t, pending)
+	require.Len(t, webhook.requests, 1)
+	assert.Equal(t, notifyProcessingFailed, webhook.requests[0]["kind"])
+	assert.Len(t, store.RecentEvents(), 3)
+}
+
+// hangingZoneResolver blocks until its caller gives up, like an unresponsive EC2 endpoint
+type hangingZoneResolver struct{}
+
+func (hangingZoneResolver) Zones(ctx context.Context, region string) ([]AvailabilityZone, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDrainQueueTimesOutSlowEvents(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, hangingZoneResolver{}))
+	useTestConfig(t, func(c *Config) { c.EventTimeout.Duration = 50 * time.Millisecond })
+
+	queue := newMemoryQueue()
+	event := testShiftEvent("Autoshift In Progress")
+	event.ID = "slow"
+	require.NoError(t, queue.Enqueue(context.Background(), event))
+
+	// The event fails once its deadline passes and stays queued for a retry
+	attempts := map[string]int{}
+	drainQueue(context.Background(), queue, attempts)
+	assert.Equal(t, 1, attempts["slow"])
+	pending, _ := queue.Pending(context.Background())
+	assert.Len(t, pending, 1)
+
+	events := store.RecentEvents()
+	require.Len(t, events, 1)
+	assert.Equal(t, outcomeFailed, events[0].Outcome)
+	assert.Contains(t, events[0].Error, "timed out after 50ms")
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+}
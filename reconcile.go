@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// defaultReconcileInterval is how often every NodePool is checked even
+	// when nothing about it has changed
+	defaultReconcileInterval = 5 * time.Minute
+
+	// eventComponent is the source recorded on Kubernetes Events
+	eventComponent = "zonal-shift"
+
+	// Kubernetes Event reasons for changes made in answer to events
+	reasonShiftApplied  = "ZonalShiftApplied"
+	reasonShiftRestored = "ZonalShiftRestored"
+
+	// Kubernetes Event reasons for drift found by the reconciler
+	reasonDriftCorrected = "ZonalShiftDriftCorrected"
+	reasonStaleZone      = "ZonalShiftStaleZone"
+)
+
+// newEventRecorder creates a recorder that writes Kubernetes Events through the API server
+func newEventRecorder(k8sConfig *rest.Config) (record.EventRecorder, error) {
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %v", err)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}), nil
+}
+
+// NodePoolReconciler keeps managed NodePools at their original zones, the
+// current zones plus those recorded as removed, minus the zones of active
+// shifts. It removes impaired zones from pools edited or created mid-shift and
+// gives back recorded zones whose shift is no longer active.
+//
+// Zones are only given back when shifts are kept in a backend that outlives
+// the process. With shifts in memory alone, a restarted server cannot tell a
+// finished shift from one it has not heard about, so such zones are reported
+// instead and restored by end events, expiry or the restore subcommand.
+type NodePoolReconciler struct {
+	processor *Processor
+	recorder  record.EventRecorder
+	informer  cache.SharedIndexInformer
+	queue     workqueue.TypedRateLimitingInterface[string]
+
+	// configure, if set, refreshes the processor's settings before each
+	// reconcile, so a changed ZonalShiftPolicy applies without a restart
+	configure func(*Processor)
+}
+
+// NewNodePoolReconciler watches every NodePool, reconciling those the processor
+// manages and relisting all of them every resync interval
+func NewNodePoolReconciler(processor *Processor, recorder record.EventRecorder, resync time.Duration) *NodePoolReconciler {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(processor.client, resync)
+	r := &NodePoolReconciler{
+		processor: processor,
+		recorder:  recorder,
+		informer:  factory.ForResource(nodePoolGVR).Informer(),
+		queue:     workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+	}
+	r.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueue,
+		UpdateFunc: func(_, obj interface{}) { r.enqueue(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+				excludedZones.DeleteLabelValues(key)
+			}
+		},
+	})
+	return r
+}
+
+func (r *NodePoolReconciler) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		slog.Error("Failed to get key for object", "error", err)
+		return
+	}
+	r.queue.Add(key)
+}
+
+// Run starts the informer and processes the queue until ctx is done
+func (r *NodePoolReconciler) Run(ctx context.Context) {
+	defer r.queue.ShutDown()
+
+	go r.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), r.informer.HasSynced) {
+		slog.Error("Failed to sync node pool informer")
+		return
+	}
+	slog.Info("Node pool informer synced, reconciling")
+
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for r.processNext(ctx) {
+		}
+	}, time.Second)
+	<-ctx.Done()
+}
+
+// processNext handles a single queued NodePool, returning false when the queue is shut down
+func (r *NodePoolReconciler) processNext(ctx context.Context) bool {
+	key, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	// A hung API call fails the key and retries it rather than stalling the queue
+	ctx, cancel := context.WithTimeout(ctx, appConfig.EventTimeout.Duration)
+	defer cancel()
+	if err := r.reconcile(ctx, key); err != nil {
+		slog.Warn("Failed to reconcile node pool, retrying", "nodepool", key, "error", err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+// reconcile moves one NodePool towards its original zones minus the zones of
+// active shifts. Impaired zones are removed first; the update requeues the
+// pool, and zones to give back are restored on the next pass.
+func (r *NodePoolReconciler) reconcile(ctx context.Context, key string) error {
+	item, exists, err := r.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	original := item.(*unstructured.Unstructured)
+	if r.configure != nil {
+		r.configure(r.processor)
+	}
+	if managed, err := r.processor.manages(original); err != nil || !managed {
+		return err
+	}
+
+	// Plan the removal of every impaired zone on top of each other, then write once
+	obj := original.DeepCopy()
+	var combined *NodePoolChange
+	var removed []string
+	impaired := map[string]bool{}
+	for _, shift := range store.ActiveShifts() {
+		impaired[shift.Zone] = true
+
+		zones, err := r.processor.regionZones(ctx, shift.Region)
+		if err != nil {
+			return err
+		}
+		change, err := r.processor.planPoolShift(obj, shift.Zone, shift.ID, len(zones))
+		if err != nil {
+			return err
+		}
+		if change == nil || change.Refused != "" {
+			continue
+		}
+		if combined == nil {
+			combined = change
+		} else {
+			combined.NewZones, combined.object = change.NewZones, change.object
+		}
+		obj = change.object
+		removed = append(removed, shift.Zone)
+	}
+
+	if combined != nil {
+		combined.Source = reconcilerActor
+		slog.Info("Node pool can use impaired zones, removing them", "nodepool", combined.Name, "zones", removed)
+		if err := r.processor.Apply(ctx, []NodePoolChange{*combined}); err != nil {
+			return err
+		}
+		r.recorder.Eventf(original, corev1.EventTypeWarning, reasonDriftCorrected,
+			"Removed impaired zones %v, zones %v -> %v", removed, combined.OldZones, combined.NewZones)
+		return nil
+	}
+
+	pool, err := decodeNodePool(obj)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, zone := range pool.removedZones() {
+		if !impaired[zone] {
+			stale = append(stale, zone)
+		}
+	}
+	if len(stale) > 0 && !store.Durable() {
+		for _, zone := range stale {
+			r.recorder.Eventf(original, corev1.EventTypeWarning, reasonStaleZone,
+				"Zone %s is recorded as removed but no shift for it is active", zone)
+		}
+		stale = nil
+	}
+	for _, zone := range stale {
+		change, err := planPoolRestore(obj, zone)
+		if err != nil {
+			return err
+		}
+		if change == nil {
+			continue
+		}
+		if combined == nil {
+			combined = change
+		} else {
+			combined.NewZones, combined.object = change.NewZones, change.object
+		}
+		obj = change.object
+	}
+	if combined != nil {
+		combined.Source = reconcilerActor
+		slog.Info("Node pool is missing zones no shift is active for, restoring them", "nodepool", combined.Name, "zones", stale)
+		if err := r.processor.Apply(ctx, []NodePoolChange{*combined}); err != nil {
+			return err
+		}
+		r.recorder.Eventf(original, corev1.EventTypeNormal, reasonDriftCorrected,
+			"Restored zones %v no shift is active for, zones %v -> %v", stale, combined.OldZones, combined.NewZones)
+		if pool, err = decodeNodePool(obj); err != nil {
+			return err
+		}
+	}
+	excludedZones.WithLabelValues(pool.Metadata.Name).Set(float64(len(pool.removedZones())))
+	return nil
+}
+
+// runNodePoolReconciler starts the reconciler against the cluster the service runs in
+func runNodePoolReconciler(ctx context.Context, k8sConfig *rest.Config) error {
+	processor, err := newProcessor()
+	if err != nil {
+		return err
+	}
+	recorder := processor.Recorder
+	if recorder == nil {
+		if recorder, err = newEventRecorder(k8sConfig); err != nil {
+			return err
+		}
+	}
+	r := NewNodePoolReconciler(processor, recorder, appConfig.ReconcileInterval.Duration)
+	r.configure = configureProcessor
+	r.Run(ctx)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNodePoolReconcilerRemovesImpairedZone(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("stale", zoneRequirementOf("In", "us-east-1b")),
+	)
+	processor := NewProcessor(client, testZones)
+	useTestProcessor(t, processor)
+	store.StartShift(Shift{ID: "shift-1", ZoneID: "use1-az1", Zone: "us-east-1a", Region: "us-east-1"})
+
+	stale, err := client.Resource(nodePoolGVR).Get(context.Background(), "stale", metav1.GetOptions{})
+	require.NoError(t, err)
+	stale.SetAnnotations(map[string]string{removedZonesAnnotation: "us-east-1c"})
+	_, err = client.Resource(nodePoolGVR).Update(context.Background(), stale, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := record.NewFakeRecorder(10)
+	go NewNodePoolReconciler(processor, recorder, time.Minute).Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		return len(getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	pool := getTestNodePool(t, client, "default")
+	assert.Equal(t, []string{"us-east-1b"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Equal(t, []string{"us-east-1a"}, pool.removedZones())
+
+	// A pool created mid-shift is narrowed too
+	_, err = client.Resource(nodePoolGVR).Create(ctx,
+		newTestNodePool("late", zoneRequirementOf("In", "us-east-1a", "us-east-1c")), metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(getTestNodePool(t, client, "late").Spec.Template.Spec.Requirements[0].Values) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	for _, reason := range []string{reasonDriftCorrected, reasonStaleZone} {
+		assert.True(t, slices.ContainsFunc(events, func(e string) bool {
+			return strings.HasPrefix(e, "Warning "+reason)
+		}), "missing %s event in %v", reason, events)
+	}
+}
+
+// savedShifts is a ShiftBackend keeping shifts in memory
+type savedShifts struct{ shifts []Shift }
+
+func (b *savedShifts) LoadShifts(ctx context.Context) ([]Shift, error) { return b.shifts, nil }
+
+func (b *savedShifts) SaveShifts(ctx context.Context, shifts []Shift) error {
+	b.shifts = shifts
+	return nil
+}
+
+func TestNodePoolReconcilerRestoresEndedShift(t *testing.T) {
+	client := newTestClient(
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1b")),
+		newTestNodePool("excluding", zoneRequirementOf("NotIn", "us-east-1a", "us-east-1c")),
+	)
+	for _, name := range []string{"default", "excluding"} {
+		pool, err := client.Resource(nodePoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		pool.SetAnnotations(map[string]string{removedZonesAnnotation: "us-east-1a,us-east-1c"})
+		_, err = client.Resource(nodePoolGVR).Update(context.Background(), pool, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+	processor := NewProcessor(client, testZones)
+	useTestProcessor(t, processor)
+	recorder := record.NewFakeRecorder(10)
+	r := NewNodePoolReconciler(processor, recorder, time.Minute)
+	reconcile := func(name string) {
+		obj, err := client.Resource(nodePoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, r.informer.GetStore().Update(obj))
+		require.NoError(t, r.reconcile(context.Background(), name))
+	}
+
+	// Without durable shift state the zones are only reported
+	store.StartShift(Shift{ID: "shift-3", ZoneID: "use1-az3", Zone: "us-east-1c", Region: "us-east-1"})
+	reconcile("default")
+	assert.Equal(t, []string{"us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+	assert.True(t, strings.HasPrefix(<-recorder.Events, "Warning "+reasonStaleZone))
+
+	// Once shifts are loaded from a backend, zones no shift is active for come back
+	store.SetBackend(&savedShifts{shifts: store.ActiveShifts()})
+	require.NoError(t, store.Load(context.Background()))
+	reconcile("default")
+	reconcile("excluding")
+
+	pool := getTestNodePool(t, client, "default")
+	assert.Equal(t, []string{"us-east-1b", "us-east-1a"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Equal(t, []string{"us-east-1c"}, pool.removedZones())
+	pool = getTestNodePool(t, client, "excluding")
+	assert.Equal(t, []string{"us-east-1c"}, pool.Spec.Template.Spec.Requirements[0].Values)
+	assert.Equal(t, []string{"us-east-1c"}, pool.removedZones())
+	assert.True(t, strings.HasPrefix(<-recorder.Events, "Normal "+reasonDriftCorrected))
+}
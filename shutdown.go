@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkpointTimeout bounds writing the checkpoint once the shutdown timeout has passed
+const checkpointTimeout = 5 * time.Second
+
+// shuttingDown is set once the server has been asked to stop. It then refuses
+// new events and reports not ready.
+var shuttingDown atomic.Bool
+
+// errShuttingDown is returned for events received while the server stops
+var errShuttingDown = errors.New("server is shutting down")
+
+// shutdown stops the server in order: it stops accepting requests and waits
+// for those in flight, lets the event worker finish the queued events, then
+// stops the controllers, waits for notifications still being delivered and
+// checkpoints whatever is left. Work still running
+// when timeout passes is abandoned; its event stays queued and is processed
+// again on the next start, which is safe because processing is idempotent.
+func shutdown(server *http.Server, stopControllers context.CancelFunc, controllers *sync.WaitGroup, timeout time.Duration) error {
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	if err := server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to finish in-flight requests: %v", err))
+	}
+	if err := finishQueuedEvents(ctx); err != nil {
+		slog.Warn("Stopped before the event queue was drained", "error", err)
+	}
+
+	// Stopping the controllers releases the Lease, so only do it once this
+	// replica has stopped processing events
+	stopControllers()
+	if !waitUntilDone(ctx, controllers.Wait) {
+		slog.Warn("Controllers did not stop in time")
+	}
+	// Nothing notifies once the controllers have stopped, including
+	// notifiers the policy watcher has swapped out
+	if !waitUntilDone(ctx, waitForNotifications) {
+		slog.Warn("Notifications were not delivered in time")
+	}
+
+	checkpointCtx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+	if err := checkpointQueue(checkpointCtx, appConfig.CheckpointFile); err != nil {
+		errs = append(errs, err)
+	}
+	slog.Info("Shut down")
+	return errors.Join(errs...)
+}
+
+// waitUntilDone calls wait and reports whether it returned before ctx was done
+func waitUntilDone(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// checkpoint is what a stopping server with the memory backend leaves for the next start
+type checkpoint struct {
+	Events []queuedEvent `json:"events,omitempty"`
+	Shifts []Shift       `json:"shifts,omitempty"`
+}
+
+// checkpointQueue saves the events still queued, and the active shifts, to
+// path so the next start resumes them. The ConfigMap backend keeps both
+// already, so there is nothing to do for it.
+func checkpointQueue(ctx context.Context, path string) error {
+	pending, err := eventQueue.Pending(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read queued events: %v", err)
+	}
+	if _, ok := eventQueue.(*memoryQueue); !ok {
+		if len(pending) > 0 {
+			slog.Info("Leaving events queued for the next leader", "events", len(pending))
+		}
+		return nil
+	}
+	if path == "" {
+		if len(pending) > 0 {
+			slog.Warn("Dropping queued events, no checkpoint file is configured", "events", len(pending))
+		}
+		return nil
+	}
+
+	c := checkpoint{Events: pending, Shifts: store.ActiveShifts()}
+	if len(c.Events) == 0 && len(c.Shifts) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove checkpoint: %v", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Write a temporary file and rename it, so a crash never leaves half a checkpoint
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	slog.Info("Saved checkpoint", "path", path, "events", len(c.Events), "shifts", len(c.Shifts))
+	return nil
+}
+
+// restoreCheckpoint queues the events and restores the active shifts a
+// previous run saved to path, then removes the checkpoint
+func restoreCheckpoint(ctx context.Context, path string) error {
+	queue, ok := eventQueue.(*memoryQueue)
+	if path == "" || !ok {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("failed to parse checkpoint %s: %v", path, err)
+	}
+
+	// Shifts kept in a durable backend are read first, so restoring does not
+	// overwrite them and the controllers reloading the backend keep both
+	if err := store.Restore(ctx, c.Shifts); err != nil {
+		return fmt.Errorf("failed to restore checkpointed shifts: %v", err)
+	}
+	queue.restore(c.Events)
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove checkpoint: %v", err)
+	}
+	slog.Info("Restored checkpoint", "path", path, "events", len(c.Events), "shifts", len(c.Shifts))
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// useTestQueue makes queue the event queue for the test and clears shuttingDown afterwards
+func useTestQueue(t *testing.T, queue EventQueue) {
+	original := eventQueue
+	eventQueue = queue
+	t.Cleanup(func() {
+		eventQueue = original
+		shuttingDown.Store(false)
+	})
+}
+
+func TestShutdownDrainsQueuedEvents(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+
+	ctx, stopControllers := context.WithCancel(context.Background())
+	var controllers sync.WaitGroup
+	controllers.Add(1)
+	go func() {
+		defer controllers.Done()
+		runEventWorker(ctx, queue, time.Hour)
+	}()
+
+	// Queued without waking the worker, so only the shutdown drain picks it up
+	event := testShiftEvent("Autoshift In Progress")
+	event.ID = "queued"
+	require.NoError(t, queue.Enqueue(context.Background(), event))
+
+	require.NoError(t, shutdown(&http.Server{}, stopControllers, &controllers, 5*time.Second))
+	pending, err := queue.Pending(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, []string{"us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+
+	// Once stopping, the server refuses new events and reports not ready
+	assert.ErrorIs(t, handleEvent(context.Background(), testShiftEvent("Autoshift In Progress")), errShuttingDown)
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestShutdownCheckpointsUnfinishedWork(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	useTestConfig(t, func(c *Config) { c.CheckpointFile = path })
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+
+	event := testShiftEvent("Autoshift Completed")
+	event.ID = "unfinished"
+	require.NoError(t, queue.Enqueue(context.Background(), event))
+	shift := store.StartShift(Shift{ID: "shift-1", ZoneID: "use1-az1", StartedAt: time.Now()})
+
+	// No worker is running, so the drain times out and the event is checkpointed
+	var controllers sync.WaitGroup
+	require.NoError(t, shutdown(&http.Server{}, func() {}, &controllers, 50*time.Millisecond))
+	_, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// The next start queues the event again and restores the shift
+	restarted := newMemoryQueue()
+	eventQueue = restarted
+	store = NewShiftStore()
+	require.NoError(t, restoreCheckpoint(context.Background(), path))
+	pending, err := restarted.Pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "unfinished", pending[0].Event.ID)
+	restored, ok := store.GetShift(shift.ID)
+	require.True(t, ok)
+	assert.Equal(t, "use1-az1", restored.ZoneID)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing left to resume removes a stale checkpoint
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0o600))
+	eventQueue, store = newMemoryQueue(), NewShiftStore()
+	require.NoError(t, checkpointQueue(context.Background(), path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// slowSink takes delay to deliver each notification
+type slowSink struct {
+	delay time.Duration
+	sent  atomic.Int32
+}
+
+func (s *slowSink) Name() string { return "slow" }
+
+func (s *slowSink) Send(ctx context.Context, n Notification, text string) error {
+	time.Sleep(s.delay)
+	s.sent.Add(1)
+	return nil
+}
+
+// startTestWorker runs the event worker on queue until the returned cancel is called
+func startTestWorker(queue EventQueue) (context.CancelFunc, *sync.WaitGroup) {
+	ctx, stopControllers := context.WithCancel(context.Background())
+	var controllers sync.WaitGroup
+	controllers.Add(1)
+	go func() {
+		defer controllers.Done()
+		runEventWorker(ctx, queue, time.Hour)
+	}()
+	return stopControllers, &controllers
+}
+
+func TestCheckpointRestoresIntoDurableBackend(t *testing.T) {
+	ctx := context.Background()
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	useTestQueue(t, newMemoryQueue())
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{zonalShiftGVR: "ZonalShiftList"})
+	backend := newZonalShiftBackend(client, time.Hour)
+
+	// A shift already kept as a ZonalShift, and one only in the checkpoint
+	saved := Shift{ID: "saved", ZoneID: "use1-az2", StartedAt: time.Now()}
+	require.NoError(t, backend.SaveShifts(ctx, []Shift{saved}))
+	checkpointed := Shift{ID: "checkpointed", ZoneID: "use1-az1", StartedAt: time.Now()}
+	data, err := json.Marshal(checkpoint{Shifts: []Shift{checkpointed}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	store.SetBackend(backend)
+	require.NoError(t, restoreCheckpoint(ctx, path))
+
+	// The controllers reload the backend once leading, and keep both
+	require.NoError(t, store.Load(ctx))
+	ids := []string{}
+	for _, shift := range store.ActiveShifts() {
+		ids = append(ids, shift.ID)
+	}
+	assert.ElementsMatch(t, []string{"saved", "checkpointed"}, ids)
+	assert.False(t, getTestZonalShift(t, client, "saved").restored())
+}
+
+func TestShutdownWaitsForNotifications(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	sink := &slowSink{delay: 100 * time.Millisecond}
+	n, err := NewNotifier([]Sink{sink}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	n.Notify(Notification{Kind: notifyShiftApplied, ZoneID: "use1-az1"})
+	stopControllers, controllers := startTestWorker(queue)
+	require.NoError(t, shutdown(&http.Server{}, stopControllers, controllers, 5*time.Second))
+	assert.Equal(t, int32(1), sink.sent.Load())
+
+	// A delivery outlasting the shutdown timeout is abandoned
+	sink.delay = 500 * time.Millisecond
+	n.Notify(Notification{Kind: notifyShiftApplied, ZoneID: "use1-az1"})
+	start := time.Now()
+	stopControllers, controllers = startTestWorker(queue)
+	require.NoError(t, shutdown(&http.Server{}, stopControllers, controllers, 200*time.Millisecond))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	n.Wait()
+}
+
+func TestShutdownWaitsForReplacedNotifiers(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	sink := &slowSink{delay: 100 * time.Millisecond}
+	n, err := NewNotifier([]Sink{sink}, nil)
+	require.NoError(t, err)
+	original := notifier.Swap(n)
+	t.Cleanup(func() { notifier.Store(original) })
+
+	// A policy change swaps the notifier while it is still delivering
+	n.Notify(Notification{Kind: notifyShiftApplied, ZoneID: "use1-az1"})
+	replaceNotifier(nil)
+	stopControllers, controllers := startTestWorker(queue)
+	require.NoError(t, shutdown(&http.Server{}, stopControllers, controllers, 5*time.Second))
+	assert.Equal(t, int32(1), sink.sent.Load())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// Ways of confirming SNS subscriptions, for the snsConfirmation setting
+const (
+	snsConfirmByURL = "url"
+	snsConfirmByAPI = "api"
+)
+
+// snsConfirmTimeout bounds a single subscription confirmation
+const snsConfirmTimeout = 10 * time.Second
+
+// snsHostPattern matches the SNS endpoints AWS sends SubscribeURLs for
+var snsHostPattern = regexp.MustCompile(`^sns\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// errConfirmationRefused wraps the reasons a confirmation request is not acted on
+var errConfirmationRefused = errors.New("subscription confirmation refused")
+
+// snsSubscriptionConfirmer is the part of the SNS API used to confirm subscriptions
+type snsSubscriptionConfirmer interface {
+	ConfirmSubscription(ctx context.Context, params *sns.ConfirmSubscriptionInput, optFns ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error)
+}
+
+// newSNSConfirmer creates the SNS client for a region; tests replace it with fakes
+var newSNSConfirmer = func(ctx context.Context, region string) (snsSubscriptionConfirmer, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	return sns.NewFromConfig(awsCfg), nil
+}
+
+// confirmSubscription confirms the subscription in an SNS SubscriptionConfirmation
+// message, only for an allowed topic and only by calling SNS itself
+func confirmSubscription(ctx context.Context, msg SNSMessage) error {
+	topic, err := arn.Parse(msg.TopicArn)
+	if err != nil || topic.Service != "sns" {
+		return fmt.Errorf("%w: invalid TopicArn %q", errConfirmationRefused, msg.TopicArn)
+	}
+	if !slices.Contains(appConfig.AllowedTopics, msg.TopicArn) {
+		return fmt.Errorf("%w: topic is not in allowedTopics", errConfirmationRefused)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, snsConfirmTimeout)
+	defer cancel()
+	if appConfig.SNSConfirmation == snsConfirmByAPI {
+		if msg.Token == "" {
+			return fmt.Errorf("%w: message has no Token", errConfirmationRefused)
+		}
+		client, err := newSNSConfirmer(ctx, topic.Region)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		_, err = client.ConfirmSubscription(ctx, &sns.ConfirmSubscriptionInput{
+			TopicArn: aws.String(msg.TopicArn),
+			Token:    aws.String(msg.Token),
+		})
+		observeAPICall("sns", "confirm-subscription", start, err)
+		return err
+	}
+
+	subscribeURL, err := checkSubscribeURL(msg.SubscribeURL, topic)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errConfirmationRefused, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscribeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Based on the default client so tests can replace its transport, but
+	// never following a redirect away from the checked URL
+	client := *http.DefaultClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SNS answered the confirmation with %s", resp.Status)
+	}
+	return nil
+}
+
+// checkSubscribeURL only accepts the SNS ConfirmSubscription URL for topic,
+// so a forged message cannot make the service request anything else
+func checkSubscribeURL(raw string, topic arn.ARN) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SubscribeURL: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("SubscribeURL must use https, not %q", u.Scheme)
+	}
+	if u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return nil, errors.New("SubscribeURL must not carry credentials or a port")
+	}
+	match := snsHostPattern.FindStringSubmatch(strings.ToLower(u.Hostname()))
+	if match == nil {
+		return nil, fmt.Errorf("SubscribeURL host %q is not an SNS endpoint", u.Hostname())
+	}
+	if match[1] != topic.Region {
+		return nil, fmt.Errorf("SubscribeURL host %q is not in the topic's region %s", u.Hostname(), topic.Region)
+	}
+	query := u.Query()
+	if query.Get("Action") != "ConfirmSubscription" || query.Get("TopicArn") != topic.String() {
+		return nil, errors.New("SubscribeURL is not a ConfirmSubscription request for the topic")
+	}
+	return u, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTopicArn     = "arn:aws:sns:us-east-1:123456789012:zonal-shift"
+	testSubscribeURL = "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&TopicArn=" +
+		"arn:aws:sns:us-east-1:123456789012:zonal-shift&Token=token123"
+)
+
+// fakeSNSConfirmer records the ConfirmSubscription calls made to it
+type fakeSNSConfirmer struct {
+	inputs []*sns.ConfirmSubscriptionInput
+	err    error
+}
+
+func (f *fakeSNSConfirmer) ConfirmSubscription(_ context.Context, params *sns.ConfirmSubscriptionInput, _ ...func(*sns.Options)) (*sns.ConfirmSubscriptionOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &sns.ConfirmSubscriptionOutput{}, f.err
+}
+
+// useTestHTTPClient answers the default client's requests with status, recording the URLs requested
+func useTestHTTPClient(t *testing.T, status int) *[]string {
+	var requested []string
+	original := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: &MockRoundTripper{
+		MockDo: func(req *http.Request) (*http.Response, error) {
+			requested = append(requested, req.URL.String())
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: http.NoBody}, nil
+		},
+	}}
+	t.Cleanup(func() { http.DefaultClient = original })
+	return &requested
+}
+
+func sendConfirmation(t *testing.T, msg SNSMessage) int {
+	msg.Type = "SubscriptionConfirmation"
+	body, err := json.Marshal(signSNSMessage(t, msg))
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/sns", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestSubscriptionConfirmationRefusesUnsafeURLs(t *testing.T) {
+	requested := useTestHTTPClient(t, http.StatusOK)
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+
+	withQuery := func(base string) string {
+		return base + "?Action=ConfirmSubscription&TopicArn=" + url.QueryEscape(testTopicArn) + "&Token=token123"
+	}
+	for name, subscribeURL := range map[string]string{
+		"instance metadata": "http://169.254.169.254/latest/meta-data/iam/security-credentials/",
+		"plain http":        withQuery("http://sns.us-east-1.amazonaws.com/"),
+		"other host":        withQuery("https://sns.us-east-1.amazonaws.com.attacker.example/"),
+		"lookalike host":    withQuery("https://sns-us-east-1.amazonaws.com/"),
+		"other region":      withQuery("https://sns.eu-west-1.amazonaws.com/"),
+		"credentials":       withQuery("https://user@sns.us-east-1.amazonaws.com/"),
+		"port":              withQuery("https://sns.us-east-1.amazonaws.com:8443/"),
+		"other action":      "https://sns.us-east-1.amazonaws.com/?Action=Unsubscribe&TopicArn=" + url.QueryEscape(testTopicArn),
+		"other topic":       "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&TopicArn=arn:aws:sns:us-east-1:123456789012:other",
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, http.StatusForbidden, sendConfirmation(t, SNSMessage{TopicArn: testTopicArn, SubscribeURL: subscribeURL}))
+		})
+	}
+	assert.Empty(t, *requested)
+
+	assert.Equal(t, http.StatusOK, sendConfirmation(t, SNSMessage{TopicArn: testTopicArn, SubscribeURL: testSubscribeURL}))
+	assert.Equal(t, []string{testSubscribeURL}, *requested)
+}
+
+func TestSubscriptionConfirmationRequiresAllowedTopic(t *testing.T) {
+	requested := useTestHTTPClient(t, http.StatusOK)
+	msg := SNSMessage{TopicArn: testTopicArn, SubscribeURL: testSubscribeURL}
+
+	// Without an allowlist nothing is confirmed, since any topic could subscribe
+	useTestConfig(t, func(c *Config) {})
+	assert.Equal(t, http.StatusForbidden, sendConfirmation(t, msg))
+
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{"arn:aws:sns:us-east-1:123456789012:other"} })
+	assert.Equal(t, http.StatusForbidden, sendConfirmation(t, msg))
+	assert.Empty(t, *requested)
+}
+
+func TestSubscriptionConfirmationChecksStatus(t *testing.T) {
+	useTestHTTPClient(t, http.StatusForbidden)
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+	assert.Equal(t, http.StatusInternalServerError, sendConfirmation(t, SNSMessage{TopicArn: testTopicArn, SubscribeURL: testSubscribeURL}))
+}
+
+func TestSubscriptionConfirmationByAPI(t *testing.T) {
+	requested := useTestHTTPClient(t, http.StatusOK)
+	useTestConfig(t, func(c *Config) {
+		c.AllowedTopics = []string{testTopicArn}
+		c.SNSConfirmation = snsConfirmByAPI
+	})
+	fake := &fakeSNSConfirmer{}
+	var region string
+	original := newSNSConfirmer
+	newSNSConfirmer = func(_ context.Context, r string) (snsSubscriptionConfirmer, error) {
+		region = r
+		return fake, nil
+	}
+	t.Cleanup(func() { newSNSConfirmer = original })
+
+	// The SubscribeURL is never fetched, so it does not matter where it points
+	msg := SNSMessage{TopicArn: testTopicArn, Token: "token123", SubscribeURL: "http://169.254.169.254/"}
+	assert.Equal(t, http.StatusOK, sendConfirmation(t, msg))
+	require.Len(t, fake.inputs, 1)
+	assert.Equal(t, "us-east-1", region)
+	assert.Equal(t, testTopicArn, aws.ToString(fake.inputs[0].TopicArn))
+	assert.Equal(t, "token123", aws.ToString(fake.inputs[0].Token))
+	assert.Empty(t, *requested)
+
+	fake.err = errors.New("invalid token")
+	assert.Equal(t, http.StatusInternalServerError, sendConfirmation(t, msg))
+
+	msg.Token = ""
+	assert.Equal(t, http.StatusForbidden, sendConfirmation(t, msg))
+}
+
+func TestSNSConfirmationValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig([]string{"--sns-confirmation", "email"})
+	assert.ErrorContains(t, err, `unknown snsConfirmation "email"`)
+}
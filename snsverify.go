@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+const (
+	// snsCertTimeout bounds fetching one signing certificate
+	snsCertTimeout = 10 * time.Second
+
+	// maxSNSCertSize caps how much of a signing certificate response is read
+	maxSNSCertSize = 64 << 10
+)
+
+// snsCertPathPattern matches the paths SNS serves its signing certificates on
+var snsCertPathPattern = regexp.MustCompile(`^/SimpleNotificationService-[0-9A-Za-z]+\.pem$`)
+
+// snsVerifier checks the signatures of SNS messages, caching the signing
+// certificates it fetches
+type snsVerifier struct {
+	// fetch downloads the PEM certificate at a checked SigningCertURL
+	fetch func(ctx context.Context, certURL string) ([]byte, error)
+	now   func() time.Time
+
+	mu    sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func newSNSVerifier() *snsVerifier {
+	return &snsVerifier{fetch: fetchSNSCert, now: time.Now, certs: map[string]*x509.Certificate{}}
+}
+
+// snsSignatures verifies the SNS messages the server receives
+var snsSignatures = newSNSVerifier()
+
+// verify checks that msg was signed by SNS in the region of its topic
+func (v *snsVerifier) verify(ctx context.Context, msg SNSMessage) error {
+	if msg.Signature == "" || msg.SigningCertURL == "" {
+		return errors.New("message is not signed")
+	}
+	var hash crypto.Hash
+	switch msg.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported SignatureVersion %q", msg.SignatureVersion)
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid Signature: %v", err)
+	}
+	signed, err := snsStringToSign(msg)
+	if err != nil {
+		return err
+	}
+	topic, err := arn.Parse(msg.TopicArn)
+	if err != nil || topic.Service != "sns" {
+		return fmt.Errorf("invalid TopicArn %q", msg.TopicArn)
+	}
+	certURL, err := checkSigningCertURL(msg.SigningCertURL, topic)
+	if err != nil {
+		return err
+	}
+	cert, err := v.certificate(ctx, certURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signing certificate does not hold an RSA key")
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return errors.New("signature does not match the message")
+	}
+	return nil
+}
+
+// certificate returns the certificate at certURL, fetching it on first use
+func (v *snsVerifier) certificate(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	v.mu.Lock()
+	cert, ok := v.certs[certURL]
+	v.mu.Unlock()
+	if !ok {
+		ctx, cancel := context.WithTimeout(ctx, snsCertTimeout)
+		defer cancel()
+		data, err := v.fetch(ctx, certURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch signing certificate: %v", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("signing certificate is not a PEM certificate")
+		}
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid signing certificate: %v", err)
+		}
+		v.mu.Lock()
+		v.certs[certURL] = cert
+		v.mu.Unlock()
+	}
+	if now := v.now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("signing certificate is not valid now")
+	}
+	return cert, nil
+}
+
+// fetchSNSCert downloads a signing certificate, never following a redirect
+// away from the checked URL
+func fetchSNSCert(ctx context.Context, certURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := *http.DefaultClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SNS answered with %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSNSCertSize))
+}
+
+// checkSigningCertURL only accepts an https certificate URL on the SNS
+// endpoint of the topic's region
+func checkSigningCertURL(raw string, topic arn.ARN) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid SigningCertURL: %v", err)
+	}
+	if u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") || u.RawQuery != "" {
+		return "", fmt.Errorf("SigningCertURL %q is not a plain https URL", raw)
+	}
+	match := snsHostPattern.FindStringSubmatch(strings.ToLower(u.Hostname()))
+	if match == nil || match[1] != topic.Region {
+		return "", fmt.Errorf("SigningCertURL host %q is not the SNS endpoint of %s", u.Hostname(), topic.Region)
+	}
+	if !snsCertPathPattern.MatchString(u.Path) {
+		return "", fmt.Errorf("SigningCertURL path %q is not an SNS certificate", u.Path)
+	}
+	return u.String(), nil
+}
+
+// snsStringToSign builds the string SNS signs for a message of each type
+func snsStringToSign(msg SNSMessage) (string, error) {
+	var fields [][2]string
+	switch msg.Type {
+	case snsNotification:
+		fields = append(fields, [2]string{"Message", msg.Message}, [2]string{"MessageId", msg.MessageId})
+		if msg.Subject != "" {
+			fields = append(fields, [2]string{"Subject", msg.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", msg.Timestamp}, [2]string{"TopicArn", msg.TopicArn}, [2]string{"Type", msg.Type})
+	case snsSubscriptionConfirmation, snsUnsubscribeConfirmation:
+		fields = [][2]string{
+			{"Message", msg.Message}, {"MessageId", msg.MessageId}, {"SubscribeURL", msg.SubscribeURL},
+			{"Timestamp", msg.Timestamp}, {"Token", msg.Token}, {"TopicArn", msg.TopicArn}, {"Type", msg.Type},
+		}
+	default:
+		return "", fmt.Errorf("unsupported SNS message type %q", msg.Type)
+	}
+	var b strings.Builder
+	for _, field := range fields {
+		b.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSNSKey is the key test SNS messages are signed with, generated once since RSA keys are slow to make
+var testSNSKey = sync.OnceValues(func() (*rsa.PrivateKey, error) { return rsa.GenerateKey(rand.Reader, 2048) })
+
+// testSNSCert returns a PEM certificate for key, valid around now
+func testSNSCert(t *testing.T, key *rsa.PrivateKey) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// useTestSNSCertificate makes the verifier fetch the test certificate instead
+// of SNS's, recording the URLs it fetches
+func useTestSNSCertificate(t *testing.T) *[]string {
+	key, err := testSNSKey()
+	require.NoError(t, err)
+	cert := testSNSCert(t, key)
+	var fetched []string
+	original := snsSignatures
+	snsSignatures = newSNSVerifier()
+	snsSignatures.fetch = func(_ context.Context, certURL string) ([]byte, error) {
+		fetched = append(fetched, certURL)
+		return cert, nil
+	}
+	t.Cleanup(func() { snsSignatures = original })
+	return &fetched
+}
+
+// signSNSMessage signs msg like SNS in its topic's region, defaulting the
+// topic to testTopicArn, and makes the verifier trust the signing certificate
+func signSNSMessage(t *testing.T, msg SNSMessage) SNSMessage {
+	useTestSNSCertificate(t)
+	if msg.TopicArn == "" {
+		msg.TopicArn = testTopicArn
+	}
+	region := "us-east-1"
+	if topic, err := arn.Parse(msg.TopicArn); err == nil {
+		region = topic.Region
+	}
+	msg.SignatureVersion = "2"
+	msg.SigningCertURL = "https://sns." + region + ".amazonaws.com/SimpleNotificationService-test.pem"
+	signed, err := snsStringToSign(msg)
+	require.NoError(t, err)
+	key, err := testSNSKey()
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+	return msg
+}
+
+func TestSNSSignatureVerification(t *testing.T) {
+	ctx := context.Background()
+	msg := signSNSMessage(t, SNSMessage{Type: snsNotification, MessageId: "m-1", Message: "{}", Subject: "autoshift", Timestamp: "2024-10-01T08:00:00.000Z"})
+	fetched := useTestSNSCertificate(t)
+	require.NoError(t, snsSignatures.verify(ctx, msg))
+
+	// The certificate is fetched once and then cached
+	require.NoError(t, snsSignatures.verify(ctx, msg))
+	assert.Equal(t, []string{"https://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"}, *fetched)
+
+	// Version 1 signatures use SHA1
+	key, err := testSNSKey()
+	require.NoError(t, err)
+	v1 := msg
+	v1.SignatureVersion = "1"
+	signed, err := snsStringToSign(v1)
+	require.NoError(t, err)
+	digest := sha1.Sum([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	require.NoError(t, err)
+	v1.Signature = base64.StdEncoding.EncodeToString(signature)
+	assert.NoError(t, snsSignatures.verify(ctx, v1))
+
+	for name, test := range map[string]struct {
+		change  func(*SNSMessage)
+		message string
+	}{
+		"unsigned":        {func(m *SNSMessage) { m.Signature = "" }, "message is not signed"},
+		"no certificate":  {func(m *SNSMessage) { m.SigningCertURL = "" }, "message is not signed"},
+		"unknown version": {func(m *SNSMessage) { m.SignatureVersion = "3" }, `unsupported SignatureVersion "3"`},
+		"changed message": {func(m *SNSMessage) { m.Message = `{"id": "forged"}` }, "signature does not match"},
+		"changed subject": {func(m *SNSMessage) { m.Subject = "" }, "signature does not match"},
+		"plain http": {func(m *SNSMessage) {
+			m.SigningCertURL = "http://sns.us-east-1.amazonaws.com/SimpleNotificationService-test.pem"
+		}, "not a plain https URL"},
+		"other host": {func(m *SNSMessage) { m.SigningCertURL = "https://attacker.example/SimpleNotificationService-test.pem" }, "is not the SNS endpoint"},
+		"lookalike host": {func(m *SNSMessage) {
+			m.SigningCertURL = "https://sns.us-east-1.amazonaws.com.attacker.example/SimpleNotificationService-test.pem"
+		}, "is not the SNS endpoint"},
+		"other region": {func(m *SNSMessage) {
+			m.SigningCertURL = "https://sns.eu-west-1.amazonaws.com/SimpleNotificationService-test.pem"
+		}, "is not the SNS endpoint of us-east-1"},
+		"other path":        {func(m *SNSMessage) { m.SigningCertURL = "https://sns.us-east-1.amazonaws.com/uploads/cert.pem" }, "is not an SNS certificate"},
+		"invalid topic ARN": {func(m *SNSMessage) { m.TopicArn = "zonal-shift" }, `invalid TopicArn "zonal-shift"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			changed := msg
+			test.change(&changed)
+			assert.ErrorContains(t, snsSignatures.verify(ctx, changed), test.message)
+		})
+	}
+	assert.Len(t, *fetched, 1)
+}
+
+func TestSNSSigningCertificateChecks(t *testing.T) {
+	msg := signSNSMessage(t, SNSMessage{Type: snsNotification, MessageId: "m-1", Message: "{}"})
+	ctx := context.Background()
+
+	// A certificate SNS cannot serve, or one that has expired, is not trusted
+	snsSignatures.fetch = func(context.Context, string) ([]byte, error) { return nil, errors.New("connection refused") }
+	assert.ErrorContains(t, snsSignatures.verify(ctx, msg), "failed to fetch signing certificate")
+	snsSignatures.fetch = func(context.Context, string) ([]byte, error) { return []byte("not a certificate"), nil }
+	assert.ErrorContains(t, snsSignatures.verify(ctx, msg), "not a PEM certificate")
+
+	useTestSNSCertificate(t)
+	snsSignatures.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.ErrorContains(t, snsSignatures.verify(ctx, msg), "signing certificate is not valid now")
+
+	// A certificate for another key does not verify the signature
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherCert := testSNSCert(t, otherKey)
+	useTestSNSCertificate(t)
+	snsSignatures.fetch = func(context.Context, string) ([]byte, error) { return otherCert, nil }
+	assert.ErrorContains(t, snsSignatures.verify(ctx, msg), "signature does not match")
+}
+
+func TestUnsignedSNSMessagesAreRejected(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	requested := useTestHTTPClient(t, http.StatusOK)
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+	tracker := useTestSubscriptions(t, time.Now())
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	useTestSNSCertificate(t)
+
+	event := `{"version": "0", "id": "forged", "detail-type": "Autoshift In Progress", "source": "aws.arc", "region": "us-east-1", "detail": {"version": "0.0.1", "metadata": {"awayFrom": "use1-az1"}}}`
+	for _, msg := range []SNSMessage{
+		{Type: snsNotification, TopicArn: testTopicArn, Message: event},
+		{Type: snsSubscriptionConfirmation, TopicArn: testTopicArn, SubscribeURL: testSubscribeURL},
+		{Type: snsUnsubscribeConfirmation, TopicArn: testTopicArn, SubscribeURL: testSubscribeURL},
+	} {
+		assert.Equal(t, http.StatusForbidden, postSNS(t, msg), msg.Type)
+
+		// A signature for other content does not carry over
+		signed := signSNSMessage(t, msg)
+		signed.MessageId = "replayed"
+		assert.Equal(t, http.StatusForbidden, postSNS(t, signed), msg.Type)
+	}
+	assert.Empty(t, pendingEvents(t, queue))
+	assert.Empty(t, *requested)
+	assert.Equal(t, subscriptionState{}, tracker.snapshot()[testTopicArn])
+}
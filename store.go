@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentEvents caps how many processed events the store remembers
+const maxRecentEvents = 100
+
+// Shift is a zonal shift the service is currently acting on
+type Shift struct {
+	ID        string     `json:"id"`
+	ZoneID    string     `json:"zoneId"`
+	Zone      string     `json:"zone,omitempty"`
+	Region    string     `json:"region,omitempty"`
+	Source    string     `json:"source"`
+	EventID   string     `json:"eventId,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Resources []string   `json:"resources"`
+	NodePools []string   `json:"nodePools"`
+	// Practice marks the shift of a rehearsed practice run, kept apart from
+	// any real shift for the same zone
+	Practice bool `json:"practice,omitempty"`
+}
+
+// EventRecord is the processing outcome of a single received event
+type EventRecord struct {
+	ID          string    `json:"id"`
+	DetailType  string    `json:"detailType"`
+	Source      string    `json:"source"`
+	ZoneID      string    `json:"zoneId"`
+	ReceivedAt  time.Time `json:"receivedAt"`
+	CompletedAt time.Time `json:"completedAt"`
+	Outcome     string    `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	NodePools   []string  `json:"nodePools,omitempty"`
+	Refused     []string  `json:"refused,omitempty"`
+	// PracticeRun is set for practice run events that were observed or rehearsed
+	PracticeRun *PracticeRunResult `json:"practiceRun,omitempty"`
+}
+
+// Event processing outcomes
+const (
+	outcomeApplied   = "applied"
+	outcomeNoChanges = "no-changes"
+	outcomeRefused   = "refused"
+	outcomeFailed    = "failed"
+	outcomeIgnored   = "ignored"
+	// outcomeObserved is a practice run whose changes were planned but not made
+	outcomeObserved = "observed"
+	// outcomeDryRun is an event whose changes were planned but not made because of DRY_RUN
+	outcomeDryRun = "dry-run"
+)
+
+// ShiftStore keeps the active shifts and recently processed events in memory,
+// saving active shifts to a backend when one is set
+type ShiftStore struct {
+	mu      sync.Mutex
+	shifts  map[string]*Shift
+	events  []EventRecord
+	backend ShiftBackend
+	// loaded is set once the active shifts have been read from the backend
+	loaded bool
+	// version counts changes to the active shifts
+	version uint64
+
+	// saveMu orders saves to the backend, which happen without holding mu.
+	// saved is the version of the last snapshot sent to the backend.
+	saveMu sync.Mutex
+	saved  uint64
+}
+
+// NewShiftStore creates an empty ShiftStore
+func NewShiftStore() *ShiftStore {
+	return &ShiftStore{shifts: map[string]*Shift{}}
+}
+
+// store is the state shared by the event handlers and the admin API
+var store = NewShiftStore()
+
+// SetBackend makes the store save active shifts to backend
+func (s *ShiftStore) SetBackend(backend ShiftBackend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backend, s.loaded = backend, false
+}
+
+// Load replaces the active shifts with those saved in the backend
+func (s *ShiftStore) Load(ctx context.Context) error {
+	s.mu.Lock()
+	backend := s.backend
+	s.mu.Unlock()
+	if backend == nil {
+		return nil
+	}
+
+	shifts, err := backend.LoadShifts(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shifts = map[string]*Shift{}
+	for i := range shifts {
+		s.shifts[shifts[i].ID] = &shifts[i]
+	}
+	s.loaded = true
+	return nil
+}
+
+// shiftSnapshot is the active shifts as of one change to the store
+type shiftSnapshot struct {
+	backend ShiftBackend
+	shifts  []Shift
+	version uint64
+}
+
+// changed records a change to the active shifts and returns a snapshot to
+// persist once s.mu is released. Callers hold s.mu.
+func (s *ShiftStore) changed() shiftSnapshot {
+	s.version++
+	snapshot := shiftSnapshot{backend: s.backend, version: s.version}
+	if s.backend == nil {
+		return snapshot
+	}
+	snapshot.shifts = make([]Shift, 0, len(s.shifts))
+	for _, shift := range s.shifts {
+		snapshot.shifts = append(snapshot.shifts, *shift)
+	}
+	return snapshot
+}
+
+// persist saves a snapshot to the backend, logging a failure. It is called
+// without s.mu held so a slow backend does not block readers.
+func (s *ShiftStore) persist(snapshot shiftSnapshot) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.save(ctx, snapshot); err != nil {
+		slog.Error("Failed to save active shifts", "error", err)
+	}
+}
+
+// save writes a snapshot to the backend. A snapshot older than one already
+// saved is dropped so saves never go backwards.
+func (s *ShiftStore) save(ctx context.Context, snapshot shiftSnapshot) error {
+	if snapshot.backend == nil {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if snapshot.version <= s.saved {
+		return nil
+	}
+	s.saved = snapshot.version
+	return snapshot.backend.SaveShifts(ctx, snapshot.shifts)
+}
+
+// Restore merges shifts saved by an earlier run into the active shifts read
+// from the backend, and saves the result, so reloading it keeps both
+func (s *ShiftStore) Restore(ctx context.Context, shifts []Shift) error {
+	if err := s.Load(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, shift := range shifts {
+		s.startShift(shift)
+	}
+	snapshot := s.changed()
+	s.mu.Unlock()
+
+	return s.save(ctx, snapshot)
+}
+
+// Durable reports whether active shifts are kept in a backend that outlives
+// the process and were read back from it, so a shift missing from the store
+// has really ended
+func (s *ShiftStore) Durable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend != nil && s.loaded
+}
+
+// StartShift records a shift as active. A shift for a zone that already has
+// an active shift of the same kind, practice or real, is merged into it.
+func (s *ShiftStore) StartShift(shift Shift) Shift {
+	s.mu.Lock()
+	shift = s.startShift(shift)
+	snapshot := s.changed()
+	s.mu.Unlock()
+
+	s.persist(snapshot)
+	return shift
+}
+
+// startShift adds a shift or merges it into the active shift of the same
+// kind for its zone. Callers hold s.mu.
+func (s *ShiftStore) startShift(shift Shift) Shift {
+	for _, existing := range s.shifts {
+		if existing.ZoneID == shift.ZoneID && existing.Practice == shift.Practice {
+			existing.NodePools = mergeStrings(existing.NodePools, shift.NodePools)
+			existing.Resources = mergeStrings(existing.Resources, shift.Resources)
+			if shift.ExpiresAt != nil {
+				existing.ExpiresAt = shift.ExpiresAt
+			}
+			return *existing
+		}
+	}
+	if shift.ID == "" {
+		shift.ID = newShiftID()
+	}
+	s.shifts[shift.ID] = &shift
+	return shift
+}
+
+// EndShift removes the active practice or real shift for a zone and returns it
+func (s *ShiftStore) EndShift(zoneID string, practice bool) (Shift, bool) {
+	s.mu.Lock()
+	for id, shift := range s.shifts {
+		if shift.ZoneID == zoneID && shift.Practice == practice {
+			delete(s.shifts, id)
+			snapshot := s.changed()
+			s.mu.Unlock()
+
+			s.persist(snapshot)
+			return *shift, true
+		}
+	}
+	s.mu.Unlock()
+	return Shift{}, false
+}
+
+// GetShift returns the active shift with the given ID
+func (s *ShiftStore) GetShift(id string) (Shift, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shift, ok := s.shifts[id]
+	if !ok {
+		return Shift{}, false
+	}
+	return *shift, true
+}
+
+// ShiftForZone returns the active practice or real shift for a zone
+func (s *ShiftStore) ShiftForZone(zoneID string, practice bool) (Shift, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, shift := range s.shifts {
+		if shift.ZoneID == zoneID && shift.Practice == practice {
+			return *shift, true
+		}
+	}
+	return Shift{}, false
+}
+
+// ExtendShift moves the expiry of an active shift
+func (s *ShiftStore) ExtendShift(id string, expiresAt time.Time) bool {
+	s.mu.Lock()
+	shift, ok := s.shifts[id]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	shift.ExpiresAt = &expiresAt
+	snapshot := s.changed()
+	s.mu.Unlock()
+
+	s.persist(snapshot)
+	return true
+}
+
+// ActiveShifts returns the active shifts, oldest first
+func (s *ShiftStore) ActiveShifts() []Shift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shifts := make([]Shift, 0, len(s.shifts))
+	for _, shift := range s.shifts {
+		shifts = append(shifts, *shift)
+	}
+	sort.Slice(shifts, func(i, j int) bool { return shifts[i].StartedAt.Before(shifts[j].StartedAt) })
+	return shifts
+}
+
+// RecordEvent remembers the outcome of a processed event
+func (s *ShiftStore) RecordEvent(record EventRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, record)
+	if len(s.events) > maxRecentEvents {
+		s.events = s.events[len(s.events)-maxRecentEvents:]
+	}
+}
+
+// RecentEvents returns the recently processed events, newest first
+func (s *ShiftStore) RecentEvents() []EventRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]EventRecord, len(s.events))
+	for i, record := range s.events {
+		events[len(s.events)-1-i] = record
+	}
+	return events
+}
+
+// newShiftID returns a random identifier for a shift
+func newShiftID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
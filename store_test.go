@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShiftStoreMergesShiftsForSameZone(t *testing.T) {
+	s := NewShiftStore()
+	first := s.StartShift(Shift{ID: "a", ZoneID: "use1-az1", NodePools: []string{"default"}, StartedAt: time.Now()})
+	s.StartShift(Shift{ID: "b", ZoneID: "use1-az1", NodePools: []string{"batch"}})
+	s.StartShift(Shift{ZoneID: "use1-az2"})
+
+	shifts := s.ActiveShifts()
+	assert.Len(t, shifts, 2)
+
+	ended, ok := s.EndShift("use1-az1", false)
+	assert.True(t, ok)
+	assert.Equal(t, first.ID, ended.ID)
+	assert.Equal(t, []string{"batch", "default"}, ended.NodePools)
+
+	_, ok = s.EndShift("use1-az1", false)
+	assert.False(t, ok)
+}
+
+func TestShiftStoreKeepsRecentEvents(t *testing.T) {
+	s := NewShiftStore()
+	for i := 0; i < maxRecentEvents+10; i++ {
+		s.RecordEvent(EventRecord{ID: fmt.Sprint(i)})
+	}
+	events := s.RecentEvents()
+	assert.Len(t, events, maxRecentEvents)
+	assert.Equal(t, fmt.Sprint(maxRecentEvents+9), events[0].ID)
+}
+
+// blockingBackend holds every save until it is released
+type blockingBackend struct {
+	saving  chan []Shift
+	release chan struct{}
+	saved   [][]Shift
+}
+
+func (b *blockingBackend) LoadShifts(ctx context.Context) ([]Shift, error) { return nil, nil }
+
+func (b *blockingBackend) SaveShifts(ctx context.Context, shifts []Shift) error {
+	b.saving <- shifts
+	<-b.release
+	b.saved = append(b.saved, shifts)
+	return nil
+}
+
+func TestShiftStoreSavesOutsideLock(t *testing.T) {
+	backend := &blockingBackend{saving: make(chan []Shift, 1), release: make(chan struct{})}
+	s := NewShiftStore()
+	s.SetBackend(backend)
+
+	done := make(chan struct{})
+	go func() {
+		s.StartShift(Shift{ID: "a", ZoneID: "use1-az1"})
+		close(done)
+	}()
+	<-backend.saving
+
+	// The store can be read while the backend is saving
+	_, ok := s.ShiftForZone("use1-az1", false)
+	assert.True(t, ok)
+
+	close(backend.release)
+	<-done
+	require.Len(t, backend.saved, 1)
+
+	// A snapshot older than the last one saved is dropped
+	_, ok = s.EndShift("use1-az1", false)
+	require.True(t, ok)
+	s.persist(shiftSnapshot{backend: backend, shifts: []Shift{{ID: "a", ZoneID: "use1-az1"}}, version: 1})
+	assert.Len(t, backend.saved, 2)
+	assert.Empty(t, backend.saved[1])
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SNS message types
+const (
+	snsSubscriptionConfirmation = "SubscriptionConfirmation"
+	snsNotification             = "Notification"
+	snsUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// snsMessageTypeLabel returns the metric label for an SNS message type,
+// folding the types that are not handled into one
+func snsMessageTypeLabel(messageType string) string {
+	switch messageType {
+	case snsSubscriptionConfirmation, snsNotification, snsUnsubscribeConfirmation:
+		return messageType
+	}
+	return "unsupported"
+}
+
+// maxTrackedTopics limits the topics tracked when allowedTopics does not
+// name them, so messages for made-up topics cannot grow the state without bound
+const maxTrackedTopics = 20
+
+// subscriptionState is what this replica has seen of the subscription to one topic
+type subscriptionState struct {
+	Confirmed      bool
+	ConfirmedAt    time.Time
+	UnsubscribedAt time.Time
+	LastMessageAt  time.Time
+	// Silent is set once no message has arrived within the silence window
+	Silent bool
+}
+
+// subscriptionTracker records the subscription state of each SNS topic
+type subscriptionTracker struct {
+	mu      sync.Mutex
+	started time.Time
+	topics  map[string]*subscriptionState
+}
+
+func newSubscriptionTracker(now time.Time) *subscriptionTracker {
+	return &subscriptionTracker{started: now, topics: map[string]*subscriptionState{}}
+}
+
+// subscriptions tracks the topics this replica receives messages from
+var subscriptions = newSubscriptionTracker(time.Now())
+
+// state returns the state of topic, creating it if the topic may be tracked.
+// The caller holds mu.
+func (t *subscriptionTracker) state(topic string) *subscriptionState {
+	if s, ok := t.topics[topic]; ok {
+		return s
+	}
+	if topic == "" || (len(appConfig.AllowedTopics) == 0 && len(t.topics) >= maxTrackedTopics) {
+		return nil
+	}
+	s := &subscriptionState{}
+	t.topics[topic] = s
+	return s
+}
+
+// received records a message of any type from topic
+func (t *subscriptionTracker) received(topic string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.state(topic); s != nil {
+		s.LastMessageAt = now
+		if s.Silent {
+			s.Silent = false
+			slog.Info("Messages from topic resumed", "topic_arn", topic)
+		}
+	}
+}
+
+// confirmed records that the subscription to topic was confirmed
+func (t *subscriptionTracker) confirmed(topic string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.state(topic); s != nil {
+		s.Confirmed, s.ConfirmedAt = true, now
+	}
+}
+
+// unsubscribed records that the subscription to topic was removed
+func (t *subscriptionTracker) unsubscribed(topic string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.state(topic); s != nil {
+		s.Confirmed, s.UnsubscribedAt = false, now
+	}
+}
+
+// snapshot returns a copy of the state of every tracked topic, including
+// allowed topics nothing has arrived from yet
+func (t *subscriptionTracker) snapshot() map[string]subscriptionState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, topic := range appConfig.AllowedTopics {
+		t.state(topic)
+	}
+	states := make(map[string]subscriptionState, len(t.topics))
+	for topic, s := range t.topics {
+		states[topic] = *s
+	}
+	return states
+}
+
+// silentSince returns when the silence of s started: its last message, or
+// when tracking started if nothing has arrived yet
+func (t *subscriptionTracker) silentSince(s subscriptionState) time.Time {
+	if s.LastMessageAt.IsZero() {
+		return t.started
+	}
+	return s.LastMessageAt
+}
+
+// checkSilence marks the topics nothing has arrived from within window as
+// silent, returning those that were not already
+func (t *subscriptionTracker) checkSilence(now time.Time, window time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, topic := range appConfig.AllowedTopics {
+		t.state(topic)
+	}
+	var silenced []string
+	for topic, s := range t.topics {
+		if !s.Silent && now.Sub(t.silentSince(*s)) > window {
+			s.Silent = true
+			silenced = append(silenced, topic)
+		}
+	}
+	slices.Sort(silenced)
+	return silenced
+}
+
+// runSubscriptionWatcher raises an alert for each topic that goes quiet for
+// longer than window, until ctx is done
+func runSubscriptionWatcher(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(max(window/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			alertSilentTopics(now, window)
+		}
+	}
+}
+
+// alertSilentTopics logs and notifies about every topic that has just gone
+// silent. Only the leader checks, so a silence is reported once, not by every replica.
+func alertSilentTopics(now time.Time, window time.Duration) {
+	if !leading.Load() {
+		return
+	}
+	for _, topic := range subscriptions.checkSilence(now, window) {
+		slog.Warn("No SNS message received from topic within the silence window", "topic_arn", topic, "window", window)
+		notifier.Load().Notify(Notification{
+			Kind:     notifySubscriptionSilent,
+			TopicArn: topic,
+			Error:    fmt.Sprintf("nothing received for more than %s", window),
+			Time:     now,
+		})
+	}
+}
+
+// isHeartbeat reports whether event is a scheduled EventBridge event sent to
+// the topic to show that delivery works
+func isHeartbeat(event Event) bool {
+	return event.Source == "aws.events" && event.DetailType == "Scheduled Event"
+}
+
+func init() {
+	prometheus.MustRegister(subscriptionsCollector{
+		confirmed:   prometheus.NewDesc(metricsNamespace+"_sns_subscription_confirmed", "Whether the subscription to each SNS topic is confirmed.", []string{"topic_arn"}, nil),
+		confirmedAt: prometheus.NewDesc(metricsNamespace+"_sns_subscription_confirmed_timestamp_seconds", "When the subscription to each SNS topic was last confirmed.", []string{"topic_arn"}, nil),
+		lastMessage: prometheus.NewDesc(metricsNamespace+"_sns_last_message_timestamp_seconds", "When a message last arrived from each SNS topic.", []string{"topic_arn"}, nil),
+		silent:      prometheus.NewDesc(metricsNamespace+"_sns_subscription_silent", "Whether nothing has arrived from each SNS topic within the silence window.", []string{"topic_arn"}, nil),
+	})
+}
+
+// subscriptionsCollector reports the tracked subscriptions at scrape time
+type subscriptionsCollector struct {
+	confirmed, confirmedAt, lastMessage, silent *prometheus.Desc
+}
+
+func (c subscriptionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.confirmed
+	ch <- c.confirmedAt
+	ch <- c.lastMessage
+	ch <- c.silent
+}
+
+func (c subscriptionsCollector) Collect(ch chan<- prometheus.Metric) {
+	for topic, s := range subscriptions.snapshot() {
+		ch <- prometheus.MustNewConstMetric(c.confirmed, prometheus.GaugeValue, boolValue(s.Confirmed), topic)
+		if !s.ConfirmedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.confirmedAt, prometheus.GaugeValue, float64(s.ConfirmedAt.Unix()), topic)
+		}
+		if !s.LastMessageAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.lastMessage, prometheus.GaugeValue, float64(s.LastMessageAt.Unix()), topic)
+		}
+		if appConfig.SNSSilenceWindow.Duration > 0 {
+			ch <- prometheus.MustNewConstMetric(c.silent, prometheus.GaugeValue, boolValue(s.Silent), topic)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestSubscriptions replaces the subscription tracker with one started at started
+func useTestSubscriptions(t *testing.T, started time.Time) *subscriptionTracker {
+	original := subscriptions
+	subscriptions = newSubscriptionTracker(started)
+	t.Cleanup(func() { subscriptions = original })
+	return subscriptions
+}
+
+// sendSNS posts msg to the SNS endpoint signed like SNS would
+func sendSNS(t *testing.T, msg SNSMessage) int {
+	return postSNS(t, signSNSMessage(t, msg))
+}
+
+// postSNS posts msg to the SNS endpoint as is
+func postSNS(t *testing.T, msg SNSMessage) int {
+	body, err := json.Marshal(msg)
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/sns", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestSNSMessageTypes(t *testing.T) {
+	useTestHTTPClient(t, http.StatusOK)
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+	tracker := useTestSubscriptions(t, time.Now())
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+
+	assert.Equal(t, http.StatusOK, sendSNS(t, SNSMessage{Type: "SubscriptionConfirmation", TopicArn: testTopicArn, SubscribeURL: testSubscribeURL}))
+	state := tracker.snapshot()[testTopicArn]
+	assert.True(t, state.Confirmed)
+	assert.False(t, state.ConfirmedAt.IsZero())
+
+	// A heartbeat counts as a message but is not queued
+	heartbeat := `{"version": "0", "id": "hb-1", "detail-type": "Scheduled Event", "source": "aws.events", "region": "us-east-1", "detail": {}}`
+	assert.Equal(t, http.StatusOK, sendSNS(t, SNSMessage{Type: "Notification", TopicArn: testTopicArn, Message: heartbeat}))
+	pending, err := queue.Pending(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Unsubscribing is acknowledged, not parsed as an event
+	assert.Equal(t, http.StatusOK, sendSNS(t, SNSMessage{Type: "UnsubscribeConfirmation", TopicArn: testTopicArn, SubscribeURL: testSubscribeURL}))
+	state = tracker.snapshot()[testTopicArn]
+	assert.False(t, state.Confirmed)
+	assert.False(t, state.UnsubscribedAt.IsZero())
+
+	unsupported := testutil.ToFloat64(snsMessagesTotal.WithLabelValues("unsupported"))
+	assert.Equal(t, http.StatusBadRequest, postSNS(t, SNSMessage{Type: "SomethingNew", TopicArn: testTopicArn}))
+	assert.Equal(t, unsupported+1, testutil.ToFloat64(snsMessagesTotal.WithLabelValues("unsupported")))
+}
+
+func TestSubscriptionSilence(t *testing.T) {
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useTestConfig(t, func(c *Config) {
+		c.AllowedTopics = []string{testTopicArn, "arn:aws:sns:us-east-1:123456789012:other"}
+		c.SNSSilenceWindow.Duration = time.Hour
+	})
+	tracker := useTestSubscriptions(t, started)
+
+	// Allowed topics are tracked from the start, even before anything arrives
+	assert.Empty(t, tracker.checkSilence(started.Add(30*time.Minute), time.Hour))
+	tracker.received(testTopicArn, started.Add(50*time.Minute))
+	assert.Equal(t, []string{"arn:aws:sns:us-east-1:123456789012:other"}, tracker.checkSilence(started.Add(61*time.Minute), time.Hour))
+
+	// Each topic is reported once per silence
+	assert.Empty(t, tracker.checkSilence(started.Add(90*time.Minute), time.Hour))
+	assert.Equal(t, []string{testTopicArn}, tracker.checkSilence(started.Add(111*time.Minute), time.Hour))
+
+	tracker.received(testTopicArn, started.Add(2*time.Hour))
+	assert.False(t, tracker.snapshot()[testTopicArn].Silent)
+
+	expected := `
+# HELP zonal_shift_sns_subscription_silent Whether nothing has arrived from each SNS topic within the silence window.
+# TYPE zonal_shift_sns_subscription_silent gauge
+zonal_shift_sns_subscription_silent{topic_arn="arn:aws:sns:us-east-1:123456789012:other"} 1
+zonal_shift_sns_subscription_silent{topic_arn="arn:aws:sns:us-east-1:123456789012:zonal-shift"} 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "zonal_shift_sns_subscription_silent"))
+}
+
+func TestOnlyTheLeaderAlertsOnSilence(t *testing.T) {
+	started := time.Now()
+	useTestConfig(t, func(c *Config) { c.AllowedTopics = []string{testTopicArn} })
+	tracker := useTestSubscriptions(t, started)
+	webhook := &recordingServer{}
+	server := httptest.NewServer(webhook)
+	defer server.Close()
+	n, err := NewNotifier([]Sink{&webhookSink{url: server.URL, client: server.Client()}}, nil)
+	require.NoError(t, err)
+	original, originalLeading := notifier.Swap(n), leading.Load()
+	t.Cleanup(func() {
+		notifier.Store(original)
+		leading.Store(originalLeading)
+	})
+
+	leading.Store(false)
+	alertSilentTopics(started.Add(2*time.Hour), time.Hour)
+	n.Wait()
+	assert.Empty(t, webhook.requests)
+	assert.False(t, tracker.snapshot()[testTopicArn].Silent)
+
+	leading.Store(true)
+	alertSilentTopics(started.Add(2*time.Hour), time.Hour)
+	n.Wait()
+	require.Len(t, webhook.requests, 1)
+	assert.Equal(t, notifySubscriptionSilent, webhook.requests[0]["kind"])
+}
+
+func TestSubscriptionTrackingIsBounded(t *testing.T) {
+	useTestConfig(t, func(c *Config) {})
+	tracker := useTestSubscriptions(t, time.Now())
+	for i := range maxTrackedTopics + 5 {
+		tracker.received("arn:aws:sns:us-east-1:123456789012:topic-"+strings.Repeat("x", i), time.Now())
+	}
+	assert.Len(t, tracker.snapshot(), maxTrackedTopics)
+}
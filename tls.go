@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Client certificate modes for the tls.clientAuth setting
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// clientPrincipal returns the principal of the verified client certificate on
+// r when its common name is one of names
+func clientPrincipal(r *http.Request, names []string) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" || !slices.Contains(names, name) {
+		return "", false
+	}
+	return "x509:CN=" + name, true
+}
+
+// tlsReloader serves the certificate and client CA in TLSConfig, reloading
+// them when the files change, such as when a mounted Secret is rotated
+type tlsReloader struct {
+	config TLSConfig
+
+	mu      sync.Mutex
+	current *tls.Config
+	modTime time.Time
+}
+
+// newTLSReloader loads the files named in c, failing if they cannot be used
+func newTLSReloader(c TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{config: c}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// serverConfig returns the tls.Config for the HTTP server. Each handshake
+// picks up files changed since the last one.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config, err := r.load()
+			if err != nil {
+				// Keep serving with the last good files until the new ones are complete
+				slog.Error("Failed to reload TLS files, serving the previous ones", "error", err)
+			}
+			return config, nil
+		},
+	}
+}
+
+// load returns the current tls.Config, rebuilding it if any file has changed
+func (r *tlsReloader) load() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return r.current, err
+	}
+	if r.current != nil && modTime.Equal(r.modTime) {
+		return r.current, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return r.current, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+	}
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return r.current, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return r.current, errors.New("client CA file contains no certificates")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.config.ClientAuth == clientAuthRequire {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if r.current != nil {
+		slog.Info("Reloaded TLS files", "cert_file", r.config.CertFile)
+	}
+	r.current, r.modTime = config, modTime
+	return config, nil
+}
+
+// latestModTime returns when any of the TLS files last changed
+func (r *tlsReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS file: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue writes a certificate with the given serial number and its key to dir
+func (ca *testCA) issue(t *testing.T, dir string, serial int64, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func (ca *testCA) writeCert(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	return path
+}
+
+// startTLSServer serves a 200 on every path with the reloader's configuration
+func startTLSServer(t *testing.T, reloader *tlsReloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = reloader.serverConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serverSerial makes a request to server and returns the serial number of the certificate it presents
+func serverSerial(t *testing.T, server *httptest.Server, config *tls.Config) (int64, error) {
+	// A fresh transport so every request makes a new handshake
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestTLSReloadsRotatedCertificate(t *testing.T) {
+	ca, dir := newTestCA(t), t.TempDir()
+	certFile, keyFile := ca.issue(t, dir, 100, x509.ExtKeyUsageServerAuth)
+	reloader, err := newTLSReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	server := startTLSServer(t, reloader)
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+
+	serial, err := serverSerial(t, server, client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), serial)
+
+	// Rotating the Secret replaces both files; new connections get the new certificate
+	ca.issue(t, dir, 200, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	serial, err = serverSerial(t, server, client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), serial)
+
+	// A broken file keeps the last good certificate in service
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0o600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	serial, err = serverSerial(t, server, client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), serial)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, serverDir, clientDir := newTestCA(t), t.TempDir(), t.TempDir()
+	certFile, keyFile := ca.issue(t, serverDir, 100, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, clientDir, 300, x509.ExtKeyUsageClientAuth)
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	withCert := &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: []tls.Certificate{pair}}
+	withoutCert := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+	otherCA := newTestCA(t)
+	otherCert, otherKey := otherCA.issue(t, t.TempDir(), 400, x509.ExtKeyUsageClientAuth)
+	otherPair, err := tls.LoadX509KeyPair(otherCert, otherKey)
+	require.NoError(t, err)
+	withOtherCert := &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: []tls.Certificate{otherPair}}
+
+	tlsConfig := TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.writeCert(t, serverDir), ClientAuth: clientAuthRequire}
+	reloader, err := newTLSReloader(tlsConfig)
+	require.NoError(t, err)
+	server := startTLSServer(t, reloader)
+	_, err = serverSerial(t, server, withCert)
+	assert.NoError(t, err)
+	_, err = serverSerial(t, server, withoutCert)
+	assert.Error(t, err)
+	_, err = serverSerial(t, server, withOtherCert)
+	assert.Error(t, err)
+
+	// Optional verification lets callers without a certificate through, such as SNS
+	tlsConfig.ClientAuth = clientAuthOptional
+	reloader, err = newTLSReloader(tlsConfig)
+	require.NoError(t, err)
+	server = startTLSServer(t, reloader)
+	_, err = serverSerial(t, server, withoutCert)
+	assert.NoError(t, err)
+	_, err = serverSerial(t, server, withOtherCert)
+	assert.Error(t, err)
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig([]string{"--tls-client-auth", "require"})
+	assert.ErrorContains(t, err, "tls.clientAuth require requires tls.certFile and tls.clientCAFile")
+	_, err = loadConfig([]string{"--tls-client-auth", "sometimes"})
+	assert.ErrorContains(t, err, `unknown tls.clientAuth "sometimes"`)
+	_, err = loadConfig([]string{"--tls-client-ca-file", "ca.crt"})
+	assert.ErrorContains(t, err, "tls.clientCAFile requires tls.clientAuth optional or require")
+	_, err = loadConfig([]string{"--tls-admin-clients", "ops-console"})
+	assert.ErrorContains(t, err, "tls.adminClients and tls.eventClients require tls.clientAuth optional or require")
+	_, err = loadConfig([]string{"--probe-address", ":8080"})
+	assert.ErrorContains(t, err, "probeAddress must differ from listenAddress")
+}
+
+func TestProbeRouterIsSeparate(t *testing.T) {
+	get := func(router http.Handler, path string) int {
+		req, err := http.NewRequest("GET", path, nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	events, probes := newEventRouter(), newProbeRouter()
+	assert.Equal(t, http.StatusNotFound, get(events, "/metrics"))
+	assert.Equal(t, http.StatusNotFound, get(events, "/healthz"))
+	assert.Equal(t, http.StatusOK, get(probes, "/metrics"))
+	assert.Equal(t, http.StatusOK, get(probes, "/healthz"))
+	assert.Equal(t, http.StatusNotFound, get(probes, "/api/v1/shifts"))
+}
+
+// withClientCert marks req as arriving with a verified client certificate named commonName
+func withClientCert(req *http.Request, commonName string) *http.Request {
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: commonName}}}}}
+	return req
+}
+
+func TestClientCertificatesAuthenticate(t *testing.T) {
+	useTestProcessor(t, NewProcessor(newTestClient(), testZones))
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	useTestConfig(t, func(c *Config) {
+		c.TLS.AdminClients, c.TLS.EventClients = []string{"ops-console"}, []string{"incident-bot"}
+	})
+	serve := func(req *http.Request) int {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	admin := func(commonName string) int {
+		req := httptest.NewRequest("GET", "/api/v1/shifts", nil)
+		if commonName != "" {
+			withClientCert(req, commonName)
+		}
+		return serve(req)
+	}
+	assert.Equal(t, http.StatusOK, admin("ops-console"))
+	assert.Equal(t, http.StatusUnauthorized, admin("incident-bot"))
+	assert.Equal(t, http.StatusUnauthorized, admin(""))
+
+	// Direct events are accepted from an event client while the shared credentials are disabled
+	event := func(commonName string) int {
+		return serve(withClientCert(httptest.NewRequest("POST", "/sns", strings.NewReader(testDirectEvent)), commonName))
+	}
+	assert.Equal(t, http.StatusUnauthorized, event("ops-console"))
+	assert.Equal(t, http.StatusOK, event("incident-bot"))
+	pending, err := queue.Pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "x509:CN=incident-bot", pending[0].Principal)
+}
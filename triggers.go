@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Detail types of the events trigger rules produce. The ended one is seen
+// as a shift end by isShiftEnd.
+const (
+	triggerStarted = "Impairment Started"
+	triggerEnded   = "Impairment Ended"
+)
+
+// TriggerRule maps events from a source other than ARC, such as AWS Health or
+// FIS, to shifts. Paths are dotted, such as detail.new-state.status, with
+// numbers indexing arrays.
+type TriggerRule struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// DetailTypes, if set, limits the detail types the rule matches
+	DetailTypes []string `json:"detailTypes,omitempty"`
+	// Match, if set, requires the value at each path to be one of the listed values
+	Match map[string][]string `json:"match,omitempty"`
+	// ZoneIDPath is where the event names the impaired zone, by ID or name.
+	// ZoneID is used instead when the event does not name one, such as for
+	// an experiment template that always targets the same zone.
+	ZoneIDPath string `json:"zoneIdPath,omitempty"`
+	ZoneID     string `json:"zoneId,omitempty"`
+	// StatePath, if set, is where the event says whether the impairment has
+	// started or ended. Events with a state in neither list are skipped.
+	StatePath   string   `json:"statePath,omitempty"`
+	StartStates []string `json:"startStates,omitempty"`
+	EndStates   []string `json:"endStates,omitempty"`
+	// NotesPath, if set, is where the event describes the impairment
+	NotesPath string `json:"notesPath,omitempty"`
+}
+
+// validate reports the mistakes in a rule
+func (r TriggerRule) validate() []error {
+	var errs []error
+	if r.Name == "" {
+		errs = append(errs, errors.New("triggers: every rule needs a name"))
+	}
+	if r.Source == "" {
+		errs = append(errs, fmt.Errorf("trigger %q needs a source", r.Name))
+	}
+	if slices.Contains(arcSources, r.Source) {
+		errs = append(errs, fmt.Errorf("trigger %q cannot match ARC source %q", r.Name, r.Source))
+	}
+	if (r.ZoneIDPath == "") == (r.ZoneID == "") {
+		errs = append(errs, fmt.Errorf("trigger %q needs exactly one of zoneIdPath and zoneId", r.Name))
+	}
+	if r.StatePath == "" && (len(r.StartStates) > 0 || len(r.EndStates) > 0) {
+		errs = append(errs, fmt.Errorf("trigger %q needs statePath for startStates and endStates", r.Name))
+	}
+	if r.StatePath != "" && len(r.StartStates) == 0 {
+		errs = append(errs, fmt.Errorf("trigger %q needs startStates with statePath", r.Name))
+	}
+	return errs
+}
+
+// validateTriggers checks every rule and that their names are unique
+func validateTriggers(rules []TriggerRule) []error {
+	var errs []error
+	names := map[string]bool{}
+	for _, rule := range rules {
+		errs = append(errs, rule.validate()...)
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("duplicate trigger name %q", rule.Name))
+		}
+		names[rule.Name] = true
+	}
+	return errs
+}
+
+// decodeEvent decodes a received EventBridge event. Events matched by a
+// trigger rule are mapped to a shift event; a non-empty skip says why a
+// matched event is not acted on. Other events are parsed by parseEvent.
+func decodeEvent(data []byte) (event Event, skip string, err error) {
+	var envelope Event
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return Event{}, "", err
+	}
+	for _, rule := range appConfig.Triggers {
+		if rule.Source != envelope.Source || (len(rule.DetailTypes) > 0 && !slices.Contains(rule.DetailTypes, envelope.DetailType)) {
+			continue
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return Event{}, "", err
+		}
+		if !rule.matches(doc) {
+			continue
+		}
+		return rule.apply(envelope, doc)
+	}
+	event, err = parseEvent(data)
+	return event, "", err
+}
+
+// matches reports whether doc has every value the rule's Match requires
+func (r TriggerRule) matches(doc interface{}) bool {
+	for path, values := range r.Match {
+		value, ok := lookupPath(doc, path)
+		if !ok || !slices.Contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply maps an event the rule matches to the shift event updateKarpenterNodePool consumes
+func (r TriggerRule) apply(envelope Event, doc interface{}) (Event, string, error) {
+	detailType := triggerStarted
+	if r.StatePath != "" {
+		state, _ := lookupPath(doc, r.StatePath)
+		switch {
+		case slices.Contains(r.EndStates, state):
+			detailType = triggerEnded
+		case !slices.Contains(r.StartStates, state):
+			return envelope, fmt.Sprintf("trigger %q does not act on state %q", r.Name, state), nil
+		}
+	}
+
+	zone := r.ZoneID
+	if r.ZoneIDPath != "" {
+		value, ok := lookupPath(doc, r.ZoneIDPath)
+		if !ok || value == "" {
+			return Event{}, "", fmt.Errorf("trigger %q found no zone at %s", r.Name, r.ZoneIDPath)
+		}
+		zone = value
+	}
+
+	notes := fmt.Sprintf("%s (%s) matched trigger %q", envelope.DetailType, envelope.Source, r.Name)
+	if r.NotesPath != "" {
+		if value, ok := lookupPath(doc, r.NotesPath); ok && value != "" {
+			notes += ": " + value
+		}
+	}
+	return Event{
+		Version:    envelope.Version,
+		ID:         envelope.ID,
+		DetailType: detailType,
+		Source:     envelope.Source,
+		Account:    envelope.Account,
+		Time:       envelope.Time,
+		Region:     envelope.Region,
+		Resources:  envelope.Resources,
+		Detail:     Detail{Metadata: Metadata{AwayFrom: zone, Notes: notes}},
+	}, "", nil
+}
+
+// lookupPath returns the value at a dotted path in a decoded JSON document as
+// a string. Numbers and booleans are formatted; objects and arrays are not found.
+func lookupPath(doc interface{}, path string) (string, bool) {
+	current := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			current = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTriggers are the example rules from the README
+var testTriggers = []TriggerRule{
+	{
+		Name:        "health-ec2",
+		Source:      "aws.health",
+		DetailTypes: []string{"AWS Health Event"},
+		Match:       map[string][]string{"detail.eventTypeCode": {"AWS_EC2_OPERATIONAL_ISSUE"}},
+		ZoneIDPath:  "detail.affectedEntities.0.entityValue",
+		StatePath:   "detail.statusCode",
+		StartStates: []string{"open"},
+		EndStates:   []string{"closed"},
+		NotesPath:   "detail.eventDescription.0.latestDescription",
+	},
+	{
+		Name:        "fis-az-power",
+		Source:      "aws.fis",
+		DetailTypes: []string{"FIS Experiment State Change"},
+		Match:       map[string][]string{"detail.experiment-template-id": {"EXTaz-power-use1-az2"}},
+		ZoneID:      "use1-az2",
+		StatePath:   "detail.new-state.status",
+		StartStates: []string{"running"},
+		EndStates:   []string{"completed", "stopped", "failed"},
+	},
+}
+
+func readTriggerSample(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "triggers", name))
+	require.NoError(t, err)
+	return data
+}
+
+func TestTriggerRulesMapEvents(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.Triggers = testTriggers })
+
+	event, skip, err := decodeEvent(readTriggerSample(t, "health-ec2-operational-issue.json"))
+	require.NoError(t, err)
+	assert.Empty(t, skip)
+	assert.Equal(t, triggerStarted, event.DetailType)
+	assert.Equal(t, "aws.health", event.Source)
+	assert.Equal(t, "7405c0b0-3f3e-4bb4-9d2a-6a1e0c2c5b11", event.ID)
+	assert.Equal(t, "use1-az1", event.Detail.Metadata.AwayFrom)
+	assert.True(t, strings.HasPrefix(event.Detail.Metadata.Notes, `AWS Health Event (aws.health) matched trigger "health-ec2": We are investigating`))
+	assert.NoError(t, validateEvent(event))
+	assert.False(t, isShiftEnd(event))
+
+	closed := bytes.Replace(readTriggerSample(t, "health-ec2-operational-issue.json"), []byte(`"open"`), []byte(`"closed"`), 1)
+	event, _, err = decodeEvent(closed)
+	require.NoError(t, err)
+	assert.True(t, isShiftEnd(event))
+
+	event, skip, err = decodeEvent(readTriggerSample(t, "fis-az-power-interruption.json"))
+	require.NoError(t, err)
+	assert.Empty(t, skip)
+	assert.Equal(t, "use1-az2", event.Detail.Metadata.AwayFrom)
+	assert.Equal(t, []string{"arn:aws:fis:us-east-1:123456789012:experiment/EXPabcdef1234567"}, event.Resources)
+
+	// States in neither list are skipped
+	pending := bytes.Replace(readTriggerSample(t, "fis-az-power-interruption.json"), []byte(`"running"`), []byte(`"pending"`), 1)
+	_, skip, err = decodeEvent(pending)
+	require.NoError(t, err)
+	assert.Equal(t, `trigger "fis-az-power" does not act on state "pending"`, skip)
+
+	// Other experiments match no rule and are read as they come
+	other := bytes.Replace(readTriggerSample(t, "fis-az-power-interruption.json"), []byte(`EXTaz-power-use1-az2`), []byte(`EXTother`), 1)
+	event, skip, err = decodeEvent(other)
+	require.NoError(t, err)
+	assert.Empty(t, skip)
+	assert.Equal(t, "FIS Experiment State Change", event.DetailType)
+	assert.Error(t, validateEvent(event))
+
+	// A matched event that does not name its zone is refused
+	noZone := bytes.Replace(readTriggerSample(t, "health-ec2-operational-issue.json"), []byte(`"entityValue"`), []byte(`"entityArn"`), 1)
+	_, _, err = decodeEvent(noZone)
+	assert.ErrorContains(t, err, `trigger "health-ec2" found no zone at detail.affectedEntities.0.entityValue`)
+}
+
+func TestTriggeredShiftNarrowsNodePools(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b", "us-east-1c")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.Triggers = testTriggers })
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+
+	body, err := json.Marshal(signSNSMessage(t, SNSMessage{Type: "Notification", Message: string(readTriggerSample(t, "fis-az-power-interruption.json"))}))
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", "/sns", bytes.NewReader(body))
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	pending, err := queue.Pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	record, err := processReceivedEvent(context.Background(), pending[0].Event, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, outcomeApplied, record.Outcome)
+	assert.Equal(t, []string{"us-east-1b"}, getTestNodePool(t, client, "default").removedZones())
+}
+
+func TestTriggerValidation(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig([]string{"--config", writeConfigFile(t, `
+triggers:
+- name: health
+  source: aws.health
+  zoneIdPath: detail.affectedEntities.0.entityValue
+  zoneId: use1-az1
+- name: health
+  source: aws.arc
+  zoneId: use1-az1
+  endStates: [closed]
+`)})
+	require.Error(t, err)
+	for _, message := range []string{
+		`trigger "health" needs exactly one of zoneIdPath and zoneId`,
+		`duplicate trigger name "health"`,
+		`trigger "health" cannot match ARC source "aws.arc"`,
+		`trigger "health" needs statePath for startStates and endStates`,
+	} {
+		assert.ErrorContains(t, err, message)
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"a": {"b": [{"c": "x"}, {"c": 2}], "d": true, "e": {}}}`), &doc))
+	for path, want := range map[string]string{"a.b.0.c": "x", "a.b.1.c": "2", "a.d": "true"} {
+		value, ok := lookupPath(doc, path)
+		assert.True(t, ok, path)
+		assert.Equal(t, want, value, path)
+	}
+	for _, path := range []string{"a.b.2.c", "a.b.x", "a.e", "a.missing", "a.d.f"} {
+		_, ok := lookupPath(doc, path)
+		assert.False(t, ok, path)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// ZonalShift condition types
+	conditionApplied          = "Applied"
+	conditionPartiallyApplied = "PartiallyApplied"
+	conditionRefused          = "Refused"
+	conditionRestored         = "Restored"
+
+	// outcomeRestored is the outcome of a NodePool given its zone back
+	outcomeRestored = "restored"
+
+	// defaultZonalShiftRetention is how long a restored ZonalShift is kept
+	defaultZonalShiftRetention = 24 * time.Hour
+)
+
+var zonalShiftGVR = schema.GroupVersionResource{Group: "zonalshift.karpenter.aws", Version: "v1alpha1", Resource: "zonalshifts"}
+
+// ZonalShift is the cluster-scoped custom resource recording one shift and
+// what it did to each NodePool. Its schema is in zonalshift-crd.yaml.
+type ZonalShift struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ZonalShiftSpec   `json:"spec"`
+	Status            ZonalShiftStatus `json:"status,omitempty"`
+}
+
+// ZonalShiftSpec describes the shift
+type ZonalShiftSpec struct {
+	// ShiftID is the ID of the shift in the admin API, which may not be a valid object name
+	ShiftID   string       `json:"shiftID"`
+	ZoneID    string       `json:"zoneID"`
+	Zone      string       `json:"zone,omitempty"`
+	Region    string       `json:"region,omitempty"`
+	Source    string       `json:"source"`
+	EventID   string       `json:"eventID,omitempty"`
+	Reason    string       `json:"reason,omitempty"`
+	StartedAt metav1.Time  `json:"startedAt"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	Resources []string     `json:"resources,omitempty"`
+	NodePools []string     `json:"nodePools,omitempty"`
+	// Practice marks the shift of a rehearsed practice run
+	Practice bool `json:"practice,omitempty"`
+}
+
+// ZonalShiftStatus reports what the shift did
+type ZonalShiftStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	NodePools  []NodePoolOutcome  `json:"nodePools,omitempty"`
+	RestoredAt *metav1.Time       `json:"restoredAt,omitempty"`
+}
+
+// NodePoolOutcome is what the shift did to one NodePool
+type NodePoolOutcome struct {
+	Name string `json:"name"`
+	// Outcome is applied, refused, failed or restored
+	Outcome string `json:"outcome"`
+	// Zones are the zones the NodePool was left with
+	Zones   []string `json:"zones,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// shift returns the active shift the object records
+func (z *ZonalShift) shift() Shift {
+	shift := Shift{
+		ID:        z.Spec.ShiftID,
+		ZoneID:    z.Spec.ZoneID,
+		Zone:      z.Spec.Zone,
+		Region:    z.Spec.Region,
+		Source:    z.Spec.Source,
+		EventID:   z.Spec.EventID,
+		Reason:    z.Spec.Reason,
+		StartedAt: z.Spec.StartedAt.Time,
+		Resources: z.Spec.Resources,
+		NodePools: z.Spec.NodePools,
+		Practice:  z.Spec.Practice,
+	}
+	if z.Spec.ExpiresAt != nil {
+		shift.ExpiresAt = &z.Spec.ExpiresAt.Time
+	}
+	return shift
+}
+
+// zonalShiftSpec describes a shift as a ZonalShift spec
+func zonalShiftSpec(shift Shift) ZonalShiftSpec {
+	spec := ZonalShiftSpec{
+		ShiftID:   shift.ID,
+		ZoneID:    shift.ZoneID,
+		Zone:      shift.Zone,
+		Region:    shift.Region,
+		Source:    shift.Source,
+		EventID:   shift.EventID,
+		Reason:    shift.Reason,
+		StartedAt: metav1.NewTime(shift.StartedAt),
+		Resources: shift.Resources,
+		NodePools: shift.NodePools,
+		Practice:  shift.Practice,
+	}
+	if shift.ExpiresAt != nil {
+		expiresAt := metav1.NewTime(*shift.ExpiresAt)
+		spec.ExpiresAt = &expiresAt
+	}
+	return spec
+}
+
+// restored reports whether the shift has ended
+func (z *ZonalShift) restored() bool {
+	return meta.IsStatusConditionTrue(z.Status.Conditions, conditionRestored)
+}
+
+// setOutcomes merges the outcome of each change into the per-pool outcomes
+// and recomputes the Applied, PartiallyApplied and Refused conditions
+func (z *ZonalShift) setOutcomes(changes []NodePoolChange) {
+	for _, change := range changes {
+		outcome := NodePoolOutcome{Name: change.Name, Outcome: outcomeApplied, Zones: change.NewZones}
+		switch {
+		case change.Refused != "":
+			outcome.Outcome, outcome.Zones, outcome.Message = outcomeRefused, change.OldZones, change.Refused
+		case change.Error != "":
+			outcome.Outcome, outcome.Zones, outcome.Message = outcomeFailed, change.OldZones, change.Error
+		case change.Restore:
+			outcome.Outcome = outcomeRestored
+		}
+		i := slices.IndexFunc(z.Status.NodePools, func(o NodePoolOutcome) bool { return o.Name == change.Name })
+		if i < 0 {
+			z.Status.NodePools = append(z.Status.NodePools, outcome)
+		} else {
+			z.Status.NodePools[i] = outcome
+		}
+	}
+	slices.SortFunc(z.Status.NodePools, func(a, b NodePoolOutcome) int { return strings.Compare(a.Name, b.Name) })
+
+	var applied, refused, failed []string
+	for _, o := range z.Status.NodePools {
+		switch o.Outcome {
+		case outcomeApplied, outcomeRestored:
+			applied = append(applied, o.Name)
+		case outcomeRefused:
+			refused = append(refused, o.Name)
+		case outcomeFailed:
+			failed = append(failed, o.Name)
+		}
+	}
+	notApplied := len(refused) + len(failed)
+
+	switch {
+	case len(applied) > 0 && notApplied == 0:
+		z.setCondition(conditionApplied, true, "AllNodePoolsShifted", "Zone removed from node pools %s", strings.Join(applied, ", "))
+	case len(applied) > 0:
+		z.setCondition(conditionApplied, false, "SomeNodePoolsNotShifted", "Zone kept by node pools %s", strings.Join(append(refused, failed...), ", "))
+	case len(failed) > 0:
+		z.setCondition(conditionApplied, false, "Failed", "Failed to shift node pools %s", strings.Join(failed, ", "))
+	default:
+		z.setCondition(conditionApplied, false, "NoNodePoolsShifted", "No node pool was shifted")
+	}
+	z.setCondition(conditionPartiallyApplied, len(applied) > 0 && notApplied > 0, "PartiallyApplied",
+		"%d of %d node pools shifted", len(applied), len(applied)+notApplied)
+	if len(refused) > 0 {
+		z.setCondition(conditionRefused, true, "RefusedByPolicy", "Safety policy refused node pools %s", strings.Join(refused, ", "))
+	} else {
+		z.setCondition(conditionRefused, false, "NotRefused", "No node pool was refused")
+	}
+}
+
+func (z *ZonalShift) setCondition(conditionType string, status bool, reason, format string, args ...interface{}) {
+	condition := metav1.Condition{
+		Type:               conditionType,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            fmt.Sprintf(format, args...),
+		ObservedGeneration: z.Generation,
+	}
+	if status {
+		condition.Status = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&z.Status.Conditions, condition)
+}
+
+// zonalShiftName turns a shift ID into a valid object name
+func zonalShiftName(shiftID string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(shiftID), "-"), "-.")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return name
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// zonalShiftBackend keeps a ZonalShift object for every shift. As a
+// ShiftBackend it creates one when a shift starts and marks it Restored when
+// the shift ends, keeping restored shifts for the retention period.
+type zonalShiftBackend struct {
+	client    dynamic.Interface
+	retention time.Duration
+}
+
+// zonalShifts writes ZonalShift objects; setupStateBackend sets it when ZONAL_SHIFT_RESOURCES=true
+var zonalShifts *zonalShiftBackend
+
+func newZonalShiftBackend(client dynamic.Interface, retention time.Duration) *zonalShiftBackend {
+	return &zonalShiftBackend{client: client, retention: retention}
+}
+
+func (b *zonalShiftBackend) list(ctx context.Context) ([]*ZonalShift, error) {
+	start := time.Now()
+	list, err := b.client.Resource(zonalShiftGVR).List(ctx, metav1.ListOptions{})
+	observeAPICall("kubernetes", "list", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zonal shifts: %v", err)
+	}
+	shifts := make([]*ZonalShift, 0, len(list.Items))
+	for i := range list.Items {
+		z, err := decodeZonalShift(&list.Items[i])
+		if err != nil {
+			slog.Warn("Skipping unreadable ZonalShift", "name", list.Items[i].GetName(), "error", err)
+			continue
+		}
+		shifts = append(shifts, z)
+	}
+	return shifts, nil
+}
+
+func (b *zonalShiftBackend) LoadShifts(ctx context.Context) ([]Shift, error) {
+	objects, err := b.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var shifts []Shift
+	for _, z := range objects {
+		if !z.restored() {
+			shifts = append(shifts, z.shift())
+		}
+	}
+	return shifts, nil
+}
+
+func (b *zonalShiftBackend) SaveShifts(ctx context.Context, shifts []Shift) error {
+	objects, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+	active := map[string]bool{}
+	var errs []error
+	for _, shift := range shifts {
+		name := zonalShiftName(shift.ID)
+		active[name] = true
+		errs = append(errs, b.update(ctx, name, func(z *ZonalShift) {
+			z.Spec = zonalShiftSpec(shift)
+			z.Status.RestoredAt = nil
+			z.setCondition(conditionRestored, false, "ShiftActive", "Shift is active")
+		}))
+	}
+	now := time.Now()
+	for _, z := range objects {
+		switch {
+		case active[z.Name]:
+		case !z.restored():
+			errs = append(errs, b.update(ctx, z.Name, func(z *ZonalShift) {
+				restoredAt := metav1.NewTime(now)
+				z.Status.RestoredAt = &restoredAt
+				z.setCondition(conditionRestored, true, "ShiftEnded", "Shift ended and its zone was given back")
+			}))
+		case z.Status.RestoredAt != nil && now.Sub(z.Status.RestoredAt.Time) > b.retention:
+			start := time.Now()
+			err := b.client.Resource(zonalShiftGVR).Delete(ctx, z.Name, metav1.DeleteOptions{})
+			observeAPICall("kubernetes", "delete", start, err)
+			if err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("failed to delete zonal shift %s: %v", z.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RecordOutcomes merges the outcome of each change into the status of a shift's ZonalShift
+func (b *zonalShiftBackend) RecordOutcomes(ctx context.Context, shiftID string, changes []NodePoolChange) error {
+	return b.update(ctx, zonalShiftName(shiftID), func(z *ZonalShift) {
+		z.setOutcomes(changes)
+	})
+}
+
+// update applies mutate to the named ZonalShift, creating it if it does not
+// exist, and writes back whatever part of the spec and status changed
+func (b *zonalShiftBackend) update(ctx context.Context, name string, mutate func(*ZonalShift)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		resource := b.client.Resource(zonalShiftGVR)
+		start := time.Now()
+		obj, err := resource.Get(ctx, name, metav1.GetOptions{})
+		observeAPICall("kubernetes", "get", start, err)
+		exists := err == nil
+		if apierrors.IsNotFound(err) {
+			obj = &unstructured.Unstructured{}
+			obj.SetAPIVersion(zonalShiftGVR.GroupVersion().String())
+			obj.SetKind("ZonalShift")
+			obj.SetName(name)
+		} else if err != nil {
+			return fmt.Errorf("failed to get zonal shift %s: %v", name, err)
+		}
+
+		z, err := decodeZonalShift(obj)
+		if err != nil {
+			return err
+		}
+		mutate(z)
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(z)
+		if err != nil {
+			return fmt.Errorf("failed to encode zonal shift %s: %v", name, err)
+		}
+		updated := &unstructured.Unstructured{Object: content}
+
+		// The spec and the status subresource are written separately
+		var written *unstructured.Unstructured
+		start = time.Now()
+		if exists {
+			written, err = resource.Update(ctx, updated, metav1.UpdateOptions{})
+			observeAPICall("kubernetes", "update", start, err)
+		} else {
+			written, err = resource.Create(ctx, updated, metav1.CreateOptions{})
+			observeAPICall("kubernetes", "create", start, err)
+		}
+		if err != nil {
+			return err
+		}
+		updated.SetResourceVersion(written.GetResourceVersion())
+		start = time.Now()
+		_, err = resource.UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+		observeAPICall("kubernetes", "update", start, err)
+		return err
+	})
+}
+
+// decodeZonalShift converts an unstructured object into a ZonalShift
+func decodeZonalShift(obj *unstructured.Unstructured) (*ZonalShift, error) {
+	var z ZonalShift
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &z); err != nil {
+		return nil, fmt.Errorf("failed to parse zonal shift %s: %v", obj.GetName(), err)
+	}
+	return &z, nil
+}
+
+// recordShiftOutcomes records what an event did to each NodePool on its shift's
+// ZonalShift, logging rather than failing when it cannot be written
+func recordShiftOutcomes(ctx context.Context, shiftID string, changes []NodePoolChange) {
+	if zonalShifts == nil || len(changes) == 0 {
+		return
+	}
+	if err := zonalShifts.RecordOutcomes(ctx, shiftID, changes); err != nil {
+		slog.Error("Failed to record shift outcomes", "shift_id", shiftID, "error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func getTestZonalShift(t *testing.T, client dynamic.Interface, name string) *ZonalShift {
+	obj, err := client.Resource(zonalShiftGVR).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	z, err := decodeZonalShift(obj)
+	require.NoError(t, err)
+	return z
+}
+
+func conditionStatus(z *ZonalShift, conditionType string) metav1.ConditionStatus {
+	if c := meta.FindStatusCondition(z.Status.Conditions, conditionType); c != nil {
+		return c.Status
+	}
+	return ""
+}
+
+func TestZonalShiftRecordsShiftLifecycle(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{nodePoolGVR: "NodePoolList", zonalShiftGVR: "ZonalShiftList"},
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("single", zoneRequirementOf("In", "us-east-1a")),
+	)
+	useTestProcessor(t, NewProcessor(client, testZones))
+	backend := newZonalShiftBackend(client, time.Hour)
+	store.SetBackend(backend)
+	original := zonalShifts
+	zonalShifts = backend
+	t.Cleanup(func() { zonalShifts = original })
+
+	start := testShiftEvent("Autoshift In Progress")
+	start.ID, start.Source = "Event_1", "aws.arc"
+	_, err := updateKarpenterNodePool(context.Background(), start)
+	require.NoError(t, err)
+
+	z := getTestZonalShift(t, client, "event-1")
+	assert.Equal(t, "Event_1", z.Spec.ShiftID)
+	assert.Equal(t, "use1-az1", z.Spec.ZoneID)
+	assert.Equal(t, "aws.arc", z.Spec.Source)
+	assert.NotNil(t, z.Spec.ExpiresAt)
+	assert.Equal(t, metav1.ConditionFalse, conditionStatus(z, conditionApplied))
+	assert.Equal(t, metav1.ConditionTrue, conditionStatus(z, conditionPartiallyApplied))
+	assert.Equal(t, metav1.ConditionTrue, conditionStatus(z, conditionRefused))
+	assert.Equal(t, metav1.ConditionFalse, conditionStatus(z, conditionRestored))
+	assert.Equal(t, []NodePoolOutcome{
+		{Name: "default", Outcome: outcomeApplied, Zones: []string{"us-east-1b"}},
+		{Name: "single", Outcome: outcomeRefused, Zones: []string{"us-east-1a"}, Message: "would leave 0 zone(s), policy requires at least 1"},
+	}, z.Status.NodePools)
+
+	// The objects are a durable record a restarted replica reloads active shifts from
+	reloaded := NewShiftStore()
+	reloaded.SetBackend(backend)
+	require.NoError(t, reloaded.Load(context.Background()))
+	require.Len(t, reloaded.ActiveShifts(), 1)
+	assert.Equal(t, "Event_1", reloaded.ActiveShifts()[0].ID)
+
+	end := testShiftEvent("Autoshift Completed")
+	end.ID, end.Source = "event-2", "aws.arc"
+	_, err = updateKarpenterNodePool(context.Background(), end)
+	require.NoError(t, err)
+
+	z = getTestZonalShift(t, client, "event-1")
+	assert.Equal(t, metav1.ConditionTrue, conditionStatus(z, conditionRestored))
+	assert.NotNil(t, z.Status.RestoredAt)
+	assert.Equal(t, outcomeRestored, z.Status.NodePools[0].Outcome)
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1b"}, z.Status.NodePools[0].Zones)
+	require.NoError(t, reloaded.Load(context.Background()))
+	assert.Empty(t, reloaded.ActiveShifts())
+}
+
+func TestZonalShiftBackendKeepsPracticeShifts(t *testing.T) {
+	ctx := context.Background()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{zonalShiftGVR: "ZonalShiftList"})
+	backend := newZonalShiftBackend(client, time.Hour)
+
+	// A rehearsal and a real shift for the same zone reload as they were saved
+	startedAt := time.Now().Truncate(time.Second)
+	practice := Shift{ID: "practice-start", ZoneID: "use1-az1", Source: "aws.arc-zonal-shift", StartedAt: startedAt, Practice: true}
+	autoshift := Shift{ID: "autoshift-start", ZoneID: "use1-az1", Source: "aws.arc-zonal-shift", StartedAt: startedAt}
+	require.NoError(t, backend.SaveShifts(ctx, []Shift{practice, autoshift}))
+	assert.True(t, getTestZonalShift(t, client, "practice-start").Spec.Practice)
+
+	reloaded := NewShiftStore()
+	reloaded.SetBackend(backend)
+	require.NoError(t, reloaded.Load(ctx))
+	shift, ok := reloaded.ShiftForZone("use1-az1", true)
+	require.True(t, ok)
+	assert.Equal(t, "practice-start", shift.ID)
+	shift, ok = reloaded.ShiftForZone("use1-az1", false)
+	require.True(t, ok)
+	assert.Equal(t, "autoshift-start", shift.ID)
+}
+
+func TestZonalShiftBackendPrunesRestoredShifts(t *testing.T) {
+	ctx := context.Background()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{zonalShiftGVR: "ZonalShiftList"})
+	backend := newZonalShiftBackend(client, time.Hour)
+
+	shift := Shift{ID: "shift-1", ZoneID: "use1-az1", StartedAt: time.Now()}
+	require.NoError(t, backend.SaveShifts(ctx, []Shift{shift}))
+	require.NoError(t, backend.SaveShifts(ctx, nil))
+	assert.True(t, getTestZonalShift(t, client, "shift-1").restored())
+
+	// Kept within the retention period, deleted after it
+	require.NoError(t, backend.SaveShifts(ctx, nil))
+	getTestZonalShift(t, client, "shift-1")
+	require.NoError(t, backend.update(ctx, "shift-1", func(z *ZonalShift) {
+		restoredAt := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+		z.Status.RestoredAt = &restoredAt
+	}))
+	require.NoError(t, backend.SaveShifts(ctx, nil))
+	list, err := client.Resource(zonalShiftGVR).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, list.Items)
+}
+
+func TestZonalShiftCRDMatchesGoTypes(t *testing.T) {
+	assertSchemaMatches(t, "ZonalShift", crdSchema(t, "zonalshift-crd.yaml"), reflect.TypeOf(ZonalShift{}))
+}
+
+func TestZonalShiftName(t *testing.T) {
+	assert.Equal(t, "0b4a2e5c-9f5a-4bd6-8c5e-1f2a3b4c5d6e", zonalShiftName("0b4a2e5c-9f5a-4bd6-8c5e-1f2a3b4c5d6e"))
+	assert.Equal(t, "manual-shift-1", zonalShiftName("Manual_Shift 1"))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// defaultPolicyName is the ZonalShiftPolicy the service follows unless ZONAL_SHIFT_POLICY names another
+	defaultPolicyName = "default"
+
+	// reasonInvalidPolicy is the Kubernetes Event reason for a policy the service cannot use
+	reasonInvalidPolicy = "InvalidPolicy"
+)
+
+var policyGVR = schema.GroupVersionResource{Group: "zonalshift.karpenter.aws", Version: "v1alpha1", Resource: "zonalshiftpolicies"}
+
+//go:generate go run sigs.k8s.io/controller-tools/cmd/controller-gen@v0.17.2 object paths=.
+
+// ZonalShiftPolicy is the cluster-scoped custom resource that configures the
+// service. Its schema is in zonalshiftpolicy-crd.yaml.
+//
+// +kubebuilder:object:root=true
+type ZonalShiftPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ZonalShiftPolicySpec `json:"spec"`
+}
+
+// ZonalShiftPolicySpec declares which NodePools are managed and how shifts are applied to them
+// +kubebuilder:object:generate=true
+type ZonalShiftPolicySpec struct {
+	// NodePoolSelector selects the managed NodePools by label; all are managed when it is unset
+	NodePoolSelector *metav1.LabelSelector `json:"nodePoolSelector,omitempty"`
+	// NodePools, if set, limits the managed NodePools to these names
+	NodePools []string `json:"nodePools,omitempty"`
+	// MinZones is the fewest zones a shift may leave a NodePool able to use
+	MinZones int `json:"minZones,omitempty"`
+	// EvacuateNodes deletes the NodeClaims of a shifted NodePool in the removed zone
+	EvacuateNodes bool `json:"evacuateNodes,omitempty"`
+	// AutoModePool configures the pool created when only the EKS Auto Mode defaults exist
+	AutoModePool AutoModePoolSpec `json:"autoModePool,omitempty"`
+	// AllowedSources, if set, limits the event sources acted on, such as aws.arc
+	AllowedSources []string `json:"allowedSources,omitempty"`
+	// AllowedResources, if set, limits events to those naming a matching resource ARN.
+	// A trailing * matches any suffix.
+	AllowedResources []string `json:"allowedResources,omitempty"`
+	// Notifications, if set, replaces the notification targets from the environment
+	Notifications *NotificationTargets `json:"notifications,omitempty"`
+}
+
+// AutoModePoolSpec configures the NodePool created for a shift in an EKS Auto Mode cluster
+// +kubebuilder:object:generate=true
+type AutoModePoolSpec struct {
+	// Enabled turns creating the pool on or off; it is on when unset
+	Enabled *bool `json:"enabled,omitempty"`
+	// Name of the created pool, zonal-shift-karpenter when unset
+	Name string `json:"name,omitempty"`
+	// NodeClassRef replaces the node class copied from the general-purpose pool
+	NodeClassRef *NodeClassReference `json:"nodeClassRef,omitempty"`
+}
+
+// NodeClassReference names the node class a NodePool launches nodes with
+// +kubebuilder:object:generate=true
+type NodeClassReference struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Group string `json:"group"`
+}
+
+// NotificationTargets are the places notifications are sent
+// +kubebuilder:object:generate=true
+type NotificationTargets struct {
+	WebhookURL      string `json:"webhookURL,omitempty"`
+	SlackWebhookURL string `json:"slackWebhookURL,omitempty"`
+	SNSTopicARN     string `json:"snsTopicARN,omitempty"`
+}
+
+func (s AutoModePoolSpec) enabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+func (s AutoModePoolSpec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return autoModePoolName
+}
+
+// validate reports why the service cannot follow the spec
+func (s ZonalShiftPolicySpec) validate() error {
+	if s.MinZones < 0 {
+		return fmt.Errorf("minZones must not be negative, got %d", s.MinZones)
+	}
+	if s.NodePoolSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(s.NodePoolSelector); err != nil {
+			return fmt.Errorf("invalid nodePoolSelector: %v", err)
+		}
+	}
+	return nil
+}
+
+// activePolicy is the ZonalShiftPolicy currently in force, nil when there is none
+var activePolicy atomic.Pointer[ZonalShiftPolicy]
+
+// configureProcessor sets the parts of a Processor a ZonalShiftPolicy controls,
+// from the active policy when there is one and from the configuration otherwise
+func configureProcessor(p *Processor) {
+	p.Policy = SafetyPolicy{MinZones: appConfig.MinRemainingZones}
+	p.Selector = appConfig.NodePoolSelector
+	p.DryRun = appConfig.DryRun
+	p.NodePools, p.EvacuateNodes, p.AutoModePool = nil, false, AutoModePoolSpec{}
+	p.AllowedSources, p.AllowedResources = nil, nil
+
+	policy := activePolicy.Load()
+	if policy == nil {
+		return
+	}
+	spec := policy.Spec
+	if spec.MinZones > 0 {
+		p.Policy.MinZones = spec.MinZones
+	}
+	if spec.NodePoolSelector != nil {
+		// validate has already checked the selector
+		selector, _ := metav1.LabelSelectorAsSelector(spec.NodePoolSelector)
+		p.Selector = selector.String()
+	}
+	p.NodePools = spec.NodePools
+	p.EvacuateNodes = spec.EvacuateNodes
+	p.AutoModePool = spec.AutoModePool
+	p.AllowedSources = spec.AllowedSources
+	p.AllowedResources = spec.AllowedResources
+}
+
+// ignores returns why the processor does not act on an event, or an empty
+// string if it does. Shifts requested through the admin API or restored on
+// expiry are never ignored.
+func (p *Processor) ignores(event Event) string {
+	if event.Source == manualEventSource || event.Source == expiryEventSource {
+		return ""
+	}
+	if len(p.AllowedSources) > 0 && !slices.Contains(p.AllowedSources, event.Source) {
+		return fmt.Sprintf("source %q is not allowed by policy", event.Source)
+	}
+	if len(p.AllowedResources) > 0 && !slices.ContainsFunc(event.Resources, func(resource string) bool {
+		return slices.ContainsFunc(p.AllowedResources, func(pattern string) bool { return matchesPattern(pattern, resource) })
+	}) {
+		return "no resource is allowed by policy"
+	}
+	return ""
+}
+
+// matchesPattern matches value exactly, or by prefix when pattern ends in *
+func matchesPattern(pattern, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+// PolicyWatcher follows one ZonalShiftPolicy, making it the active policy
+// whenever it changes. Every replica runs one.
+type PolicyWatcher struct {
+	name     string
+	informer cache.SharedIndexInformer
+	handler  cache.ResourceEventHandlerRegistration
+	// onChange is called with the new policy, or nil when it is deleted
+	onChange func(*ZonalShiftPolicy)
+}
+
+// NewPolicyWatcher watches the ZonalShiftPolicy called name
+func NewPolicyWatcher(client dynamic.Interface, name string, onChange func(*ZonalShiftPolicy)) *PolicyWatcher {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, metav1.NamespaceAll, func(opts *metav1.ListOptions) {
+		opts.FieldSelector = "metadata.name=" + name
+	})
+	w := &PolicyWatcher{name: name, informer: factory.ForResource(policyGVR).Informer(), onChange: onChange}
+	// The informer is new, so adding a handler cannot fail
+	w.handler, _ = w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.update,
+		UpdateFunc: func(_, obj interface{}) { w.update(obj) },
+		DeleteFunc: func(interface{}) {
+			slog.Info("ZonalShiftPolicy deleted, using configuration from the environment", "policy", w.name)
+			activePolicy.Store(nil)
+			w.onChange(nil)
+		},
+	})
+	return w
+}
+
+func (w *PolicyWatcher) update(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || u.GetName() != w.name {
+		return
+	}
+	policy, err := decodePolicy(u)
+	if err == nil {
+		err = policy.Spec.validate()
+	}
+	if err != nil {
+		slog.Error("Ignoring invalid ZonalShiftPolicy, keeping the previous configuration", "policy", w.name, "error", err)
+		if eventRecorder != nil {
+			eventRecorder.Eventf(u, corev1.EventTypeWarning, reasonInvalidPolicy, "Ignoring invalid policy: %v", err)
+		}
+		return
+	}
+	slog.Info("Applying ZonalShiftPolicy", "policy", w.name, "generation", u.GetGeneration())
+	activePolicy.Store(policy)
+	w.onChange(policy)
+}
+
+// Run watches the policy until ctx is done
+func (w *PolicyWatcher) Run(ctx context.Context) {
+	w.informer.Run(ctx.Done())
+}
+
+// HasSynced reports whether the policy read since Run started has been applied
+func (w *PolicyWatcher) HasSynced() bool {
+	return w.handler.HasSynced()
+}
+
+// decodePolicy converts an unstructured object into a ZonalShiftPolicy
+func decodePolicy(obj *unstructured.Unstructured) (*ZonalShiftPolicy, error) {
+	var policy ZonalShiftPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse ZonalShiftPolicy %s: %v", obj.GetName(), err)
+	}
+	return &policy, nil
+}
+
+// runPolicyWatcher follows the ZonalShiftPolicy named by ZONAL_SHIFT_POLICY,
+// swapping in its notification targets when it sets them. Without the CRD
+// installed the service keeps using the environment. It closes synced once
+// the policy in force is known, or once it stops trying to find out.
+func runPolicyWatcher(ctx context.Context, k8sConfig *rest.Config, synced chan<- struct{}) error {
+	var syncOnce sync.Once
+	markSynced := func() { syncOnce.Do(func() { close(synced) }) }
+	defer markSynced()
+
+	disc, err := discovery.NewDiscoveryClientForConfig(k8sConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery client: %v", err)
+	}
+	if _, err := disc.ServerResourcesForGroupVersion(policyGVR.GroupVersion().String()); err != nil {
+		slog.Info("ZonalShiftPolicy CRD is not installed, using configuration from the environment", "error", err)
+		return nil
+	}
+	client, err := newDynamicClient(k8sConfig)
+	if err != nil {
+		return err
+	}
+
+	name := appConfig.Policy
+	envNotifier := notifier.Load()
+	watcher := NewPolicyWatcher(client, name, func(policy *ZonalShiftPolicy) {
+		n := envNotifier
+		if policy != nil && policy.Spec.Notifications != nil {
+			var err error
+			if n, err = newNotifierForTargets(ctx, *policy.Spec.Notifications); err != nil {
+				slog.Error("Failed to configure notifications from ZonalShiftPolicy", "policy", name, "error", err)
+				return
+			}
+		}
+		// Swap between events so each one is notified through a single notifier
+		processingMu.Lock()
+		replaceNotifier(n)
+		processingMu.Unlock()
+	})
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), watcher.HasSynced) {
+			slog.Info("ZonalShiftPolicy synced", "policy", name, "found", activePolicy.Load() != nil)
+			markSynced()
+		}
+	}()
+	watcher.Run(ctx)
+	return nil
+}
+
+// loadActivePolicy makes the ZonalShiftPolicy called name the active policy,
+// for commands that run once instead of watching it. A missing policy or CRD
+// leaves the configuration from the environment in force.
+func loadActivePolicy(ctx context.Context, client dynamic.Interface, name string) error {
+	u, err := client.Resource(policyGVR).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ZonalShiftPolicy %s: %v", name, err)
+	}
+	policy, err := decodePolicy(u)
+	if err == nil {
+		err = policy.Spec.validate()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid ZonalShiftPolicy %s: %v", name, err)
+	}
+	activePolicy.Store(policy)
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+func newTestPolicy(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "zonalshift.karpenter.aws/v1alpha1",
+		"kind":       "ZonalShiftPolicy",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec":       spec,
+	}}
+}
+
+func newTestNodeClaim(name, nodePool, zone string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "karpenter.sh/v1",
+		"kind":       "NodeClaim",
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]interface{}{nodePoolLabelKey: nodePool, zoneLabelKey: zone},
+		},
+	}}
+}
+
+// crdSchema reads the openAPIV3Schema of the only version in a CRD manifest
+func crdSchema(t *testing.T, path string) map[string]interface{} {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var crd struct {
+		Spec struct {
+			Versions []struct {
+				Schema struct {
+					OpenAPIV3Schema map[string]interface{} `json:"openAPIV3Schema"`
+				} `json:"schema"`
+			} `json:"versions"`
+		} `json:"spec"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &crd))
+	require.Len(t, crd.Spec.Versions, 1)
+	return crd.Spec.Versions[0].Schema.OpenAPIV3Schema
+}
+
+var (
+	metaTimeType   = reflect.TypeOf(metav1.Time{})
+	objectMetaType = reflect.TypeOf(metav1.ObjectMeta{})
+)
+
+// assertSchemaMatches checks that the schema at path describes exactly the JSON
+// fields of typ, with matching types and required fields
+func assertSchemaMatches(t *testing.T, path string, schema map[string]interface{}, typ reflect.Type) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	var want string
+	switch {
+	case typ == metaTimeType, typ.Kind() == reflect.String:
+		want = "string"
+	case typ.Kind() == reflect.Bool:
+		want = "boolean"
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Uint64:
+		want = "integer"
+	case typ.Kind() == reflect.Slice:
+		want = "array"
+	default:
+		want = "object"
+	}
+	if !assert.Equal(t, want, schema["type"], "type of %s", path) {
+		return
+	}
+	switch {
+	case typ.Kind() == reflect.Slice:
+		items, _ := schema["items"].(map[string]interface{})
+		assertSchemaMatches(t, path+"[]", items, typ.Elem())
+		return
+	case typ.Kind() != reflect.Struct, typ == metaTimeType, typ == objectMetaType:
+		return
+	}
+
+	fields, required := map[string]reflect.Type{}, []string(nil)
+	collectJSONFields(typ, fields, &required)
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, field := range fields {
+		property, ok := properties[name].(map[string]interface{})
+		if assert.True(t, ok, "%s.%s is missing from the schema", path, name) {
+			assertSchemaMatches(t, path+"."+name, property, field)
+		}
+	}
+	for name := range properties {
+		_, ok := fields[name]
+		assert.True(t, ok, "%s.%s is in the schema but not the Go type", path, name)
+	}
+	var schemaRequired []string
+	if list, ok := schema["required"].([]interface{}); ok {
+		for _, name := range list {
+			schemaRequired = append(schemaRequired, name.(string))
+		}
+	}
+	slices.Sort(required)
+	slices.Sort(schemaRequired)
+	assert.Equal(t, required, schemaRequired, "required fields of %s", path)
+}
+
+// collectJSONFields adds the JSON fields of a struct, following inlined structs
+func collectJSONFields(typ reflect.Type, fields map[string]reflect.Type, required *[]string) {
+	for i := range typ.NumField() {
+		field := typ.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" && (field.Anonymous || options == "inline") {
+			collectJSONFields(field.Type, fields, required)
+			continue
+		}
+		fields[name] = field.Type
+		if !slices.Contains(strings.Split(options, ","), "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func TestPolicyCRDMatchesGoTypes(t *testing.T) {
+	assertSchemaMatches(t, "ZonalShiftPolicy", crdSchema(t, "zonalshiftpolicy-crd.yaml"), reflect.TypeOf(ZonalShiftPolicy{}))
+}
+
+// usePolicy makes policy the active ZonalShiftPolicy for the rest of the test
+func usePolicy(t *testing.T, policy *ZonalShiftPolicy) {
+	original := activePolicy.Load()
+	activePolicy.Store(policy)
+	t.Cleanup(func() { activePolicy.Store(original) })
+}
+
+func TestPolicyConfiguresProcessor(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.NodePoolSelector = "team=infra" })
+
+	processor := NewProcessor(nil, testZones)
+	configureProcessor(processor)
+	assert.Equal(t, "team=infra", processor.Selector)
+	assert.Equal(t, defaultSafetyPolicy, processor.Policy)
+
+	policy, err := decodePolicy(newTestPolicy("default", map[string]interface{}{
+		"nodePoolSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"zonal-shift": "enabled"}},
+		"nodePools":        []interface{}{"default"},
+		"minZones":         int64(2),
+		"evacuateNodes":    true,
+		"autoModePool":     map[string]interface{}{"enabled": false},
+		"allowedSources":   []interface{}{"aws.arc"},
+		"allowedResources": []interface{}{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/web/*"},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, policy.Spec.validate())
+	usePolicy(t, policy)
+
+	configureProcessor(processor)
+	assert.Equal(t, "zonal-shift=enabled", processor.Selector)
+	assert.Equal(t, []string{"default"}, processor.NodePools)
+	assert.Equal(t, SafetyPolicy{MinZones: 2}, processor.Policy)
+	assert.True(t, processor.EvacuateNodes)
+	assert.False(t, processor.AutoModePool.enabled())
+
+	managed, err := processor.manages(newTestNodePool("default"))
+	require.NoError(t, err)
+	assert.False(t, managed, "pool without the selected label")
+
+	event := testShiftEvent("Autoshift In Progress")
+	event.Source = "aws.arc"
+	event.Resources = []string{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/web/50dc6c495c0c9188"}
+	assert.Empty(t, processor.ignores(event))
+	event.Resources = []string{"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/app/api/50dc6c495c0c9188"}
+	assert.Equal(t, "no resource is allowed by policy", processor.ignores(event))
+	event.Source = "aws.health"
+	assert.Contains(t, processor.ignores(event), "aws.health")
+	event.Source = manualEventSource
+	assert.Empty(t, processor.ignores(event))
+
+	invalid, err := decodePolicy(newTestPolicy("default", map[string]interface{}{"minZones": int64(-1)}))
+	require.NoError(t, err)
+	assert.Error(t, invalid.Spec.validate())
+}
+
+func TestPolicyWatcherFollowsChanges(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{policyGVR: "ZonalShiftPolicyList"})
+	usePolicy(t, nil)
+	changed := make(chan *ZonalShiftPolicy, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewPolicyWatcher(client, "default", func(p *ZonalShiftPolicy) { changed <- p }).Run(ctx)
+
+	next := func() *ZonalShiftPolicy {
+		select {
+		case p := <-changed:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("policy change not seen")
+			return nil
+		}
+	}
+
+	policies := client.Resource(policyGVR)
+	_, err := policies.Create(ctx, newTestPolicy("default", map[string]interface{}{"minZones": int64(2)}), metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, next().Spec.MinZones)
+	assert.Equal(t, 2, activePolicy.Load().Spec.MinZones)
+
+	// An invalid update is ignored, keeping the previous policy
+	_, err = policies.Update(ctx, newTestPolicy("default", map[string]interface{}{"minZones": int64(-1)}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	_, err = policies.Update(ctx, newTestPolicy("default", map[string]interface{}{"minZones": int64(3), "evacuateNodes": true}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	policy := next()
+	assert.Equal(t, 3, policy.Spec.MinZones)
+	assert.True(t, policy.Spec.EvacuateNodes)
+
+	require.NoError(t, policies.Delete(ctx, "default", metav1.DeleteOptions{}))
+	assert.Nil(t, next())
+	assert.Nil(t, activePolicy.Load())
+}
+
+func TestZonalShiftPolicyDeepCopy(t *testing.T) {
+	enabled := false
+	policy := &ZonalShiftPolicy{Spec: ZonalShiftPolicySpec{
+		NodePoolSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "web"}},
+		NodePools:        []string{"default"},
+		AutoModePool:     AutoModePoolSpec{Enabled: &enabled, NodeClassRef: &NodeClassReference{Name: "default"}},
+		Notifications:    &NotificationTargets{WebhookURL: "https://hooks.example.com"},
+	}}
+	copied := policy.DeepCopyObject().(*ZonalShiftPolicy)
+	require.Equal(t, policy, copied)
+
+	copied.Spec.NodePoolSelector.MatchLabels["team"] = "api"
+	copied.Spec.NodePools[0] = "other"
+	*copied.Spec.AutoModePool.Enabled = true
+	copied.Spec.AutoModePool.NodeClassRef.Name = "other"
+	copied.Spec.Notifications.WebhookURL = ""
+	assert.Equal(t, "web", policy.Spec.NodePoolSelector.MatchLabels["team"])
+	assert.Equal(t, []string{"default"}, policy.Spec.NodePools)
+	assert.False(t, *policy.Spec.AutoModePool.Enabled)
+	assert.Equal(t, "default", policy.Spec.AutoModePool.NodeClassRef.Name)
+	assert.Equal(t, "https://hooks.example.com", policy.Spec.Notifications.WebhookURL)
+}
+
+func TestPolicyWatcherSyncsExistingPolicy(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{policyGVR: "ZonalShiftPolicyList"},
+		newTestPolicy("default", map[string]interface{}{"minZones": int64(2)}))
+	usePolicy(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := NewPolicyWatcher(client, "default", func(*ZonalShiftPolicy) {})
+	go watcher.Run(ctx)
+
+	// Once synced, the policy is already in force
+	require.True(t, cache.WaitForCacheSync(ctx.Done(), watcher.HasSynced))
+	require.NotNil(t, activePolicy.Load())
+	assert.Equal(t, 2, activePolicy.Load().Spec.MinZones)
+}
+
+func TestControllersWaitForPolicySync(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	useTestProcessor(t, NewProcessor(client, testZones))
+	useTestConfig(t, func(c *Config) { c.Queue.PollInterval = metav1.Duration{Duration: 10 * time.Millisecond} })
+	queue := newMemoryQueue()
+	useTestQueue(t, queue)
+	require.NoError(t, queue.Enqueue(context.Background(), testShiftEvent("Autoshift In Progress")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	policySynced := make(chan struct{})
+	go runControllers(ctx, nil, policySynced)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, pendingEvents(t, queue), 1, "processed before the policy was read")
+	close(policySynced)
+	assert.Eventually(t, func() bool { return len(pendingEvents(t, queue)) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPolicyEvacuatesNodesAndNamesAutoModePool(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{nodePoolGVR: "NodePoolList", nodeClaimGVR: "NodeClaimList"},
+		newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodeClaim("default-a", "default", "us-east-1a"),
+		newTestNodeClaim("default-b", "default", "us-east-1b"),
+		newTestNodeClaim("other-a", "other", "us-east-1a"),
+	)
+	processor := NewProcessor(client, testZones)
+	processor.EvacuateNodes = true
+	ctx := context.Background()
+
+	changes, err := processor.PlanShift(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.NoError(t, processor.Apply(ctx, changes))
+
+	claims, err := client.Resource(nodeClaimGVR).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, claim := range claims.Items {
+		names = append(names, claim.GetName())
+	}
+	assert.ElementsMatch(t, []string{"default-b", "other-a"}, names)
+
+	autoMode := newTestClient(
+		newTestNodePool("general-purpose", zoneRequirementOf("In", "us-east-1a", "us-east-1b")),
+		newTestNodePool("system"),
+	)
+	processor = NewProcessor(autoMode, testZones)
+	processor.AutoModePool = AutoModePoolSpec{Name: "shift-pool", NodeClassRef: &NodeClassReference{Name: "shift", Kind: "NodeClass", Group: "eks.amazonaws.com"}}
+	changes, err = processor.PlanShift(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.NoError(t, processor.Apply(ctx, changes))
+	assert.Equal(t, "shift", getTestNodePool(t, autoMode, "shift-pool").Spec.Template.Spec.NodeClassRef.Name)
+
+	// Without the Auto Mode pool the defaults are shifted like any other pool
+	disabled := false
+	processor.AutoModePool = AutoModePoolSpec{Enabled: &disabled}
+	changes, err = processor.PlanShift(ctx, testShiftEvent("Autoshift In Progress"))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "general-purpose", changes[0].Name)
+}
+
+func TestIgnoredEventsLeaveNodePools(t *testing.T) {
+	client := newTestClient(newTestNodePool("default", zoneRequirementOf("In", "us-east-1a", "us-east-1b")))
+	processor := NewProcessor(client, testZones)
+	processor.AllowedSources = []string{"aws.arc"}
+	useTestProcessor(t, processor)
+
+	event := testShiftEvent("Autoshift In Progress")
+	event.Source = "aws.health"
+	record, err := updateKarpenterNodePool(context.Background(), event)
+	require.NoError(t, err)
+	assert.Equal(t, outcomeIgnored, record.Outcome)
+	assert.Contains(t, record.Reason, "aws.health")
+	assert.Empty(t, store.ActiveShifts())
+	assert.Equal(t, []string{"us-east-1a", "us-east-1b"}, getTestNodePool(t, client, "default").Spec.Template.Spec.Requirements[0].Values)
+}
@@ -0,0 +1,132 @@
+//go:build !ignore_autogenerated
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoModePoolSpec) DeepCopyInto(out *AutoModePoolSpec) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.NodeClassRef != nil {
+		in, out := &in.NodeClassRef, &out.NodeClassRef
+		*out = new(NodeClassReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoModePoolSpec.
+func (in *AutoModePoolSpec) DeepCopy() *AutoModePoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoModePoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeClassReference) DeepCopyInto(out *NodeClassReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeClassReference.
+func (in *NodeClassReference) DeepCopy() *NodeClassReference {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeClassReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotificationTargets) DeepCopyInto(out *NotificationTargets) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotificationTargets.
+func (in *NotificationTargets) DeepCopy() *NotificationTargets {
+	if in == nil {
+		return nil
+	}
+	out := new(NotificationTargets)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ZonalShiftPolicy) DeepCopyInto(out *ZonalShiftPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ZonalShiftPolicy.
+func (in *ZonalShiftPolicy) DeepCopy() *ZonalShiftPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ZonalShiftPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ZonalShiftPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ZonalShiftPolicySpec) DeepCopyInto(out *ZonalShiftPolicySpec) {
+	*out = *in
+	if in.NodePoolSelector != nil {
+		in, out := &in.NodePoolSelector, &out.NodePoolSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodePools != nil {
+		in, out := &in.NodePools, &out.NodePools
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.AutoModePool.DeepCopyInto(&out.AutoModePool)
+	if in.AllowedSources != nil {
+		in, out := &in.AllowedSources, &out.AllowedSources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedResources != nil {
+		in, out := &in.AllowedResources, &out.AllowedResources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Notifications != nil {
+		in, out := &in.Notifications, &out.Notifications
+		*out = new(NotificationTargets)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ZonalShiftPolicySpec.
+func (in *ZonalShiftPolicySpec) DeepCopy() *ZonalShiftPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ZonalShiftPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}